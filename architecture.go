@@ -0,0 +1,282 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// An Architecture describes the structure of a Bot's
+// network and the way its inputs are encoded.
+//
+// An Architecture is saved along with a Bot, so that
+// training samples and chats can be encoded to match the
+// network.
+// A nil *Architecture is equivalent to the result of
+// DefaultArchitecture.
+type Architecture struct {
+	// StateSizes lists the output sizes of the LSTM layers.
+	StateSizes []int
+
+	// Embedding, if non-zero, is the size of a learned
+	// embedding which is fed to the first LSTM in place of
+	// a one-hot vector.
+	// When an embedding is used, each input vector stores
+	// the index of the input token rather than a one-hot
+	// encoding of it.
+	Embedding int
+
+	// Speakers, if greater than 1, is the number of
+	// external speakers which the bot can tell apart in a
+	// group conversation.
+	// Speaker 0 is marked with StartExternalMsg, and every
+	// other speaker has its own control token after the
+	// standard inputs.
+	// Speakers beyond the last slot share slots.
+	Speakers int
+
+	// TimeGaps adds GapBucketCount inputs which encode the
+	// time since the previous message at the start of
+	// every message.
+	// The inputs follow the token in each input vector.
+	TimeGaps bool
+
+	// Personas lists the labels of the personas which the
+	// bot can speak as.
+	// A one-hot encoding of the current persona is added
+	// to every input vector, after the time gap inputs.
+	Personas []string `json:",omitempty"`
+
+	// Attributes lists the labels of the message attributes
+	// which can be requested from the bot.
+	// Each input vector encodes the attributes of its
+	// message, after the persona inputs.
+	Attributes []string `json:",omitempty"`
+}
+
+// InputControls stores the control inputs which go along
+// with a token in an input vector.
+type InputControls struct {
+	// Gap is 0 if the time since the previous message is
+	// unknown or if the token does not start a message.
+	// Otherwise, it is 1 plus the GapBucket of that time.
+	Gap int
+
+	// Persona is the label of the persona which the bot
+	// speaks as, or "" for no particular persona.
+	Persona string
+
+	// Attributes are the labels of the attributes of the
+	// token's message.
+	Attributes []string
+}
+
+// DefaultArchitecture returns the architecture used by
+// NewBot.
+func DefaultArchitecture() *Architecture {
+	return &Architecture{StateSizes: []int{400, 300, 200}}
+}
+
+// Validate checks that the architecture describes a
+// network which can be created.
+func (a *Architecture) Validate() error {
+	if a == nil {
+		return nil
+	}
+	if len(a.StateSizes) == 0 {
+		return errors.New("architecture has no LSTM layers")
+	}
+	for _, size := range a.StateSizes {
+		if size <= 0 {
+			return errors.New("architecture has a non-positive state size")
+		}
+	}
+	if a.Embedding < 0 {
+		return errors.New("architecture has a negative embedding size")
+	}
+	if a.Speakers < 0 {
+		return errors.New("architecture has a negative speaker count")
+	}
+	seen := map[string]bool{}
+	for _, persona := range a.Personas {
+		if persona == "" {
+			return errors.New("architecture has an empty persona label")
+		} else if seen[persona] {
+			return errors.New("architecture has a duplicate persona: " + persona)
+		}
+		seen[persona] = true
+	}
+	seen = map[string]bool{}
+	for _, attr := range a.Attributes {
+		if attr == "" {
+			return errors.New("architecture has an empty attribute label")
+		} else if seen[attr] {
+			return errors.New("architecture has a duplicate attribute: " + attr)
+		}
+		seen[attr] = true
+	}
+	return nil
+}
+
+// TokenCount returns the number of distinct tokens,
+// which is InputCount plus any extra speaker tokens.
+func (a *Architecture) TokenCount() int {
+	if a != nil && a.Speakers > 1 {
+		return InputCount + a.Speakers - 1
+	}
+	return InputCount
+}
+
+// InputSize returns the size of the network's input
+// vectors.
+func (a *Architecture) InputSize() int {
+	if a != nil && a.Embedding != 0 {
+		return 1 + a.controlInputs()
+	}
+	return a.TokenCount() + a.controlInputs()
+}
+
+// controlInputs returns the number of inputs which follow
+// the token in each input vector.
+func (a *Architecture) controlInputs() int {
+	if a == nil {
+		return 0
+	}
+	res := len(a.Personas) + len(a.Attributes)
+	if a.TimeGaps {
+		res += GapBucketCount
+	}
+	return res
+}
+
+// PersonaIndex returns the index of a persona label in
+// a.Personas, or -1 if it is not present.
+func (a *Architecture) PersonaIndex(persona string) int {
+	if a == nil || persona == "" {
+		return -1
+	}
+	return labelIndex(a.Personas, persona)
+}
+
+// AttributeIndex returns the index of an attribute label
+// in a.Attributes, or -1 if it is not present.
+func (a *Architecture) AttributeIndex(attr string) int {
+	if a == nil || attr == "" {
+		return -1
+	}
+	return labelIndex(a.Attributes, attr)
+}
+
+// CheckControls returns an error if the persona or any
+// of the attributes of the controls is not one of the
+// architecture's labels.
+// An empty persona is always allowed.
+func (a *Architecture) CheckControls(c InputControls) error {
+	if c.Persona != "" && a.PersonaIndex(c.Persona) < 0 {
+		return unknownLabelError("persona", c.Persona, a.personas())
+	}
+	for _, attr := range c.Attributes {
+		if a.AttributeIndex(attr) < 0 {
+			return unknownLabelError("attribute", attr, a.attributes())
+		}
+	}
+	return nil
+}
+
+func (a *Architecture) personas() []string {
+	if a == nil {
+		return nil
+	}
+	return a.Personas
+}
+
+func (a *Architecture) attributes() []string {
+	if a == nil {
+		return nil
+	}
+	return a.Attributes
+}
+
+func unknownLabelError(kind, label string, known []string) error {
+	if len(known) == 0 {
+		return fmt.Errorf("unknown %s %q (the architecture has no %ss)", kind, label, kind)
+	}
+	return fmt.Errorf("unknown %s %q (the architecture has %s)", kind, label,
+		strings.Join(known, ", "))
+}
+
+func labelIndex(labels []string, label string) int {
+	for i, x := range labels {
+		if x == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// SpeakerToken returns the control token which starts a
+// message from an external speaker.
+func (a *Architecture) SpeakerToken(speaker int) int {
+	if speaker <= 0 || a == nil || a.Speakers <= 1 {
+		return StartExternalMsg
+	}
+	return InputCount + (speaker-1)%(a.Speakers-1)
+}
+
+// IsStartToken checks if a token starts a message from
+// the bot or from any external speaker.
+func (a *Architecture) IsStartToken(token int) bool {
+	return token == StartExternalMsg || token == StartBotMsg ||
+		(token >= InputCount && token < a.TokenCount())
+}
+
+// TokenVector encodes an input token (a byte or a control
+// token such as StartBotMsg) as an input vector with no
+// control inputs set.
+func (a *Architecture) TokenVector(token int) linalg.Vector {
+	return a.InputVector(token, InputControls{})
+}
+
+// InputVector encodes an input token along with its
+// control inputs.
+// Control inputs which the architecture does not use are
+// ignored.
+func (a *Architecture) InputVector(token int, c InputControls) linalg.Vector {
+	var res linalg.Vector
+	if a != nil && a.Embedding != 0 {
+		res = linalg.Vector{float64(token)}
+	} else {
+		res = a.OutputVector(token)
+	}
+	if n := a.controlInputs(); n != 0 {
+		controls := make(linalg.Vector, n)
+		var offset int
+		if a.TimeGaps {
+			if c.Gap > 0 {
+				controls[c.Gap-1] = 1
+			}
+			offset += GapBucketCount
+		}
+		if idx := a.PersonaIndex(c.Persona); idx >= 0 {
+			controls[offset+idx] = 1
+		}
+		offset += len(a.Personas)
+		for _, attr := range c.Attributes {
+			if idx := a.AttributeIndex(attr); idx >= 0 {
+				controls[offset+idx] = 1
+			}
+		}
+		res = append(res, controls...)
+	}
+	return res
+}
+
+// OutputVector encodes a token as a one-hot vector over
+// all of the tokens, as the network outputs it.
+func (a *Architecture) OutputVector(token int) linalg.Vector {
+	res := make(linalg.Vector, a.TokenCount())
+	res[token] = 1
+	return res
+}
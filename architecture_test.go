@@ -0,0 +1,88 @@
+package chatbot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestInputVectorControls(t *testing.T) {
+	arch := &Architecture{
+		StateSizes: []int{10},
+		Speakers:   3,
+		TimeGaps:   true,
+		Personas:   []string{"alice", "bob"},
+		Attributes: []string{"formal", "short", "emoji"},
+	}
+	controls := InputControls{
+		Gap:        3,
+		Persona:    "bob",
+		Attributes: []string{"short", "emoji", "unknown"},
+	}
+	// Gaps come first, then personas, then attributes.
+	expectedControls := linalg.Vector{0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 1}
+
+	vec := arch.InputVector(StartBotMsg, controls)
+	if len(vec) != arch.InputSize() {
+		t.Fatalf("expected size %d but got %d", arch.InputSize(), len(vec))
+	}
+	tokens := arch.TokenCount()
+	if !reflect.DeepEqual(vec[:tokens], arch.OutputVector(StartBotMsg)) {
+		t.Error("unexpected token encoding")
+	}
+	if !reflect.DeepEqual(vec[tokens:], expectedControls) {
+		t.Errorf("expected controls %v but got %v", expectedControls, vec[tokens:])
+	}
+
+	arch.Embedding = 8
+	vec = arch.InputVector('x', controls)
+	if len(vec) != arch.InputSize() || vec[0] != 'x' {
+		t.Errorf("unexpected embedding input %v", vec)
+	} else if !reflect.DeepEqual(vec[1:], expectedControls) {
+		t.Errorf("expected controls %v but got %v", expectedControls, vec[1:])
+	}
+
+	arch = &Architecture{StateSizes: []int{10}, Attributes: []string{"short"}}
+	vec = arch.InputVector('x', controls)
+	if !reflect.DeepEqual(vec[arch.TokenCount():], linalg.Vector{1}) {
+		t.Errorf("unexpected controls without gaps or personas: %v", vec[arch.TokenCount():])
+	}
+}
+
+func TestSpeakerToken(t *testing.T) {
+	tests := []struct {
+		arch     *Architecture
+		speaker  int
+		expected int
+	}{
+		{nil, 0, StartExternalMsg},
+		{nil, 2, StartExternalMsg},
+		{&Architecture{Speakers: 1}, 1, StartExternalMsg},
+		{&Architecture{Speakers: 3}, 0, StartExternalMsg},
+		{&Architecture{Speakers: 3}, 1, InputCount},
+		{&Architecture{Speakers: 3}, 2, InputCount + 1},
+		// Speakers past the last slot wrap around.
+		{&Architecture{Speakers: 3}, 3, InputCount},
+		{&Architecture{Speakers: 3}, 4, InputCount + 1},
+		{&Architecture{Speakers: 3}, 5, InputCount},
+	}
+	for _, test := range tests {
+		actual := test.arch.SpeakerToken(test.speaker)
+		if actual != test.expected {
+			t.Errorf("speakers %d, speaker %d: expected token %d but got %d",
+				test.arch.TokenCount()-InputCount+1, test.speaker, test.expected, actual)
+		}
+		if !test.arch.IsStartToken(actual) {
+			t.Errorf("token %d is not a start token", actual)
+		}
+	}
+
+	arch := &Architecture{StateSizes: []int{10}, Speakers: 3}
+	if arch.TokenCount() != InputCount+2 {
+		t.Errorf("expected %d tokens but got %d", InputCount+2, arch.TokenCount())
+	}
+	if arch.IsStartToken(InputCount+2) || arch.IsStartToken('x') {
+		t.Error("unexpected start token")
+	}
+}
@@ -0,0 +1,137 @@
+package chatbot
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// An AttributeTagger labels messages with attributes,
+// such as their length or style, so that a bot can be
+// trained to produce replies with requested attributes.
+type AttributeTagger interface {
+	Tag(body string) []string
+}
+
+// An AttributeTaggerChain combines the attributes from a
+// list of AttributeTaggers.
+type AttributeTaggerChain []AttributeTagger
+
+// Tag returns the attributes from every tagger in the
+// chain.
+func (a AttributeTaggerChain) Tag(body string) []string {
+	var res []string
+	for _, x := range a {
+		res = append(res, x.Tag(body)...)
+	}
+	return res
+}
+
+// DefaultAttributeTaggers returns a chain of taggers for
+// message length, emoji use, and formality.
+func DefaultAttributeTaggers() AttributeTaggerChain {
+	return AttributeTaggerChain{
+		&LengthTagger{Short: 20, Long: 200},
+		&EmojiTagger{},
+		&FormalityTagger{},
+	}
+}
+
+// LengthTagger labels messages "short" if they are
+// shorter than Short bytes, or "long" if they are at
+// least Long bytes.
+type LengthTagger struct {
+	Short int
+	Long  int
+}
+
+// Tag returns the length attribute of the body, if any.
+func (l *LengthTagger) Tag(body string) []string {
+	if len(body) < l.Short {
+		return []string{"short"}
+	} else if len(body) >= l.Long {
+		return []string{"long"}
+	}
+	return nil
+}
+
+// EmojiTagger labels messages which contain emoji
+// "emoji".
+type EmojiTagger struct{}
+
+// Tag returns the emoji attribute of the body, if any.
+func (e *EmojiTagger) Tag(body string) []string {
+	for _, r := range body {
+		if isEmoji(r) {
+			return []string{"emoji"}
+		}
+	}
+	return nil
+}
+
+func isEmoji(r rune) bool {
+	return (r >= 0x1f300 && r <= 0x1faff) || (r >= 0x2600 && r <= 0x27bf) ||
+		(r >= 0x1f1e6 && r <= 0x1f1ff)
+}
+
+// FormalityTagger labels messages "formal" if they start
+// with a capital letter and end with punctuation, or
+// "casual" if they contain letters but no capitals.
+type FormalityTagger struct{}
+
+// Tag returns the formality attribute of the body, if
+// any.
+func (f *FormalityTagger) Tag(body string) []string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil
+	}
+	first, _ := utf8.DecodeRuneInString(body)
+	last, _ := utf8.DecodeLastRuneInString(body)
+	if unicode.IsUpper(first) && strings.ContainsRune(".!?", last) {
+		return []string{"formal"}
+	}
+	var letters bool
+	for _, r := range body {
+		if unicode.IsUpper(r) {
+			return nil
+		} else if unicode.IsLetter(r) {
+			letters = true
+		}
+	}
+	if letters {
+		return []string{"casual"}
+	}
+	return nil
+}
+
+// tagConversations adds the tagger's attributes to every
+// message.
+func tagConversations(t AttributeTagger, convos [][]message) {
+	if t == nil {
+		return
+	}
+	for _, convo := range convos {
+		for i, msg := range convo {
+			convo[i].Attributes = mergeAttributes(msg.Attributes, t.Tag(msg.Body))
+		}
+	}
+}
+
+// mergeAttributes adds the new attributes to a list of
+// attributes, skipping any which are already present.
+func mergeAttributes(attrs, newAttrs []string) []string {
+	for _, attr := range newAttrs {
+		var present bool
+		for _, x := range attrs {
+			if x == attr {
+				present = true
+				break
+			}
+		}
+		if !present {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
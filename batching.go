@@ -0,0 +1,217 @@
+package chatbot
+
+import (
+	"math/bits"
+	"math/rand"
+
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+// A BucketSampler splits a sample set into batches of
+// samples with similar lengths, so that little of each
+// batch is spent on padding.
+//
+// Samples are grouped into power-of-two length buckets,
+// like the buckets of a Histogram.
+// Each epoch, the samples within each bucket are shuffled
+// and split into batches, and then the batches from all
+// the buckets are shuffled together.
+//
+// If the sample set has a Reshuffle method, as a
+// MixtureSampleSet does, it is reshuffled and measured
+// again before every epoch but the first.
+type BucketSampler struct {
+	// BatchSize is the maximum number of samples in a
+	// batch.
+	// If it is 0, only TokenBudget limits batches.
+	BatchSize int
+
+	// TokenBudget, if non-zero, is the maximum number of
+	// timesteps in a batch, including padding.
+	// This is the number of samples in the batch times the
+	// length of its longest sample.
+	// A sample longer than the budget gets its own batch.
+	TokenBudget int
+
+	// Unbucketed puts every sample in one bucket, so that
+	// batches are drawn at random regardless of length.
+	// They are still limited by BatchSize and TokenBudget.
+	Unbucketed bool
+
+	samples sgd.SampleSet
+	lengths []int
+	started bool
+}
+
+// A reshuffler is a sample set which draws new samples
+// for each epoch.
+type reshuffler interface {
+	Reshuffle()
+}
+
+// NewBucketSampler creates a BucketSampler for a sample
+// set, measuring the length of every sample.
+//
+// The sample set is copied, so the original may be
+// modified without affecting the sampler.
+func NewBucketSampler(s sgd.SampleSet, batchSize, tokenBudget int) *BucketSampler {
+	res := &BucketSampler{
+		BatchSize:   batchSize,
+		TokenBudget: tokenBudget,
+		samples:     s.Copy(),
+		lengths:     make([]int, s.Len()),
+	}
+	res.measure()
+	return res
+}
+
+func (b *BucketSampler) measure() {
+	for i := range b.lengths {
+		b.lengths[i] = sampleLength(b.samples, i)
+	}
+}
+
+// Len returns the number of samples.
+func (b *BucketSampler) Len() int {
+	return len(b.lengths)
+}
+
+// Epoch returns a shuffled list of batches which contains
+// every sample exactly once.
+func (b *BucketSampler) Epoch() []sgd.SampleSet {
+	if r, ok := b.samples.(reshuffler); ok && b.started {
+		r.Reshuffle()
+		b.measure()
+	}
+	b.started = true
+
+	var buckets [][]int
+	for i, length := range b.lengths {
+		var bucket int
+		if !b.Unbucketed {
+			bucket = bits.Len(uint(length))
+		}
+		for len(buckets) <= bucket {
+			buckets = append(buckets, nil)
+		}
+		buckets[bucket] = append(buckets[bucket], i)
+	}
+
+	var batches [][]int
+	for _, bucket := range buckets {
+		rand.Shuffle(len(bucket), func(i, j int) {
+			bucket[i], bucket[j] = bucket[j], bucket[i]
+		})
+		var batch []int
+		var maxLen int
+		for _, idx := range bucket {
+			newMax := maxLen
+			if b.lengths[idx] > newMax {
+				newMax = b.lengths[idx]
+			}
+			if len(batch) > 0 && !b.fits(len(batch)+1, newMax) {
+				batches = append(batches, batch)
+				batch, newMax = nil, b.lengths[idx]
+			}
+			batch = append(batch, idx)
+			maxLen = newMax
+		}
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+	}
+	rand.Shuffle(len(batches), func(i, j int) {
+		batches[i], batches[j] = batches[j], batches[i]
+	})
+
+	var order []int
+	for _, batch := range batches {
+		order = append(order, batch...)
+	}
+	samples := b.samples.Copy()
+	permuteSampleSet(samples, order)
+
+	res := make([]sgd.SampleSet, len(batches))
+	var start int
+	for i, batch := range batches {
+		res[i] = samples.Subset(start, start+len(batch))
+		start += len(batch)
+	}
+	return res
+}
+
+func (b *BucketSampler) fits(count, maxLen int) bool {
+	if b.BatchSize != 0 && count > b.BatchSize {
+		return false
+	}
+	return b.TokenBudget == 0 || count*maxLen <= b.TokenBudget
+}
+
+// SGDBucketed is like sgd.SGDMini, but it gets batches
+// from a BucketSampler.
+//
+// The status function is called before each batch is
+// trained on, and training stops when it returns false.
+// It also stops if an epoch has no batches, since the
+// sampler has no samples.
+func SGDBucketed(g sgd.Gradienter, b *BucketSampler, stepSize float64,
+	sf func(batch sgd.SampleSet) bool) {
+	for {
+		batches := b.Epoch()
+		if len(batches) == 0 {
+			return
+		}
+		for _, batch := range batches {
+			if !sf(batch) {
+				return
+			}
+			g.Gradient(batch).AddToVars(-stepSize)
+		}
+	}
+}
+
+// ShuffleEpoch prepares a sample set for a new epoch.
+// Sets with a Reshuffle method, like MixtureSampleSet, are
+// reshuffled, and other sets are shuffled.
+func ShuffleEpoch(s sgd.SampleSet) {
+	if r, ok := s.(reshuffler); ok {
+		r.Reshuffle()
+	} else {
+		sgd.ShuffleSampleSet(s)
+	}
+}
+
+// sampleLength returns the number of timesteps in a
+// sample.
+// Sample sets from this package compute lengths without
+// generating samples.
+func sampleLength(s sgd.SampleSet, idx int) int {
+	if l, ok := s.(interface {
+		SampleLength(idx int) int
+	}); ok {
+		return l.SampleLength(idx)
+	}
+	return len(s.GetSample(idx).(seqtoseq.Sample).Inputs)
+}
+
+// permuteSampleSet reorders a sample set so that the
+// sample which was at index order[i] moves to index i.
+func permuteSampleSet(s sgd.SampleSet, order []int) {
+	at := make([]int, len(order))
+	where := make([]int, len(order))
+	for i := range at {
+		at[i] = i
+		where[i] = i
+	}
+	for i, orig := range order {
+		pos := where[orig]
+		if pos == i {
+			continue
+		}
+		s.Swap(i, pos)
+		displaced := at[i]
+		at[i], at[pos] = orig, displaced
+		where[orig], where[displaced] = i, pos
+	}
+}
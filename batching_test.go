@@ -0,0 +1,62 @@
+package chatbot
+
+import (
+	"math/bits"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/sgd"
+)
+
+func TestBucketSamplerEpoch(t *testing.T) {
+	samples := testSampleSet(nil, 30, 200)
+	for _, unbucketed := range []bool{false, true} {
+		sampler := NewBucketSampler(samples, 4, 150)
+		sampler.Unbucketed = unbucketed
+
+		var total int
+		for _, batch := range sampler.Epoch() {
+			total += batch.Len()
+			if batch.Len() > 4 {
+				t.Errorf("batch has %d samples", batch.Len())
+			}
+			var maxLen int
+			for i := 0; i < batch.Len(); i++ {
+				if l := sampleLength(batch, i); l > maxLen {
+					maxLen = l
+				}
+			}
+			if batch.Len() > 1 && batch.Len()*maxLen > 150 {
+				t.Errorf("batch exceeds token budget: %d*%d", batch.Len(), maxLen)
+			}
+			if !unbucketed {
+				bucket := bits.Len(uint(sampleLength(batch, 0)))
+				for i := 1; i < batch.Len(); i++ {
+					if bits.Len(uint(sampleLength(batch, i))) != bucket {
+						t.Error("batch mixes length buckets")
+					}
+				}
+			}
+		}
+		if total != samples.Len() {
+			t.Errorf("epoch has %d samples but expected %d", total, samples.Len())
+		}
+	}
+}
+
+func TestSGDBucketedEmpty(t *testing.T) {
+	sampler := NewBucketSampler(&SampleSet{}, 4, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		SGDBucketed(nil, sampler, 0.1, func(batch sgd.SampleSet) bool {
+			t.Error("unexpected batch")
+			return false
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SGDBucketed did not return")
+	}
+}
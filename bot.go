@@ -1,11 +1,13 @@
 package chatbot
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 
 	"github.com/unixpickle/neuralstruct"
-	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/serializer"
 	"github.com/unixpickle/weakai/neuralnet"
 	"github.com/unixpickle/weakai/rnn"
@@ -22,14 +24,38 @@ const (
 	HiddenDropout = 0.5
 )
 
+const botFileHeader = "chatbot-bot 1\n"
+
 // A Bot manages a recurrent neural network that acts as a
 // chat bot.
 type Bot struct {
 	Block rnn.Block
+
+	// Arch is the architecture of the Block.
+	// It may be nil for a Bot with the default
+	// architecture.
+	Arch *Architecture
 }
 
-// NewBot creates a new, untrained Bot.
+// NewBot creates a new, untrained Bot with the default
+// architecture.
 func NewBot() *Bot {
+	return NewBotArchitecture(DefaultArchitecture())
+}
+
+// NewBotArchitecture creates a new, untrained Bot with
+// the given architecture.
+// A nil architecture is the default one.
+//
+// It panics if the architecture is invalid, so untrusted
+// architectures should be checked with Validate first.
+func NewBotArchitecture(arch *Architecture) *Bot {
+	if arch == nil {
+		arch = DefaultArchitecture()
+	}
+	if err := arch.Validate(); err != nil {
+		panic("invalid architecture: " + err.Error())
+	}
 	structure := neuralstruct.RAggregate{
 		&neuralstruct.Stack{
 			VectorSize: 10,
@@ -41,16 +67,16 @@ func NewBot() *Bot {
 		},
 	}
 
-	stateSizes := []int{400, 300, 200}
+	stateSizes := arch.StateSizes
 	outNetwork := neuralnet.Network{
 		&neuralnet.DenseLayer{
 			InputCount:  stateSizes[len(stateSizes)-1],
-			OutputCount: structure.ControlSize() + InputCount,
+			OutputCount: structure.ControlSize() + arch.TokenCount(),
 		},
 		&neuralstruct.PartialActivation{
 			Ranges: []neuralstruct.ComponentRange{
 				{Start: 0, End: structure.DataSize()},
-				{Start: structure.ControlSize(), End: structure.ControlSize() + InputCount},
+				{Start: structure.ControlSize(), End: structure.ControlSize() + arch.TokenCount()},
 			},
 			Activations: []neuralnet.Layer{
 				&neuralnet.Sigmoid{},
@@ -62,7 +88,13 @@ func NewBot() *Bot {
 	outBlock := rnn.NewNetworkBlock(outNetwork, 0)
 
 	var fullNet rnn.StackedBlock
-	inSize := InputCount + structure.DataSize()
+	inSize := arch.InputSize() + structure.DataSize()
+	if arch.Embedding != 0 {
+		fullNet = append(fullNet, rnn.NewNetworkBlock(neuralnet.Network{
+			NewEmbeddingLayer(arch.TokenCount(), arch.Embedding),
+		}, 0))
+		inSize = arch.Embedding + arch.controlInputs() + structure.DataSize()
+	}
 	for _, outSize := range stateSizes {
 		fullNet = append(fullNet, rnn.NewLSTM(inSize, outSize))
 		fullNet = append(fullNet, rnn.NewNetworkBlock(neuralnet.Network{
@@ -79,34 +111,78 @@ func NewBot() *Bot {
 			Block:  fullNet,
 			Struct: structure,
 		},
+		Arch: arch,
 	}
 }
 
 // LoadBot reads a Bot from a file.
+//
+// Files saved before architectures were recorded are
+// loaded with the default architecture.
 func LoadBot(path string) (*Bot, error) {
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	decoded, err := serializer.DeserializeWithType(contents)
+	return DecodeBot(contents)
+}
+
+// DecodeBot decodes a Bot from data produced by Encode.
+func DecodeBot(data []byte) (*Bot, error) {
+	var arch *Architecture
+	if bytes.HasPrefix(data, []byte(botFileHeader)) {
+		data = data[len(botFileHeader):]
+		archEnd := bytes.IndexByte(data, '\n')
+		if archEnd < 0 {
+			return nil, errors.New("missing architecture")
+		}
+		arch = new(Architecture)
+		if err := json.Unmarshal(data[:archEnd], arch); err != nil {
+			return nil, fmt.Errorf("bad architecture: %s", err)
+		}
+		data = data[archEnd+1:]
+	}
+	decoded, err := serializer.DeserializeWithType(data)
 	if err != nil {
 		return nil, err
 	}
 	if block, ok := decoded.(rnn.Block); ok {
-		return &Bot{Block: block}, nil
+		return &Bot{Block: block, Arch: arch}, nil
 	}
 	return nil, fmt.Errorf("type is not an rnn.Block: %T", decoded)
 }
 
 // Save saves the Bot to a file.
 func (b *Bot) Save(path string) error {
-	encoded, err := serializer.SerializeWithType(b.Block.(serializer.Serializer))
+	encoded, err := b.Encode()
 	if err != nil {
 		return err
 	}
 	return ioutil.WriteFile(path, encoded, 0755)
 }
 
+// Encode serializes the Bot and its architecture.
+func (b *Bot) Encode() ([]byte, error) {
+	arch := b.Arch
+	if arch == nil {
+		arch = DefaultArchitecture()
+	}
+	archData, err := json.Marshal(arch)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := serializer.SerializeWithType(b.Block.(serializer.Serializer))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(botFileHeader)
+	buf.Write(archData)
+	buf.WriteByte('\n')
+	buf.Write(encoded)
+	return buf.Bytes(), nil
+}
+
 // Dropout enables or disables dropout in the network.
 func (b *Bot) Dropout(on bool) {
 	structBlock, ok := b.Block.(*neuralstruct.Block)
@@ -125,9 +201,3 @@ func (b *Bot) Dropout(on bool) {
 		}
 	}
 }
-
-func oneHotVector(i int) linalg.Vector {
-	res := make(linalg.Vector, InputCount)
-	res[i] = 1
-	return res
-}
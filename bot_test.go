@@ -0,0 +1,231 @@
+package chatbot
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+func TestNewBotArchitectureNil(t *testing.T) {
+	bot := NewBotArchitecture(nil)
+	if bot.Arch == nil || len(bot.Arch.StateSizes) == 0 {
+		t.Error("expected the default architecture")
+	}
+}
+
+func TestNewBotArchitectureInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	NewBotArchitecture(&Architecture{})
+}
+
+func TestEmbeddingBotGradient(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	bot, grad, samples := testEmbeddingBot()
+	actual := copyGradient(grad.Gradient(samples))
+	cost := func() float64 {
+		return seqtoseq.TotalCostBlock(bot.Block, samples.Len(), samples, neuralnet.DotCost{})
+	}
+	for _, v := range grad.Learner.Parameters() {
+		for _, i := range gradCheckIndices(gen, actual[v]) {
+			checkPartial(t, v, i, actual[v][i], cost)
+		}
+	}
+}
+
+func TestEmbeddingBotRGradient(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	_, grad, samples := testEmbeddingBot()
+	params := grad.Learner.Parameters()
+	rv := autofunc.RVector{}
+	for _, v := range params {
+		rv[v] = randomVector(gen, len(v.Vector))
+	}
+	_, rgrad := grad.RGradient(rv, samples)
+	actual := copyGradient(autofunc.Gradient(rgrad))
+
+	// The R-gradient is the derivative of the gradient in
+	// the direction of rv.
+	step := func(scale float64) {
+		for _, v := range params {
+			v.Vector.Add(rv[v].Copy().Scale(scale))
+		}
+	}
+	step(gradCheckDelta)
+	plus := copyGradient(grad.Gradient(samples))
+	step(-2 * gradCheckDelta)
+	minus := copyGradient(grad.Gradient(samples))
+	step(gradCheckDelta)
+	for _, v := range params {
+		expected := plus[v].Copy().Add(minus[v].Copy().Scale(-1))
+		expected.Scale(1 / (2 * gradCheckDelta))
+		if !vectorsClose(actual[v], expected) {
+			t.Errorf("R-gradient of %d-dim parameter is incorrect", len(v.Vector))
+		}
+	}
+}
+
+func TestChatSendSpeakers(t *testing.T) {
+	bot := NewBotArchitecture(&Architecture{StateSizes: []int{5}, Speakers: 3})
+	arch := bot.Arch
+
+	// sendOutput sends a message from a speaker and returns
+	// the bot's output after it starts a reply.
+	sendOutput := func(speaker int) linalg.Vector {
+		c := NewChat(bot, "")
+		c.SendAt(speaker, "hi", time.Time{})
+		return c.runner.StepTime(arch.TokenVector(StartBotMsg))
+	}
+
+	outputs := map[int]linalg.Vector{}
+	for speaker := 0; speaker < 4; speaker++ {
+		r := &rnn.Runner{Block: bot.Block}
+		r.StepTime(arch.TokenVector(arch.SpeakerToken(speaker)))
+		for _, b := range []byte("hi") {
+			r.StepTime(arch.TokenVector(int(b)))
+		}
+		expected := r.StepTime(arch.TokenVector(StartBotMsg))
+		outputs[speaker] = sendOutput(speaker)
+		if !vectorsClose(outputs[speaker], expected) {
+			t.Errorf("speaker %d: message was not started with token %d", speaker,
+				arch.SpeakerToken(speaker))
+		}
+	}
+	if vectorsClose(outputs[0], outputs[1]) || vectorsClose(outputs[1], outputs[2]) {
+		t.Error("speakers should be told apart")
+	}
+	if !vectorsClose(outputs[1], outputs[3]) {
+		t.Error("speaker 3 should share a token with speaker 1")
+	}
+}
+
+func BenchmarkGetSampleOneHot(b *testing.B) {
+	benchmarkGetSample(b, 0)
+}
+
+func BenchmarkGetSampleEmbedding(b *testing.B) {
+	benchmarkGetSample(b, 32)
+}
+
+func BenchmarkGradientOneHot(b *testing.B) {
+	benchmarkGradient(b, 0)
+}
+
+func BenchmarkGradientEmbedding(b *testing.B) {
+	benchmarkGradient(b, 32)
+}
+
+func benchmarkGetSample(b *testing.B, embedding int) {
+	arch := &Architecture{StateSizes: []int{64}, Embedding: embedding}
+	samples := testSampleSet(arch, 10, 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		samples.GetSample(i % samples.Len())
+	}
+}
+
+func benchmarkGradient(b *testing.B, embedding int) {
+	arch := &Architecture{StateSizes: []int{64}, Embedding: embedding}
+	bot := NewBotArchitecture(arch)
+	grad := &seqtoseq.Gradienter{
+		SeqFunc:  &rnn.BlockSeqFunc{B: bot.Block},
+		Learner:  bot.Block.(sgd.Learner),
+		CostFunc: neuralnet.DotCost{},
+	}
+	samples := testSampleSet(arch, 10, 200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := (i * 4) % (samples.Len() - 4)
+		grad.Gradient(samples.Subset(start, start+4))
+	}
+}
+
+// testEmbeddingBot creates a small embedding bot with a
+// gradienter and a few samples for gradient checks.
+func testEmbeddingBot() (*Bot, *seqtoseq.Gradienter, sgd.SampleSet) {
+	arch := &Architecture{StateSizes: []int{4}, Embedding: 3}
+	bot := NewBotArchitecture(arch)
+	grad := &seqtoseq.Gradienter{
+		SeqFunc:  &rnn.BlockSeqFunc{B: bot.Block},
+		Learner:  bot.Block.(sgd.Learner),
+		CostFunc: neuralnet.DotCost{},
+	}
+	samples := testSampleSet(arch, 1, 30)
+	if samples.Len() > 3 {
+		return bot, grad, samples.Subset(0, 3)
+	}
+	return bot, grad, samples
+}
+
+// gradCheckIndices picks the components of a gradient to
+// check: the largest ones, which cover the embeddings of
+// the tokens in use, and a few random ones.
+func gradCheckIndices(gen *rand.Rand, grad linalg.Vector) []int {
+	indices := make([]int, len(grad))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return math.Abs(grad[indices[i]]) > math.Abs(grad[indices[j]])
+	})
+	if len(indices) <= 10 {
+		return indices
+	}
+	res := append([]int{}, indices[:5]...)
+	for i := 0; i < 5; i++ {
+		res = append(res, indices[5+gen.Intn(len(indices)-5)])
+	}
+	return res
+}
+
+func copyGradient(g autofunc.Gradient) autofunc.Gradient {
+	res := autofunc.Gradient{}
+	for v, grad := range g {
+		res[v] = grad.Copy()
+	}
+	return res
+}
+
+// testConversations generates random conversations
+// which alternate between a human and the bot.
+func testConversations(numConvos int) [][]message {
+	gen := rand.New(rand.NewSource(1337))
+	words := []string{"hi", "hello", "how", "are", "you", "good", "thanks", "bye", "ok"}
+	var convos [][]message
+	for i := 0; i < numConvos; i++ {
+		var convo []message
+		for j := 0; j < 4+gen.Intn(6); j++ {
+			var body string
+			for k := 0; k < 1+gen.Intn(8); k++ {
+				body += words[gen.Intn(len(words))] + " "
+			}
+			convo = append(convo, message{FromBot: j%2 == 1, Body: body})
+		}
+		convos = append(convos, convo)
+	}
+	return convos
+}
+
+// testSampleSet creates a sample set of random
+// conversations for an architecture.
+func testSampleSet(arch *Architecture, numConvos, maxBuffer int) *SampleSet {
+	res, err := newSampleSetConvos(testConversations(numConvos), maxBuffer,
+		&LoadOptions{Arch: arch})
+	if err != nil {
+		panic(fmt.Sprint("generate samples: ", err))
+	}
+	return res
+}
@@ -0,0 +1,571 @@
+package chatbot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/unixpickle/sgd"
+)
+
+const (
+	cacheMagic      = "CHATBOTC"
+	cacheVersion    = 6
+	cacheHeaderSize = 56
+	cacheEntrySize  = 16
+
+	// cacheSnippetSize is the size of a snippet table
+	// entry, which is a regular entry followed by the
+	// FirstCut and LastCut of the snippet.
+	cacheSnippetSize = cacheEntrySize + 8
+
+	cacheFromBot   = 1
+	cacheEndOfChat = 1
+	cacheNextBot   = 2
+
+	// cacheLastMessage marks the last message of each
+	// conversation.
+	cacheLastMessage = 2
+
+	// cacheDuplicate marks messages which a Deduplicator
+	// found to duplicate earlier messages.
+	cacheDuplicate = 4
+
+	// cacheSpeakerShift and cacheSpeakerMask locate the
+	// speaker in the flags of a message or, for a snippet,
+	// the next speaker.
+	cacheSpeakerShift = 8
+	cacheSpeakerMask  = 0xff
+
+	// cachePersonaShift is the position of the persona in
+	// the flags of a snippet, and cacheAttributeShift is
+	// the position of the attribute set in the flags of a
+	// message.
+	// The persona is stored as 1 plus its index in the
+	// persona table, or 0 for no persona, and likewise
+	// for attribute sets.
+	cachePersonaShift   = 16
+	cacheAttributeShift = 16
+	cacheMaxLabels      = 0xffff
+
+	// cacheGapShift and cacheGapMask locate the time gap
+	// in the flags of a message.
+	cacheGapShift = 4
+	cacheGapMask  = 0xf
+)
+
+// WriteSampleCache loads the conversations at a path and
+// writes them to a compact binary cache file, which can
+// be opened with OpenCacheSampleSet.
+//
+// The arguments are treated the same way as they are in
+// NewSampleSetOptions.
+//
+// A cache file consists of a header, the raw bytes of
+// every message, a table of message offsets, senders, and
+// conversation boundaries, a table of snippets, and a
+// JSON table of persona labels and message attribute
+// sets.
+// Since snippets refer to whole messages, any cuts made
+// to their messages are stored in the snippet table.
+// Conversations are read one at a time, so the corpus
+// need not fit in memory.
+//
+// Writing fails if a conversation has more than 256
+// external speakers, or if there are more than 65535
+// distinct personas or attribute sets.
+func WriteSampleCache(outPath, path string, maxBuffer int, opts *LoadOptions) (err error) {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+
+	tempPath := outPath + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+
+	if _, err := f.Write(make([]byte, cacheHeaderSize)); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	var textSize uint64
+	var msgTable, snippetTable bytes.Buffer
+	var numMessages, numSnippets uint64
+	var labels cacheLabels
+	personaIndices := map[string]int{}
+	attributeIndices := map[string]int{}
+	err = opts.walkSources(path, func(source string) error {
+		convos, err := opts.readSource(source)
+		if err != nil {
+			return err
+		}
+		for _, convo := range opts.dedup(convos) {
+			firstMessage := numMessages
+			for i, msg := range convo {
+				if msg.Speaker > cacheSpeakerMask {
+					return fmt.Errorf("conversation has more than %d speakers",
+						cacheSpeakerMask+1)
+				}
+				flags := uint32(msg.Speaker)<<cacheSpeakerShift |
+					uint32(msg.Gap)<<cacheGapShift
+				if len(msg.Attributes) > 0 {
+					key := strings.Join(msg.Attributes, "\x00")
+					idx, ok := attributeIndices[key]
+					if !ok {
+						idx = len(labels.AttributeSets)
+						if idx == cacheMaxLabels {
+							return errTooManyLabels
+						}
+						attributeIndices[key] = idx
+						labels.AttributeSets = append(labels.AttributeSets, msg.Attributes)
+					}
+					flags |= uint32(idx+1) << cacheAttributeShift
+				}
+				if msg.FromBot {
+					flags |= cacheFromBot
+				}
+				if i == len(convo)-1 {
+					flags |= cacheLastMessage
+				}
+				if msg.Duplicate {
+					flags |= cacheDuplicate
+				}
+				writeCacheEntry(&msgTable, textSize, uint32(len(msg.Body)), flags)
+				if _, err := w.WriteString(msg.Body); err != nil {
+					return err
+				}
+				textSize += uint64(len(msg.Body))
+				numMessages++
+			}
+			var persona int
+			if len(convo) > 0 && convo[0].Persona != "" {
+				idx, ok := personaIndices[convo[0].Persona]
+				if !ok {
+					idx = len(labels.Personas)
+					if idx == cacheMaxLabels {
+						return errTooManyLabels
+					}
+					personaIndices[convo[0].Persona] = idx
+					labels.Personas = append(labels.Personas, convo[0].Persona)
+				}
+				persona = idx + 1
+			}
+			for i := range convo {
+				sn, _ := opts.Snippets.generate(maxBuffer, convo, i)
+				if sn == nil {
+					continue
+				}
+				flags := uint32(sn.NextSpeaker)<<cacheSpeakerShift |
+					uint32(persona)<<cachePersonaShift
+				if sn.EndOfChat {
+					flags |= cacheEndOfChat
+				}
+				if sn.NextBot {
+					flags |= cacheNextBot
+				}
+				start := firstMessage + uint64(i+1-len(sn.Messages))
+				writeCacheEntry(&snippetTable, start, uint32(len(sn.Messages)), flags)
+				var cuts [8]byte
+				binary.LittleEndian.PutUint32(cuts[:], uint32(sn.FirstCut))
+				binary.LittleEndian.PutUint32(cuts[4:], uint32(sn.LastCut))
+				snippetTable.Write(cuts[:])
+				numSnippets++
+				if numSnippets > math.MaxUint32 {
+					return errTooManySnippets
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	labelData, err := json.Marshal(&labels)
+	if err != nil {
+		return err
+	}
+	for _, table := range []*bytes.Buffer{&msgTable, &snippetTable} {
+		if _, err := table.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(labelData); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, cacheHeaderSize)
+	copy(header, cacheMagic)
+	binary.LittleEndian.PutUint32(header[8:], cacheVersion)
+	binary.LittleEndian.PutUint32(header[12:], uint32(maxBuffer))
+	binary.LittleEndian.PutUint64(header[16:], cacheHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:], textSize)
+	binary.LittleEndian.PutUint64(header[32:], numMessages)
+	binary.LittleEndian.PutUint64(header[40:], numSnippets)
+	binary.LittleEndian.PutUint64(header[48:], uint64(len(labelData)))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, outPath)
+}
+
+func writeCacheEntry(w *bytes.Buffer, offset uint64, size, flags uint32) {
+	var entry [cacheEntrySize]byte
+	binary.LittleEndian.PutUint64(entry[:], offset)
+	binary.LittleEndian.PutUint32(entry[8:], size)
+	binary.LittleEndian.PutUint32(entry[12:], flags)
+	w.Write(entry[:])
+}
+
+// errTooManySnippets is returned for caches whose
+// snippets cannot be indexed by a CacheSampleSet.
+var errTooManySnippets = errors.New("cache has more than 2^32-1 snippets")
+
+// errTooManyLabels is returned for caches whose personas
+// or attribute sets cannot be indexed in the flags of
+// their entries.
+var errTooManyLabels = fmt.Errorf("cache has more than %d personas or attribute sets",
+	cacheMaxLabels)
+
+// errCorruptCache is returned for cache files whose
+// sizes or entries are inconsistent.
+var errCorruptCache = errors.New("cache file is truncated or corrupt")
+
+// IsSampleCache checks if a file is a cache file created
+// by WriteSampleCache.
+func IsSampleCache(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(cacheMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == cacheMagic
+}
+
+// A CacheSampleSet is a sample set backed by a
+// memory-mapped cache file from WriteSampleCache.
+//
+// Copies and subsets of a CacheSampleSet share the same
+// mapping, which remains valid until Close is called.
+type CacheSampleSet struct {
+	arch    *Architecture
+	cache   *sampleCache
+	indices []uint32
+}
+
+// OpenCacheSampleSet memory-maps a cache file.
+//
+// If maxBuffer is non-zero, it must match the value that
+// was used to create the cache.
+func OpenCacheSampleSet(path string, maxBuffer int) (*CacheSampleSet, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := newSampleCache(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, fmt.Errorf("load %s: %s", path, err)
+	}
+	if maxBuffer != 0 && maxBuffer != cache.MaxBuffer {
+		unmapFile(data)
+		return nil, fmt.Errorf("load %s: cache has max buffer %d (expected %d)", path,
+			cache.MaxBuffer, maxBuffer)
+	}
+	res := &CacheSampleSet{
+		cache:   cache,
+		indices: make([]uint32, cache.NumSnippets),
+	}
+	for i := range res.indices {
+		res.indices[i] = uint32(i)
+	}
+	return res, nil
+}
+
+// Close unmaps the cache file.
+// Neither the sample set nor any of its copies may be
+// used after it is closed.
+func (c *CacheSampleSet) Close() error {
+	return unmapFile(c.cache.Data)
+}
+
+// Len returns the number of samples.
+func (c *CacheSampleSet) Len() int {
+	return len(c.indices)
+}
+
+// Copy returns a shallow copy of the sample set.
+func (c *CacheSampleSet) Copy() sgd.SampleSet {
+	res := &CacheSampleSet{
+		arch:    c.arch,
+		cache:   c.cache,
+		indices: make([]uint32, len(c.indices)),
+	}
+	copy(res.indices, c.indices)
+	return res
+}
+
+// Swap swaps two samples.
+func (c *CacheSampleSet) Swap(i, j int) {
+	c.indices[i], c.indices[j] = c.indices[j], c.indices[i]
+}
+
+// GetSample generates a seqtoseq.Sample for the snippet
+// at the given index.
+func (c *CacheSampleSet) GetSample(idx int) interface{} {
+	return c.cache.Snippet(int(c.indices[idx])).Sample(c.arch)
+}
+
+// SampleLength returns the number of timesteps in the
+// sample at the given index.
+func (c *CacheSampleSet) SampleLength(idx int) int {
+	return c.cache.SnippetLength(int(c.indices[idx]))
+}
+
+// Subset returns a subset of this sample set.
+func (c *CacheSampleSet) Subset(start, end int) sgd.SampleSet {
+	return &CacheSampleSet{
+		arch:    c.arch,
+		cache:   c.cache,
+		indices: c.indices[start:end],
+	}
+}
+
+// Hash returns a hash of the given sample.
+func (c *CacheSampleSet) Hash(i int) []byte {
+	return c.cache.Snippet(int(c.indices[i])).Sample(c.arch).Hash()
+}
+
+type sampleCache struct {
+	Data        []byte
+	MaxBuffer   int
+	NumSnippets int
+
+	text     []byte
+	messages []byte
+	snippets []byte
+	labels   cacheLabels
+}
+
+// cacheLabels is the label table at the end of a cache.
+type cacheLabels struct {
+	Personas      []string
+	AttributeSets [][]string
+}
+
+func newSampleCache(data []byte) (*sampleCache, error) {
+	if len(data) < len(cacheMagic) || string(data[:len(cacheMagic)]) != cacheMagic {
+		return nil, errors.New("not a sample cache")
+	} else if len(data) < cacheHeaderSize {
+		return nil, errCorruptCache
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version != cacheVersion {
+		return nil, fmt.Errorf("unsupported cache version %d (rebuild it)", version)
+	}
+	textStart := binary.LittleEndian.Uint64(data[16:])
+	textSize := binary.LittleEndian.Uint64(data[24:])
+	numMessages := binary.LittleEndian.Uint64(data[32:])
+	numSnippets := binary.LittleEndian.Uint64(data[40:])
+	labelSize := binary.LittleEndian.Uint64(data[48:])
+	if numSnippets > math.MaxUint32 {
+		return nil, errTooManySnippets
+	}
+
+	// Bounding each size by the file size keeps the sums
+	// below from overflowing.
+	size := uint64(len(data))
+	if textStart != cacheHeaderSize || textSize > size || labelSize > size ||
+		numMessages > size/cacheEntrySize || numSnippets > size/cacheSnippetSize {
+		return nil, errCorruptCache
+	}
+	msgStart := textStart + textSize
+	snippetStart := msgStart + numMessages*cacheEntrySize
+	end := snippetStart + numSnippets*cacheSnippetSize
+	if end+labelSize != size {
+		return nil, errCorruptCache
+	}
+	var labels cacheLabels
+	if labelSize > 0 {
+		if err := json.Unmarshal(data[end:], &labels); err != nil {
+			return nil, fmt.Errorf("bad label table: %s", err)
+		}
+	}
+	res := &sampleCache{
+		Data:        data,
+		MaxBuffer:   int(binary.LittleEndian.Uint32(data[12:])),
+		NumSnippets: int(numSnippets),
+		text:        data[textStart:msgStart],
+		messages:    data[msgStart:snippetStart],
+		snippets:    data[snippetStart:end],
+		labels:      labels,
+	}
+	if err := res.validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// validate checks that every entry in the cache refers
+// to data within the cache, so that reading snippets
+// cannot fail later on.
+func (s *sampleCache) validate() error {
+	numMessages := len(s.messages) / cacheEntrySize
+	for i := 0; i < numMessages; i++ {
+		offset, size, flags := readCacheEntry(s.messages, i)
+		if offset > uint64(len(s.text)) || uint64(size) > uint64(len(s.text))-offset {
+			return fmt.Errorf("message %d: %s", i, errCorruptCache)
+		}
+		if int(flags>>cacheGapShift)&cacheGapMask > GapBucketCount {
+			return fmt.Errorf("message %d: %s", i, errCorruptCache)
+		}
+	}
+	for i := 0; i < s.NumSnippets; i++ {
+		entry := s.snippetEntry(i)
+		start, count, _ := readCacheEntry(entry, 0)
+		if count == 0 || start > uint64(numMessages) ||
+			uint64(count) > uint64(numMessages)-start {
+			return fmt.Errorf("snippet %d: %s", i, errCorruptCache)
+		}
+		firstCut := binary.LittleEndian.Uint32(entry[cacheEntrySize:])
+		lastCut := binary.LittleEndian.Uint32(entry[cacheEntrySize+4:])
+		_, firstSize, _ := readCacheEntry(s.messages, int(start))
+		_, lastSize, _ := readCacheEntry(s.messages, int(start)+int(count)-1)
+		if (count > 1 && firstCut > firstSize) || lastCut > lastSize {
+			return fmt.Errorf("snippet %d: %s", i, errCorruptCache)
+		}
+	}
+	return nil
+}
+
+// checkLabels checks that the architecture of some load
+// options has the labels in the cache.
+func (s *sampleCache) checkLabels(opts *LoadOptions) error {
+	for _, persona := range s.labels.Personas {
+		if err := opts.checkControls(InputControls{Persona: persona}); err != nil {
+			return err
+		}
+	}
+	for _, attrs := range s.labels.AttributeSets {
+		if err := opts.checkControls(InputControls{Attributes: attrs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shard returns the indices of the snippets whose
+// conversations are in the given shards, where the
+// shard of a conversation is its index in the cache
+// modulo numShards.
+func (s *sampleCache) shard(numShards int, shards []int) []uint32 {
+	var convoEnds []uint64
+	numMessages := len(s.messages) / cacheEntrySize
+	for i := 0; i < numMessages; i++ {
+		if _, _, flags := readCacheEntry(s.messages, i); flags&cacheLastMessage != 0 {
+			convoEnds = append(convoEnds, uint64(i))
+		}
+	}
+	inShard := make([]bool, numShards)
+	for _, shard := range shards {
+		if shard >= 0 && shard < numShards {
+			inShard[shard] = true
+		}
+	}
+	var res []uint32
+	for i := 0; i < s.NumSnippets; i++ {
+		start, _, _ := readCacheEntry(s.snippetEntry(i), 0)
+		convo := sort.Search(len(convoEnds), func(j int) bool {
+			return convoEnds[j] >= start
+		})
+		if inShard[convo%numShards] {
+			res = append(res, uint32(i))
+		}
+	}
+	return res
+}
+
+func (s *sampleCache) Snippet(idx int) *snippet {
+	entry := s.snippetEntry(idx)
+	start, count, flags := readCacheEntry(entry, 0)
+	res := &snippet{
+		EndOfChat:   flags&cacheEndOfChat != 0,
+		NextBot:     flags&cacheNextBot != 0,
+		NextSpeaker: int(flags>>cacheSpeakerShift) & cacheSpeakerMask,
+		Messages:    make([]message, count),
+		FirstCut:    int(binary.LittleEndian.Uint32(entry[cacheEntrySize:])),
+		LastCut:     int(binary.LittleEndian.Uint32(entry[cacheEntrySize+4:])),
+	}
+	var persona string
+	if idx := int(flags >> cachePersonaShift); idx > 0 && idx <= len(s.labels.Personas) {
+		persona = s.labels.Personas[idx-1]
+	}
+	for i := range res.Messages {
+		offset, size, msgFlags := readCacheEntry(s.messages, int(start)+i)
+		res.Messages[i] = message{
+			FromBot:   msgFlags&cacheFromBot != 0,
+			Duplicate: msgFlags&cacheDuplicate != 0,
+			Speaker:   int(msgFlags>>cacheSpeakerShift) & cacheSpeakerMask,
+			Gap:       int(msgFlags>>cacheGapShift) & cacheGapMask,
+			Persona:   persona,
+			Body:      string(s.text[offset : offset+uint64(size)]),
+		}
+		attrs := int(msgFlags >> cacheAttributeShift)
+		if attrs > 0 && attrs <= len(s.labels.AttributeSets) {
+			res.Messages[i].Attributes = s.labels.AttributeSets[attrs-1]
+		}
+	}
+	return res
+}
+
+// SnippetLength computes the length of a snippet's sample
+// without copying its messages.
+func (s *sampleCache) SnippetLength(idx int) int {
+	entry := s.snippetEntry(idx)
+	start, count, _ := readCacheEntry(entry, 0)
+	res := int(count)
+	for i := 0; i < int(count); i++ {
+		_, size, _ := readCacheEntry(s.messages, int(start)+i)
+		res += int(size)
+	}
+	if count > 1 {
+		res -= int(binary.LittleEndian.Uint32(entry[cacheEntrySize:]))
+	}
+	res -= int(binary.LittleEndian.Uint32(entry[cacheEntrySize+4:]))
+	return res
+}
+
+func (s *sampleCache) snippetEntry(idx int) []byte {
+	return s.snippets[idx*cacheSnippetSize : (idx+1)*cacheSnippetSize]
+}
+
+func readCacheEntry(table []byte, idx int) (offset uint64, size, flags uint32) {
+	entry := table[idx*cacheEntrySize : (idx+1)*cacheEntrySize]
+	return binary.LittleEndian.Uint64(entry), binary.LittleEndian.Uint32(entry[8:]),
+		binary.LittleEndian.Uint32(entry[12:])
+}
@@ -0,0 +1,44 @@
+// Command cache preprocesses a corpus of conversations
+// into a binary cache file, which the training commands
+// can load much faster than the original corpus.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/unixpickle/chatbot"
+)
+
+const MaxBufferChars = 600
+
+func main() {
+	var loadOpts chatbot.LoadOptions
+	loadOpts.AddFlags(flag.CommandLine)
+	maxBuffer := flag.Int("maxbuffer", MaxBufferChars, "maximum characters per sample")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: cache [flags] <samples> <output>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	log.Println("Writing cache...")
+	if err := chatbot.WriteSampleCache(flag.Arg(1), flag.Arg(0), *maxBuffer, &loadOpts); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write cache:", err)
+		os.Exit(1)
+	}
+
+	samples, err := chatbot.OpenCacheSampleSet(flag.Arg(1), *maxBuffer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read cache:", err)
+		os.Exit(1)
+	}
+	defer samples.Close()
+	log.Println("Cached", samples.Len(), "samples.")
+}
@@ -0,0 +1,160 @@
+package chatbot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSampleCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corpus := filepath.Join(dir, "corpus")
+	writeTestFile(t, filepath.Join(corpus, "a.csv"),
+		"persona,alice\n"+
+			"human,hi there,bob,2016-01-01T00:00:00Z,\n"+
+			"human,hey,carol,2016-01-01T00:00:30Z,short\n"+
+			"bot,hello to you both,,2016-01-01T02:00:00Z,formal\n"+
+			"human,this message is long enough to be cut,bob,2016-01-03T00:00:00Z,\n"+
+			"bot,ok,,,short\n")
+	writeTestFile(t, filepath.Join(corpus, "b.json"),
+		`[{"sender":"human","body":"yo"},{"sender":"bot","body":"what's up"}]`)
+
+	opts := &LoadOptions{
+		Arch: &Architecture{
+			StateSizes: []int{10},
+			Speakers:   3,
+			TimeGaps:   true,
+			Personas:   []string{"alice"},
+			Attributes: []string{"formal", "short"},
+		},
+		Snippets: SnippetOptions{TruncateHistory: true, MinContext: 5},
+	}
+	expected, err := NewSampleSetOptions(corpus, 30, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFile := filepath.Join(dir, "cache")
+	if err := WriteSampleCache(cacheFile, corpus, 30, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSampleCache(cacheFile) {
+		t.Fatal("cache not detected")
+	}
+	if _, err := LoadSamples(cacheFile, 30, opts); err == nil {
+		t.Error("expected an error for snippet options")
+	}
+	loaded, err := LoadSamples(cacheFile, 30, &LoadOptions{Arch: opts.Arch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := loaded.(*CacheSampleSet)
+	defer actual.Close()
+
+	if actual.Len() != expected.Len() {
+		t.Fatalf("expected %d samples but got %d", expected.Len(), actual.Len())
+	}
+	var cuts bool
+	for i := 0; i < expected.Len(); i++ {
+		if !reflect.DeepEqual(actual.GetSample(i), expected.GetSample(i)) {
+			t.Errorf("sample %d differs", i)
+		}
+		if actual.SampleLength(i) != expected.SampleLength(i) {
+			t.Errorf("sample %d: expected length %d but got %d", i,
+				expected.SampleLength(i), actual.SampleLength(i))
+		}
+		if sn := expected.snippets[i]; sn.FirstCut > 0 || sn.LastCut > 0 {
+			cuts = true
+		}
+	}
+	if !cuts {
+		t.Error("no snippets with cut messages")
+	}
+}
+
+func TestSampleCacheCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	convoFile := filepath.Join(dir, "convo.csv")
+	writeTestFile(t, convoFile, "human,hi\nbot,hello\nhuman,bye\n")
+	cacheFile := filepath.Join(dir, "cache")
+	if err := WriteSampleCache(cacheFile, convoFile, 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textSize := binary.LittleEndian.Uint64(data[24:])
+	numMessages := binary.LittleEndian.Uint64(data[32:])
+	msgStart := cacheHeaderSize + textSize
+	snippetStart := msgStart + numMessages*cacheEntrySize
+
+	tests := map[string]func(d []byte) []byte{
+		"truncated": func(d []byte) []byte {
+			return d[:len(d)-1]
+		},
+		"header": func(d []byte) []byte {
+			return d[:cacheHeaderSize-1]
+		},
+		"version": func(d []byte) []byte {
+			binary.LittleEndian.PutUint32(d[8:], cacheVersion+1)
+			return d
+		},
+		"message count": func(d []byte) []byte {
+			binary.LittleEndian.PutUint64(d[32:], 1<<62)
+			return d
+		},
+		"message offset": func(d []byte) []byte {
+			binary.LittleEndian.PutUint64(d[msgStart:], textSize+1)
+			return d
+		},
+		"snippet start": func(d []byte) []byte {
+			binary.LittleEndian.PutUint64(d[snippetStart:], numMessages)
+			return d
+		},
+		"snippet cut": func(d []byte) []byte {
+			binary.LittleEndian.PutUint32(d[snippetStart+cacheEntrySize+4:], 1000)
+			return d
+		},
+	}
+	for name, corrupt := range tests {
+		path := filepath.Join(dir, "corrupt")
+		contents := corrupt(append([]byte{}, data...))
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if samples, err := OpenCacheSampleSet(path, 0); err == nil {
+			samples.Close()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSampleCacheTooManySpeakers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var rows []string
+	for i := 0; i <= cacheSpeakerMask+1; i++ {
+		rows = append(rows, fmt.Sprintf("human,hi,speaker%d", i), "bot,hello")
+	}
+	convoFile := filepath.Join(dir, "convo.csv")
+	writeTestFile(t, convoFile, strings.Join(rows, "\n"))
+	if err := WriteSampleCache(filepath.Join(dir, "cache"), convoFile, 100, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
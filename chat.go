@@ -3,6 +3,7 @@ package chatbot
 import (
 	"math"
 	"math/rand"
+	"time"
 
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/weakai/rnn"
@@ -11,46 +12,97 @@ import (
 // A Chat is a stateful conversation between some external
 // entity and a Bot.
 type Chat struct {
-	runner *rnn.Runner
+	// Tagger, if non-nil, labels the messages in the chat
+	// with attributes, like the tagger that was used while
+	// loading the bot's training data.
+	Tagger AttributeTagger
+
+	runner  *rnn.Runner
+	arch    *Architecture
+	persona string
+
+	// lastTime is the time of the latest message, or the
+	// zero time if there have been no messages.
+	lastTime time.Time
 }
 
 // NewChat creates a new chat with an empty history.
-func NewChat(b *Bot) *Chat {
+//
+// The persona is the label of the persona which the bot
+// should speak as, from b.Arch.Personas.
+// It may be "" for bots without personas, or to avoid
+// choosing one.
+func NewChat(b *Bot, persona string) *Chat {
 	b.Dropout(false)
 	return &Chat{
-		runner: &rnn.Runner{Block: b.Block},
+		runner:  &rnn.Runner{Block: b.Block},
+		arch:    b.Arch,
+		persona: persona,
 	}
 }
 
 // Send adds an external message to the chat log for the
 // bot to see.
-// It returns true if the bot expects to receive another
+//
+// The speaker identifies the sender in a group chat.
+// Speakers should be numbered from 0 in the order that
+// they join the conversation, and a chat with only one
+// external entity should always use speaker 0.
+//
+// Send returns true if the bot expects to receive another
 // message before replying.
-func (c *Chat) Send(m string) (more bool) {
-	return c.sendContents(StartExternalMsg, m)
+func (c *Chat) Send(speaker int, m string) (more bool) {
+	return c.SendAt(speaker, m, time.Now())
+}
+
+// SendAt is like Send, but for a message which was sent
+// at a specific time, such as a message from a chat's
+// history.
+func (c *Chat) SendAt(speaker int, m string, t time.Time) (more bool) {
+	return c.sendContents(c.arch.SpeakerToken(speaker), c.gap(t), m)
 }
 
 // ReceiveMessage tells the bot that it sent a message.
 // It returns true if the bot expects to send another
 // message.
 func (c *Chat) ReceiveMessage(m string) (more bool) {
-	return c.sendContents(StartBotMsg, m)
+	return c.ReceiveMessageAt(m, time.Now())
+}
+
+// ReceiveMessageAt is like ReceiveMessage, but for a
+// message which was sent at a specific time.
+func (c *Chat) ReceiveMessageAt(m string, t time.Time) (more bool) {
+	return c.sendContents(StartBotMsg, c.gap(t), m)
 }
 
 // Receive generates a message from the bot.
 // The more return value indicates whether or not the bot
 // wishes to send another message after this one.
-func (c *Chat) Receive() (msg string, more bool) {
-	lastOut := c.runner.StepTime(oneHotVector(StartBotMsg))
-	lastOut[StartExternalMsg] = math.Inf(-1)
-	lastOut[StartBotMsg] = math.Inf(-1)
+//
+// The attributes are labels from b.Arch.Attributes which
+// the message should have, such as "short" or "formal".
+// Labels which the bot does not know are ignored; use
+// Architecture.CheckControls to reject them instead.
+func (c *Chat) Receive(attributes ...string) (msg string, more bool) {
+	controls := InputControls{
+		Gap:        c.gap(time.Now()),
+		Persona:    c.persona,
+		Attributes: attributes,
+	}
+	lastOut := c.runner.StepTime(c.arch.InputVector(StartBotMsg, controls))
+	for i := range lastOut {
+		if c.arch.IsStartToken(i) {
+			lastOut[i] = math.Inf(-1)
+		}
+	}
 
 	var msgData []byte
 	for {
 		byteIdx := randomSelection(lastOut)
 		if byteIdx < CharCount {
 			msgData = append(msgData, byte(byteIdx))
-			lastOut = c.runner.StepTime(oneHotVector(byteIdx))
+			controls.Gap = 0
+			lastOut = c.runner.StepTime(c.arch.InputVector(byteIdx, controls))
 			continue
 		}
 		more = (byteIdx == StartBotMsg)
@@ -60,15 +112,43 @@ func (c *Chat) Receive() (msg string, more bool) {
 	return
 }
 
-func (c *Chat) sendContents(start int, m string) (more bool) {
-	lastOut := c.runner.StepTime(oneHotVector(start))
+// gap records the time of a new message and returns the
+// gap since the previous message, encoded as in
+// message.Gap.
+func (c *Chat) gap(t time.Time) int {
+	var res int
+	if !c.lastTime.IsZero() {
+		gap := t.Sub(c.lastTime)
+		if gap < 0 {
+			gap = 0
+		}
+		res = GapBucket(gap) + 1
+	}
+	c.lastTime = t
+	return res
+}
+
+func (c *Chat) sendContents(start, gap int, m string) (more bool) {
+	controls := InputControls{Gap: gap, Persona: c.persona}
+	if c.Tagger != nil {
+		controls.Attributes = c.Tagger.Tag(m)
+	}
+	lastOut := c.runner.StepTime(c.arch.InputVector(start, controls))
+	controls.Gap = 0
 	for _, b := range []byte(m) {
-		lastOut = c.runner.StepTime(oneHotVector(int(b)))
+		lastOut = c.runner.StepTime(c.arch.InputVector(int(b), controls))
+	}
+	var externalProb float64
+	for i, x := range lastOut {
+		if i != StartBotMsg && c.arch.IsStartToken(i) {
+			externalProb += math.Exp(x)
+		}
 	}
-	if start == StartExternalMsg {
-		return lastOut[StartBotMsg] < lastOut[StartExternalMsg]
+	botProb := math.Exp(lastOut[StartBotMsg])
+	if start == StartBotMsg {
+		return botProb > externalProb
 	} else {
-		return lastOut[StartBotMsg] > lastOut[StartExternalMsg]
+		return botProb < externalProb
 	}
 }
 
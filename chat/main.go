@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/unixpickle/chatbot"
@@ -11,22 +13,42 @@ import (
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "Usage: chat <bot_file>")
+	persona := flag.String("persona", "", "persona for the bot to speak as")
+	attributes := flag.String("attributes", "", "comma-separated attributes for the bot's replies")
+	tag := flag.Bool("tag", false, "tag messages with the default attribute taggers")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: chat [flags] <bot_file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	bot, err := chatbot.LoadBot(os.Args[1])
+	bot, err := chatbot.LoadBot(flag.Arg(0))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to load bot:", err)
 		os.Exit(1)
 	}
-	chat := chatbot.NewChat(bot)
+	var attrs []string
+	if *attributes != "" {
+		attrs = strings.Split(*attributes, ",")
+	}
+	controls := chatbot.InputControls{Persona: *persona, Attributes: attrs}
+	if err := bot.Arch.CheckControls(controls); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	chat := chatbot.NewChat(bot, *persona)
+	if *tag {
+		chat.Tagger = chatbot.DefaultAttributeTaggers()
+	}
 
 	for {
 		msg := readMessage()
-		chat.Send(msg)
+		chat.Send(0, msg)
 		for {
-			resp, more := chat.Receive()
+			resp, more := chat.Receive(attrs...)
 			fmt.Println("Bot>", resp)
 			if !more {
 				break
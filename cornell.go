@@ -0,0 +1,101 @@
+package chatbot
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cornellLinesFile  = "movie_lines.txt"
+	cornellConvosFile = "movie_conversations.txt"
+	cornellSeparator  = " +++$+++ "
+)
+
+// isCornellCorpus checks if a directory contains the
+// Cornell Movie-Dialogs corpus.
+func isCornellCorpus(dir string) bool {
+	for _, name := range []string{cornellLinesFile, cornellConvosFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// readCornell reads the conversations from a directory
+// containing the Cornell Movie-Dialogs corpus.
+//
+// The sender alternates between a human and the bot for
+// each line of a conversation.
+func readCornell(dir string) ([][]message, error) {
+	lines, err := readCornellLines(filepath.Join(dir, cornellLinesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	convosPath := filepath.Join(dir, cornellConvosFile)
+	f, err := os.Open(convosPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res [][]message
+	scanner := bufio.NewScanner(f)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Split(scanner.Text(), cornellSeparator)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s: line %d: expected 4 fields", convosPath, lineNum)
+		}
+		ids := strings.Trim(strings.TrimSpace(fields[3]), "[]")
+		var convo []message
+		for _, id := range strings.Split(ids, ",") {
+			id = strings.Trim(strings.TrimSpace(id), "'")
+			body, ok := lines[id]
+			if !ok {
+				return nil, fmt.Errorf("%s: line %d: unknown line ID %s", convosPath,
+					lineNum, id)
+			}
+			convo = append(convo, message{
+				FromBot: len(convo)%2 == 1,
+				Body:    body,
+			})
+		}
+		if len(convo) > 0 {
+			res = append(res, convo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: line %d: %s", convosPath, lineNum+1, err)
+	}
+	return res, nil
+}
+
+func readCornellLines(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Split(scanner.Text(), cornellSeparator)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s: line %d: expected 5 fields", path, lineNum)
+		}
+		res[fields[0]] = strings.TrimSpace(fields[4])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: line %d: %s", path, lineNum+1, err)
+	}
+	return res, nil
+}
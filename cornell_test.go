@@ -0,0 +1,53 @@
+package chatbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadCornell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, cornellLinesFile),
+		"L1 +++$+++ u0 +++$+++ m0 +++$+++ BIANCA +++$+++ Can we go?\n"+
+			"L2 +++$+++ u1 +++$+++ m0 +++$+++ CAMERON +++$+++ Sure. \n"+
+			"L3 +++$+++ u0 +++$+++ m0 +++$+++ BIANCA +++$+++ Great.\n"+
+			"L4 +++$+++ u1 +++$+++ m0 +++$+++ CAMERON +++$+++ Bye.\n")
+	writeTestFile(t, filepath.Join(dir, cornellConvosFile),
+		"u0 +++$+++ u1 +++$+++ m0 +++$+++ ['L1', 'L2', 'L3']\n"+
+			"u0 +++$+++ u1 +++$+++ m0 +++$+++ ['L4']\n")
+
+	if !isCornellCorpus(dir) {
+		t.Fatal("corpus not detected")
+	}
+	convos, err := readCornell(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]message{
+		{
+			{Body: "Can we go?"},
+			{FromBot: true, Body: "Sure."},
+			{Body: "Great."},
+		},
+		{
+			{Body: "Bye."},
+		},
+	}
+	if !reflect.DeepEqual(convos, expected) {
+		t.Errorf("expected %v but got %v", expected, convos)
+	}
+
+	writeTestFile(t, filepath.Join(dir, cornellConvosFile),
+		"u0 +++$+++ u1 +++$+++ m0 +++$+++ ['L1', 'L5']\n")
+	if _, err := readCornell(dir); err == nil {
+		t.Error("expected an error for an unknown line ID")
+	}
+}
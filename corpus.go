@@ -0,0 +1,206 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Histogram counts values in power-of-two buckets.
+//
+// Bucket 0 counts zeroes, and bucket i > 0 counts values
+// in the range [2^(i-1), 2^i).
+type Histogram []int
+
+// Add adds a non-negative value to the histogram.
+func (h *Histogram) Add(value int) {
+	bucket := bits.Len(uint(value))
+	for len(*h) <= bucket {
+		*h = append(*h, 0)
+	}
+	(*h)[bucket]++
+}
+
+// BucketRange returns the inclusive range of values which
+// are counted by a bucket.
+func (h Histogram) BucketRange(bucket int) (min, max int) {
+	if bucket == 0 {
+		return 0, 0
+	}
+	return 1 << uint(bucket-1), 1<<uint(bucket) - 1
+}
+
+// CorpusStats summarizes a corpus of conversations.
+type CorpusStats struct {
+	Conversations int
+	Messages      int
+	BotMessages   int
+	Snippets      int
+
+	// ConversationLengths counts the number of messages in
+	// each conversation.
+	ConversationLengths Histogram
+
+	// MessageLengths counts the number of bytes in each
+	// message.
+	MessageLengths Histogram
+
+	// SnippetLengths counts the number of bytes in each
+	// training snippet, including control tokens.
+	SnippetLengths Histogram
+
+	// EmptyMessages counts messages which are never trained
+	// on because they are empty.
+	EmptyMessages int
+
+	// LongMessages counts messages which are never trained
+	// on because they do not fit in the maximum buffer.
+	LongMessages int
+
+	// DuplicateMessages counts messages which are never
+	// trained on because they are duplicates.
+	DuplicateMessages int
+
+	// EmptyCutoffs and LengthCutoffs count the snippets
+	// whose history was cut short by an empty message or
+	// by the maximum buffer size, respectively.
+	EmptyCutoffs  int
+	LengthCutoffs int
+
+	// CutSnippets counts the snippets containing a message
+	// which was cut to fit in the maximum buffer.
+	CutSnippets int
+
+	// Bytes counts each byte value in message bodies.
+	Bytes [256]int
+
+	// ASCIIRunes, MultiByteRunes, ControlRunes, and
+	// InvalidUTF8 categorize the UTF-8 contents of the
+	// messages.
+	// ControlRunes overlaps with the other categories.
+	ASCIIRunes     int
+	MultiByteRunes int
+	ControlRunes   int
+	InvalidUTF8    int
+
+	// Issues lists problems with the corpus, such as
+	// malformed rows and unreadable files.
+	// Each issue is prefixed with a file name and, where
+	// possible, a line number.
+	Issues []string
+
+	// SkippedFiles lists the files which were not read
+	// because they lack a conversation extension.
+	SkippedFiles []string
+}
+
+// AnalyzeCorpus computes statistics about the corpus at
+// the given path.
+//
+// The arguments are treated the same way as they are in
+// NewSampleSetOptions, except that malformed rows and
+// unreadable files are recorded as issues instead of
+// stopping the analysis.
+func AnalyzeCorpus(path string, maxBuffer int, opts *LoadOptions) (*CorpusStats, error) {
+	var walkOpts LoadOptions
+	if opts != nil {
+		walkOpts = *opts
+	}
+	res := &CorpusStats{}
+	walkOpts.SkipBadFiles = true
+	walkOpts.Warn = func(err error) {
+		if errors.Is(err, errNotConversationFile) {
+			res.SkippedFiles = append(res.SkippedFiles, err.Error())
+		} else {
+			res.Issues = append(res.Issues, err.Error())
+		}
+	}
+	err := walkOpts.walkSources(path, func(source string) error {
+		convos, err := readConversationSourceRows(source, func(err error) error {
+			res.Issues = append(res.Issues, fmt.Sprintf("%s: %s", source, err))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, convo := range walkOpts.dedup(walkOpts.prepare(convos)) {
+			res.addConversation(maxBuffer, &walkOpts.Snippets, convo)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// BotRatio returns the fraction of messages sent by the
+// bot.
+func (c *CorpusStats) BotRatio() float64 {
+	if c.Messages == 0 {
+		return 0
+	}
+	return float64(c.BotMessages) / float64(c.Messages)
+}
+
+func (c *CorpusStats) addConversation(maxBuffer int, opts *SnippetOptions,
+	convo []message) {
+	c.Conversations++
+	c.ConversationLengths.Add(len(convo))
+	for i, msg := range convo {
+		c.Messages++
+		if msg.FromBot {
+			c.BotMessages++
+		}
+		c.MessageLengths.Add(len(msg.Body))
+		c.addBody(msg.Body)
+
+		sn, stop := opts.generate(maxBuffer, convo, i)
+		if sn == nil {
+			switch stop {
+			case stopDuplicate:
+				c.DuplicateMessages++
+			case stopEmptyMessage:
+				c.EmptyMessages++
+			default:
+				c.LongMessages++
+			}
+			continue
+		}
+		c.Snippets++
+		c.SnippetLengths.Add(sn.length())
+		if sn.FirstCut > 0 || sn.LastCut > 0 {
+			c.CutSnippets++
+		}
+		switch stop {
+		case stopEmptyMessage:
+			c.EmptyCutoffs++
+		case stopMaxChars:
+			c.LengthCutoffs++
+		}
+	}
+}
+
+func (c *CorpusStats) addBody(body string) {
+	for i := 0; i < len(body); i++ {
+		c.Bytes[body[i]]++
+	}
+	for len(body) > 0 {
+		r, size := utf8.DecodeRuneInString(body)
+		body = body[size:]
+		if r == utf8.RuneError && size == 1 {
+			c.InvalidUTF8++
+			continue
+		}
+		if size == 1 {
+			c.ASCIIRunes++
+		} else {
+			c.MultiByteRunes++
+		}
+		if unicode.IsControl(r) {
+			c.ControlRunes++
+		}
+	}
+}
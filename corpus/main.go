@@ -0,0 +1,235 @@
+// Command corpus inspects and validates corpora of
+// conversations before they are used for training.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/unixpickle/chatbot"
+	"golang.org/x/text/unicode/norm"
+)
+
+const MaxBufferChars = 600
+
+func main() {
+	if len(os.Args) < 2 {
+		dieUsage()
+	}
+	switch os.Args[1] {
+	case "stats":
+		Stats(os.Args[2:])
+	case "scrub":
+		Scrub(os.Args[2:])
+	case "dedup":
+		Dedup(os.Args[2:])
+	default:
+		dieUsage()
+	}
+}
+
+func Stats(args []string) {
+	var loadOpts chatbot.LoadOptions
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	loadOpts.AddFlags(fs)
+	maxBuffer := fs.Int("maxbuffer", MaxBufferChars, "maximum characters per sample")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		dieUsage()
+	}
+
+	stats, err := chatbot.AnalyzeCorpus(fs.Arg(0), *maxBuffer, &loadOpts)
+	if err != nil {
+		die("Failed to analyze corpus:", err)
+	}
+
+	fmt.Println("Conversations:", stats.Conversations)
+	fmt.Println("Messages:     ", stats.Messages)
+	fmt.Println("Snippets:     ", stats.Snippets)
+	fmt.Printf("Bot messages:  %d (%.1f%%)\n", stats.BotMessages, 100*stats.BotRatio())
+	fmt.Println()
+
+	fmt.Println("Dropped messages:")
+	fmt.Println("  empty:          ", stats.EmptyMessages)
+	fmt.Println("  over max buffer:", stats.LongMessages)
+	fmt.Println("  duplicates:     ", stats.DuplicateMessages)
+	fmt.Println("Snippet history cut short:")
+	fmt.Println("  by empty message:", stats.EmptyCutoffs)
+	fmt.Println("  by max buffer:   ", stats.LengthCutoffs)
+	fmt.Println("Snippets with cut messages:", stats.CutSnippets)
+	fmt.Println()
+
+	printHistogram("Conversation lengths (messages)", stats.ConversationLengths)
+	printHistogram("Message lengths (bytes)", stats.MessageLengths)
+	printHistogram("Snippet lengths (bytes)", stats.SnippetLengths)
+
+	fmt.Println("Characters:")
+	fmt.Println("  ASCII:          ", stats.ASCIIRunes)
+	fmt.Println("  multi-byte UTF-8:", stats.MultiByteRunes)
+	fmt.Println("  control:        ", stats.ControlRunes)
+	fmt.Println("  invalid UTF-8:  ", stats.InvalidUTF8)
+	printTopBytes(stats.Bytes, 10)
+	fmt.Println()
+
+	fmt.Println("Skipped files:", len(stats.SkippedFiles))
+	for _, skipped := range stats.SkippedFiles {
+		fmt.Println(" ", skipped)
+	}
+	fmt.Println("Issues:", len(stats.Issues))
+	for _, issue := range stats.Issues {
+		fmt.Println(" ", issue)
+	}
+	if len(stats.Issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+func Scrub(args []string) {
+	var loadOpts chatbot.LoadOptions
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	loadOpts.AddFlags(fs)
+	normalize := fs.Bool("normalize", true, "normalize Unicode to NFC")
+	whitespace := fs.Bool("whitespace", true, "clean up whitespace")
+	pii := fs.Bool("pii", true, "replace email addresses and phone numbers")
+	names := fs.String("names", "", "comma-separated names to replace with <NAME>")
+	urls := fs.String("urls", "host", "collapse URLs to their host (\"host\"), "+
+		"a placeholder (any other value), or leave them (\"\")")
+	maxLen := fs.Int("maxlen", 0, "maximum message length in bytes (0 for no limit)")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		dieUsage()
+	}
+	if *maxLen < 0 {
+		die("Invalid -maxlen:", *maxLen)
+	}
+
+	var chain chatbot.PreprocessorChain
+	if *normalize {
+		chain = append(chain, &chatbot.NormalizeUnicode{Form: norm.NFC})
+	}
+	var patterns []chatbot.PIIPattern
+	if *pii {
+		patterns = append(patterns, chatbot.DefaultPIIPatterns()...)
+	}
+	if *names != "" {
+		var nameList []string
+		for _, name := range strings.Split(*names, ",") {
+			nameList = append(nameList, strings.TrimSpace(name))
+		}
+		pattern, err := chatbot.NamePattern(nameList, "<NAME>")
+		if err != nil {
+			die("Invalid -names:", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) > 0 {
+		chain = append(chain, &chatbot.ReplacePII{Patterns: patterns})
+	}
+	if *urls == "host" {
+		chain = append(chain, &chatbot.CollapseURLs{})
+	} else if *urls != "" {
+		chain = append(chain, &chatbot.CollapseURLs{Placeholder: *urls})
+	}
+	if *whitespace {
+		chain = append(chain, &chatbot.CleanWhitespace{})
+	}
+	if *maxLen > 0 {
+		chain = append(chain, &chatbot.TruncateMessages{MaxLength: *maxLen})
+	}
+	loadOpts.Preprocessor = chain
+
+	if err := chatbot.RewriteCorpus(fs.Arg(0), fs.Arg(1), &loadOpts); err != nil {
+		die("Failed to rewrite corpus:", err)
+	}
+}
+
+func Dedup(args []string) {
+	var loadOpts chatbot.LoadOptions
+	dedup := &chatbot.Deduplicator{}
+	fs := flag.NewFlagSet("dedup", flag.ExitOnError)
+
+	// The deduplicator is configured by the flags below,
+	// so the -dedup load flag would be ignored.
+	loadFlags := flag.NewFlagSet("", flag.ContinueOnError)
+	loadOpts.AddFlags(loadFlags)
+	loadFlags.VisitAll(func(f *flag.Flag) {
+		if f.Name != "dedup" {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.BoolVar(&dedup.Conversations, "conversations", true, "remove duplicate conversations")
+	fs.BoolVar(&dedup.Messages, "messages", true,
+		"count duplicate messages (they are kept as context)")
+	fs.Float64Var(&dedup.Threshold, "threshold", 0.9,
+		"similarity for near-duplicates (0 or 1 for exact matches only)")
+	fs.IntVar(&dedup.MinLength, "minlen", chatbot.DefaultDedupMinLength,
+		"minimum length of a message to remove")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		dieUsage()
+	}
+	loadOpts.Dedup = dedup
+
+	if err := chatbot.RewriteCorpus(fs.Arg(0), fs.Arg(1), &loadOpts); err != nil {
+		die("Failed to rewrite corpus:", err)
+	}
+
+	stats := dedup.Stats
+	fmt.Println("Removed conversations:", stats.Conversations)
+	fmt.Println("  exact:", stats.ExactConversations)
+	fmt.Println("  near: ", stats.NearConversations)
+	fmt.Println("Duplicate messages:", stats.Messages)
+	fmt.Println("  exact:", stats.ExactMessages)
+	fmt.Println("  near: ", stats.NearMessages)
+}
+
+func printHistogram(title string, h chatbot.Histogram) {
+	fmt.Println(title + ":")
+	for i, count := range h {
+		if count == 0 {
+			continue
+		}
+		min, max := h.BucketRange(i)
+		fmt.Printf("  %6d-%-6d %d\n", min, max, count)
+	}
+	fmt.Println()
+}
+
+func printTopBytes(counts [256]int, n int) {
+	var order []int
+	for i, count := range counts {
+		if count > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	if len(order) > n {
+		order = order[:n]
+	}
+	fmt.Println("  most common bytes:")
+	for _, b := range order {
+		if b < utf8.RuneSelf {
+			fmt.Printf("    %q %d\n", string(rune(b)), counts[b])
+		} else {
+			fmt.Printf("    0x%02x %d\n", b, counts[b])
+		}
+	}
+}
+
+func dieUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: corpus stats [flags] <samples>")
+	fmt.Fprintln(os.Stderr, "       corpus scrub [flags] <samples> <output_dir>")
+	fmt.Fprintln(os.Stderr, "       corpus dedup [flags] <samples> <output_dir>")
+	os.Exit(1)
+}
+
+func die(args ...interface{}) {
+	fmt.Fprintln(os.Stderr, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir := testCorpus(t, map[string]string{
+		"a.csv": "human,héllo\nbot,hi\n",
+	})
+	defer os.RemoveAll(dir)
+	output := captureStdout(t, func() {
+		Stats([]string{dir})
+	})
+	for _, line := range []string{
+		"Conversations: 1\n",
+		"Messages:      2\n",
+		"Bot messages:  1 (50.0%)\n",
+		"    \"h\" 2\n",
+		"    0xc3 1\n",
+		"Issues: 0\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("missing %q in output:\n%s", line, output)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	dir := testCorpus(t, map[string]string{
+		"in/a.csv": "human,\"Email bob@example.com  now, Bob\"\n" +
+			"bot,see   www.example.com/page\n",
+	})
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	captureStdout(t, func() {
+		Scrub([]string{"-names", "Bob", filepath.Join(dir, "in"), out})
+	})
+	actual, err := ioutil.ReadFile(filepath.Join(out, "a.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "human,\"Email <EMAIL> now, <NAME>\"\nbot,see www.example.com\n"
+	if string(actual) != expected {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	convo := "human,how are you doing today\nbot,pretty well thanks for asking\n"
+	dir := testCorpus(t, map[string]string{
+		"in/a.csv": convo,
+		"in/b.csv": convo,
+	})
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	output := captureStdout(t, func() {
+		Dedup([]string{filepath.Join(dir, "in"), out})
+	})
+	if !strings.Contains(output, "Removed conversations: 1\n") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(out, "a.csv")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "b.csv")); err == nil {
+		t.Error("duplicate conversation was written")
+	}
+}
+
+func testCorpus(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// captureStdout runs f and returns what it writes to the
+// standard output.
+func captureStdout(t *testing.T, f func()) string {
+	tempFile, err := ioutil.TempFile("", "corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	oldStdout := os.Stdout
+	os.Stdout = tempFile
+	defer func() {
+		os.Stdout = oldStdout
+	}()
+	f()
+
+	output, err := ioutil.ReadFile(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
@@ -0,0 +1,306 @@
+package chatbot
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// DefaultDedupMinLength is the default minimum length
+	// of a message for it to be removed as a duplicate.
+	DefaultDedupMinLength = 20
+
+	minHashSize    = 64
+	minHashBands   = 16
+	minHashRows    = minHashSize / minHashBands
+	shingleSize    = 5
+	dedupSeparator = "\x00"
+)
+
+// DedupStats counts the duplicates found by a
+// Deduplicator.
+//
+// Duplicate conversations are removed, while duplicate
+// messages are kept as context but not trained on.
+type DedupStats struct {
+	Conversations      int
+	ExactConversations int
+	NearConversations  int
+
+	Messages      int
+	ExactMessages int
+	NearMessages  int
+}
+
+// A Deduplicator removes duplicate and near-duplicate
+// conversations and messages from a corpus.
+//
+// Near-duplicates are detected by estimating the Jaccard
+// similarity of character shingles with MinHash, using
+// locality-sensitive hashing to find candidates.
+//
+// A Deduplicator remembers everything it has seen, so the
+// same Deduplicator should not be used for more than one
+// corpus.
+// It is not safe to use from multiple Goroutines.
+type Deduplicator struct {
+	// Conversations enables the removal of conversations
+	// which duplicate earlier conversations.
+	Conversations bool
+
+	// Messages enables the masking of messages which
+	// duplicate earlier messages anywhere in the corpus.
+	// A masked message stays in the history of the
+	// messages after it, so the turns of its conversation
+	// are not disturbed, but the bot is not trained to
+	// produce it.
+	Messages bool
+
+	// Threshold is the similarity (between 0 and 1) above
+	// which two items are considered near-duplicates.
+	// If it is 0 or 1, only exact duplicates are removed.
+	Threshold float64
+
+	// MinLength is the minimum length of a message, in
+	// bytes, for it to be masked as a duplicate.
+	// Short messages like "ok" are expected to repeat.
+	// If it is 0, DefaultDedupMinLength is used.
+	MinLength int
+
+	// Stats is updated as duplicates are found.
+	Stats DedupStats
+
+	convos   *dedupIndex
+	messages *dedupIndex
+}
+
+// filter removes duplicate conversations and masks
+// duplicate messages, recording everything it sees so
+// that future duplicates will also be found.
+func (d *Deduplicator) filter(convos [][]message) [][]message {
+	return applyDedupMask(convos, d.mask(convos))
+}
+
+// A dedupMask records the duplicates in a list of
+// conversations.
+type dedupMask struct {
+	// Removed indicates which conversations are
+	// duplicates.
+	Removed []bool
+
+	// Duplicates lists the indices of the duplicate
+	// messages in each conversation.
+	Duplicates [][]int
+}
+
+// mask finds the duplicates in a list of conversations.
+// If there are none, the result is nil.
+func (d *Deduplicator) mask(convos [][]message) *dedupMask {
+	if d.convos == nil {
+		d.convos = newDedupIndex()
+		d.messages = newDedupIndex()
+	}
+	res := &dedupMask{
+		Removed:    make([]bool, len(convos)),
+		Duplicates: make([][]int, len(convos)),
+	}
+	var found bool
+	for convoIdx, convo := range convos {
+		if d.Conversations {
+			var texts []string
+			for _, msg := range convo {
+				sender := "h"
+				if msg.FromBot {
+					sender = "b"
+				}
+				texts = append(texts, sender+normalizeDedupText(msg.Body))
+			}
+			switch d.convos.Add(strings.Join(texts, dedupSeparator), d.Threshold) {
+			case dedupExact:
+				d.Stats.Conversations++
+				d.Stats.ExactConversations++
+				res.Removed[convoIdx] = true
+				found = true
+				continue
+			case dedupNear:
+				d.Stats.Conversations++
+				d.Stats.NearConversations++
+				res.Removed[convoIdx] = true
+				found = true
+				continue
+			}
+		}
+		if !d.Messages {
+			continue
+		}
+		for i, msg := range convo {
+			if len(msg.Body) < d.minLength() {
+				continue
+			}
+			switch d.messages.Add(normalizeDedupText(msg.Body), d.Threshold) {
+			case dedupExact:
+				d.Stats.Messages++
+				d.Stats.ExactMessages++
+			case dedupNear:
+				d.Stats.Messages++
+				d.Stats.NearMessages++
+			default:
+				continue
+			}
+			res.Duplicates[convoIdx] = append(res.Duplicates[convoIdx], i)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return res
+}
+
+func (d *Deduplicator) minLength() int {
+	if d.MinLength == 0 {
+		return DefaultDedupMinLength
+	}
+	return d.MinLength
+}
+
+// applyDedupMask removes the duplicate conversations
+// from a mask and marks the duplicate messages.
+func applyDedupMask(convos [][]message, mask *dedupMask) [][]message {
+	if mask == nil {
+		return convos
+	}
+	var res [][]message
+	for i, convo := range convos {
+		if mask.Removed[i] {
+			continue
+		}
+		for _, idx := range mask.Duplicates[i] {
+			convo[idx].Duplicate = true
+		}
+		res = append(res, convo)
+	}
+	return res
+}
+
+func normalizeDedupText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+type dedupResult int
+
+const (
+	dedupUnique dedupResult = iota
+	dedupExact
+	dedupNear
+)
+
+// A minHashSignature stores the low 16 bits of each
+// minimum hash (b-bit MinHash).
+// Chance collisions of the truncated hashes inflate
+// similarities by about 2^-16, which is negligible, and
+// the signatures take a quarter of the memory.
+type minHashSignature [minHashSize]uint16
+
+// dedupIndex stores exact hashes and MinHash signatures
+// of the items seen so far.
+type dedupIndex struct {
+	exact      map[uint64]struct{}
+	signatures []minHashSignature
+	buckets    map[uint64][]int32
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{
+		exact:   map[uint64]struct{}{},
+		buckets: map[uint64][]int32{},
+	}
+}
+
+// Add checks if text duplicates a previous item, and
+// records it if it does not.
+func (d *dedupIndex) Add(text string, threshold float64) dedupResult {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	exactHash := h.Sum64()
+	if _, ok := d.exact[exactHash]; ok {
+		return dedupExact
+	}
+	d.exact[exactHash] = struct{}{}
+	if threshold <= 0 || threshold >= 1 {
+		return dedupUnique
+	}
+
+	sig := newMinHashSignature(text)
+	bandKeys := make([]uint64, minHashBands)
+	for band := range bandKeys {
+		h := fnv.New64a()
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(band))
+		h.Write(buf[:])
+		for _, x := range sig[band*minHashRows : (band+1)*minHashRows] {
+			binary.LittleEndian.PutUint16(buf[:], x)
+			h.Write(buf[:2])
+		}
+		bandKeys[band] = h.Sum64()
+		for _, candidate := range d.buckets[bandKeys[band]] {
+			if signatureSimilarity(&sig, &d.signatures[candidate]) >= threshold {
+				return dedupNear
+			}
+		}
+	}
+
+	idx := int32(len(d.signatures))
+	d.signatures = append(d.signatures, sig)
+	for _, key := range bandKeys {
+		d.buckets[key] = append(d.buckets[key], idx)
+	}
+	return dedupUnique
+}
+
+func newMinHashSignature(text string) minHashSignature {
+	var mins [minHashSize]uint64
+	for i := range mins {
+		mins[i] = ^uint64(0)
+	}
+	addShingle := func(shingle string) {
+		h := fnv.New64a()
+		h.Write([]byte(shingle))
+		base := h.Sum64()
+		for i := range mins {
+			if x := splitMix64(base ^ uint64(i)*0x9e3779b97f4a7c15); x < mins[i] {
+				mins[i] = x
+			}
+		}
+	}
+	if len(text) <= shingleSize {
+		addShingle(text)
+	} else {
+		for i := 0; i+shingleSize <= len(text); i++ {
+			addShingle(text[i : i+shingleSize])
+		}
+	}
+	var sig minHashSignature
+	for i, x := range mins {
+		sig[i] = uint16(x)
+	}
+	return sig
+}
+
+func signatureSimilarity(s1, s2 *minHashSignature) float64 {
+	var matches int
+	for i, x := range s1 {
+		if x == s2[i] {
+			matches++
+		}
+	}
+	return float64(matches) / minHashSize
+}
+
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
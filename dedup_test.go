@@ -0,0 +1,120 @@
+package chatbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeduplicatorMasksMessages(t *testing.T) {
+	repeated := "this message is copied and pasted everywhere"
+	convos := [][]message{
+		{
+			{Body: "first conversation starts here"},
+			{FromBot: true, Body: repeated},
+		},
+		{
+			{Body: "second conversation starts here"},
+			{FromBot: true, Body: repeated},
+			{Body: "and it keeps going after the copy"},
+		},
+		{
+			{Body: "first conversation starts here"},
+			{FromBot: true, Body: repeated},
+		},
+	}
+	dedup := &Deduplicator{Conversations: true, Messages: true}
+	filtered := dedup.filter(convos)
+
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 conversations but got %d", len(filtered))
+	}
+	if len(filtered[1]) != 3 {
+		t.Fatalf("expected the duplicate message to stay in history")
+	}
+	if !filtered[1][1].Duplicate || filtered[0][1].Duplicate {
+		t.Error("wrong messages marked as duplicates")
+	}
+	if dedup.Stats.ExactConversations != 1 || dedup.Stats.ExactMessages != 1 {
+		t.Errorf("unexpected stats: %+v", dedup.Stats)
+	}
+
+	var opts SnippetOptions
+	if sn, _ := opts.generate(1000, filtered[1], 1); sn != nil {
+		t.Error("duplicate message should not be trained on")
+	}
+	sn, _ := opts.generate(1000, filtered[1], 2)
+	if sn == nil || len(sn.Messages) != 3 {
+		t.Fatal("duplicate message should be in the history of later messages")
+	}
+
+	// Outputs are shifted back by one timestep, so the
+	// outputs for the duplicate's bytes start right after
+	// its start token.
+	arch := &Architecture{StateSizes: []int{10}}
+	outputs := sn.Sample(arch).Outputs
+	dupStart := len(filtered[1][0].Body) + 1
+	for i, out := range outputs {
+		zero := out.Dot(out) == 0
+		isDup := i >= dupStart && i < dupStart+len(repeated)
+		if zero != isDup {
+			t.Errorf("output %d: expected zero=%v but got %v", i, isDup, out)
+		}
+	}
+}
+
+func TestDeduplicatorCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corpus := filepath.Join(dir, "corpus.csv")
+	writeTestFile(t, corpus, "human,this message is repeated twice\n"+
+		"bot,and this one is not repeated\n"+
+		"human,this message is repeated twice\n"+
+		"bot,ok\n")
+	newOpts := func() *LoadOptions {
+		return &LoadOptions{Dedup: &Deduplicator{Messages: true}}
+	}
+	expected, err := NewSampleSetOptions(corpus, 100, newOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheFile := filepath.Join(dir, "cache")
+	if err := WriteSampleCache(cacheFile, corpus, 100, newOpts()); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := OpenCacheSampleSet(cacheFile, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actual.Close()
+	if actual.Len() != expected.Len() {
+		t.Fatalf("expected %d samples but got %d", expected.Len(), actual.Len())
+	}
+	for i := 0; i < expected.Len(); i++ {
+		if !reflect.DeepEqual(actual.GetSample(i), expected.GetSample(i)) {
+			t.Errorf("sample %d differs", i)
+		}
+	}
+}
+
+func TestDeduplicatorNearDuplicates(t *testing.T) {
+	dedup := &Deduplicator{Messages: true, Threshold: 0.8}
+	convos := [][]message{
+		{{Body: "the quick brown fox jumps over the lazy dog near the river bank"}},
+		{{Body: "the quick brown fox jumps over the lazy dog near the river bank!"}},
+		{{Body: "a completely different message about something else entirely"}},
+	}
+	filtered := dedup.filter(convos)
+	if filtered[0][0].Duplicate || !filtered[1][0].Duplicate || filtered[2][0].Duplicate {
+		t.Errorf("unexpected duplicates: %v %v %v", filtered[0][0].Duplicate,
+			filtered[1][0].Duplicate, filtered[2][0].Duplicate)
+	}
+	if dedup.Stats.NearMessages != 1 {
+		t.Errorf("unexpected stats: %+v", dedup.Stats)
+	}
+}
@@ -0,0 +1,370 @@
+package chatbot
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+const (
+	// DiskCacheBytes is the approximate number of bytes of
+	// decoded conversations which a DiskSampleSet keeps in
+	// memory.
+	// The least recently used sources are evicted first,
+	// but the most recently used source is always kept,
+	// however large it is.
+	DiskCacheBytes = 256 << 20
+
+	// DiskReadAttempts is the number of times that a
+	// DiskSampleSet tries to read a source before it gives
+	// up on a sample.
+	DiskReadAttempts = 3
+)
+
+type diskSnippet struct {
+	Source      int32
+	Convo       int32
+	Start       int32
+	End         int32
+	FirstCut    int32
+	LastCut     int32
+	Length      int32
+	EndOfChat   bool
+	NextBot     bool
+	NextSpeaker int32
+}
+
+// A DiskSampleSet is a sample set which does not keep
+// conversations in memory.
+// Instead, it stores an index of the snippets in every
+// conversation file, and reads files from disk as their
+// samples are requested.
+//
+// Every read decodes, preprocesses, and tags a whole
+// file, so the recently read files are cached, up to
+// DiskCacheBytes.
+// If the corpus fits in the cache, samples may be
+// requested in any order.
+// Otherwise, samples should be requested in an order
+// where samples from the same file are close together,
+// like the order produced by Reshuffle (and by
+// ShuffleEpoch, which calls it).
+// A random order, such as the order used by
+// BucketSampler or a MixtureSampleSet, reads a file for
+// almost every sample of a corpus that does not fit.
+//
+// A DiskSampleSet is safe to use from multiple
+// Goroutines at once.
+type DiskSampleSet struct {
+	arch     *Architecture
+	cache    *diskCache
+	snippets []diskSnippet
+}
+
+// NewDiskSampleSet indexes the conversations at a path.
+// The arguments are treated the same way as they are in
+// NewSampleSetOptions.
+//
+// The conversation files should not be modified while
+// the resulting sample set is in use.
+func NewDiskSampleSet(path string, maxBuffer int, opts *LoadOptions) (*DiskSampleSet, error) {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	res := &DiskSampleSet{
+		arch: opts.Arch,
+		cache: &diskCache{
+			opts:     opts,
+			maxBytes: DiskCacheBytes,
+			entries:  map[int32]*diskCacheEntry{},
+		},
+	}
+	err := opts.walkSources(path, func(source string) error {
+		convos, err := opts.readSource(source)
+		if err != nil {
+			return err
+		}
+		var mask *dedupMask
+		if opts.Dedup != nil {
+			mask = opts.Dedup.mask(convos)
+			convos = applyDedupMask(convos, mask)
+		}
+		sourceIdx := int32(len(res.cache.sources))
+		res.cache.sources = append(res.cache.sources, source)
+		res.cache.masks = append(res.cache.masks, mask)
+		res.cache.sizes = append(res.cache.sizes, convosSize(convos))
+		for convoIdx, convo := range convos {
+			for i := range convo {
+				sn, _ := opts.Snippets.generate(maxBuffer, convo, i)
+				if sn == nil {
+					continue
+				}
+				res.snippets = append(res.snippets, diskSnippet{
+					Source:      sourceIdx,
+					Convo:       int32(convoIdx),
+					Start:       int32(i + 1 - len(sn.Messages)),
+					End:         int32(i + 1),
+					FirstCut:    int32(sn.FirstCut),
+					LastCut:     int32(sn.LastCut),
+					Length:      int32(sn.length()),
+					EndOfChat:   sn.EndOfChat,
+					NextBot:     sn.NextBot,
+					NextSpeaker: int32(sn.NextSpeaker),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Len returns the number of samples.
+func (d *DiskSampleSet) Len() int {
+	return len(d.snippets)
+}
+
+// Copy returns a shallow copy of the sample set.
+// The copy shares a file cache with the original.
+func (d *DiskSampleSet) Copy() sgd.SampleSet {
+	res := &DiskSampleSet{
+		arch:     d.arch,
+		cache:    d.cache,
+		snippets: make([]diskSnippet, len(d.snippets)),
+	}
+	copy(res.snippets, d.snippets)
+	return res
+}
+
+// Swap swaps two samples.
+func (d *DiskSampleSet) Swap(i, j int) {
+	d.snippets[i], d.snippets[j] = d.snippets[j], d.snippets[i]
+}
+
+// Reshuffle shuffles the samples while keeping samples
+// from the same file close together, so that each file
+// is read about once per epoch.
+//
+// The files are shuffled and split into groups which fit
+// in half of the cache, and the samples within each
+// group are shuffled.
+func (d *DiskSampleSet) Reshuffle() {
+	bySource := map[int32][]diskSnippet{}
+	var sources []int32
+	for _, sn := range d.snippets {
+		if _, ok := bySource[sn.Source]; !ok {
+			sources = append(sources, sn.Source)
+		}
+		bySource[sn.Source] = append(bySource[sn.Source], sn)
+	}
+	rand.Shuffle(len(sources), func(i, j int) {
+		sources[i], sources[j] = sources[j], sources[i]
+	})
+
+	shuffled := d.snippets[:0]
+	var groupStart, groupSize int
+	for _, source := range sources {
+		size := d.cache.sizes[source]
+		if groupSize > 0 && groupSize+size > d.cache.maxBytes/2 {
+			shuffleDiskSnippets(shuffled[groupStart:])
+			groupStart, groupSize = len(shuffled), 0
+		}
+		shuffled = append(shuffled, bySource[source]...)
+		groupSize += size
+	}
+	shuffleDiskSnippets(shuffled[groupStart:])
+}
+
+func shuffleDiskSnippets(s []diskSnippet) {
+	rand.Shuffle(len(s), func(i, j int) {
+		s[i], s[j] = s[j], s[i]
+	})
+}
+
+// GetSample reads the snippet at the given index and
+// generates a seqtoseq.Sample for it.
+//
+// If the snippet's conversation file can no longer be
+// read, a warning is logged and the next readable sample
+// in the set is returned in its place.
+// GetSample panics if no sample can be read.
+func (d *DiskSampleSet) GetSample(idx int) interface{} {
+	sn, err := d.snippet(idx)
+	if err == nil {
+		return sn.Sample(d.arch)
+	}
+	log.Println("Warning: substituting sample:", err)
+	failed := map[int32]bool{d.snippets[idx].Source: true}
+	for i := 1; i < len(d.snippets); i++ {
+		subIdx := (idx + i) % len(d.snippets)
+		source := d.snippets[subIdx].Source
+		if failed[source] {
+			continue
+		}
+		if sn, err := d.snippet(subIdx); err == nil {
+			return sn.Sample(d.arch)
+		}
+		failed[source] = true
+	}
+	panic("no readable samples: " + err.Error())
+}
+
+// SampleLength returns the number of timesteps in the
+// sample at the given index, without reading it from
+// disk.
+func (d *DiskSampleSet) SampleLength(idx int) int {
+	return int(d.snippets[idx].Length)
+}
+
+// Subset returns a subset of this sample set.
+func (d *DiskSampleSet) Subset(start, end int) sgd.SampleSet {
+	return &DiskSampleSet{
+		arch:     d.arch,
+		cache:    d.cache,
+		snippets: d.snippets[start:end],
+	}
+}
+
+// Hash returns a hash of the given sample.
+//
+// The hash is computed from the snippet's location rather
+// than its contents, so that it does not change if the
+// conversation file cannot be read.
+func (d *DiskSampleSet) Hash(i int) []byte {
+	entry := d.snippets[i]
+	h := md5.New()
+	h.Write([]byte(d.cache.sources[entry.Source]))
+	binary.Write(h, binary.LittleEndian, []int32{entry.Convo, entry.Start, entry.End})
+	return h.Sum(nil)
+}
+
+func (d *DiskSampleSet) snippet(idx int) (*snippet, error) {
+	entry := d.snippets[idx]
+	convos, err := d.cache.Get(entry.Source)
+	if err != nil {
+		return nil, err
+	}
+	if int(entry.Convo) >= len(convos) || int(entry.End) > len(convos[entry.Convo]) {
+		return nil, fmt.Errorf("load %s: file has changed", d.cache.sources[entry.Source])
+	}
+	return &snippet{
+		EndOfChat:   entry.EndOfChat,
+		NextBot:     entry.NextBot,
+		NextSpeaker: int(entry.NextSpeaker),
+		Messages:    convos[entry.Convo][entry.Start:entry.End],
+		FirstCut:    int(entry.FirstCut),
+		LastCut:     int(entry.LastCut),
+	}, nil
+}
+
+// diskCache stores recently decoded conversation sources.
+type diskCache struct {
+	opts     *LoadOptions
+	sources  []string
+	maxBytes int
+
+	// masks stores the duplicates found in each source.
+	masks []*dedupMask
+
+	// sizes stores the convosSize of each source.
+	sizes []int
+
+	lock    sync.Mutex
+	entries map[int32]*diskCacheEntry
+
+	// recent lists the loaded entries, starting with the
+	// most recently used one, and size is the total size
+	// of those entries.
+	recent list.List
+	size   int
+}
+
+type diskCacheEntry struct {
+	source int32
+
+	// ready is closed once convos and err are set.
+	ready  chan struct{}
+	convos [][]message
+	err    error
+
+	// elem is the entry's element in recent, or nil while
+	// the entry is loading.
+	elem *list.Element
+}
+
+// Get returns the conversations from a source.
+//
+// Sources are read without holding the cache's lock, so
+// other sources can be used while one is being read.
+// Concurrent requests for the same source share a read.
+func (d *diskCache) Get(source int32) ([][]message, error) {
+	d.lock.Lock()
+	if entry, ok := d.entries[source]; ok {
+		if entry.elem != nil {
+			d.recent.MoveToFront(entry.elem)
+		}
+		d.lock.Unlock()
+		<-entry.ready
+		return entry.convos, entry.err
+	}
+	entry := &diskCacheEntry{source: source, ready: make(chan struct{})}
+	d.entries[source] = entry
+	d.lock.Unlock()
+
+	entry.convos, entry.err = d.read(source)
+
+	d.lock.Lock()
+	if entry.err != nil {
+		delete(d.entries, source)
+	} else {
+		entry.elem = d.recent.PushFront(entry)
+		d.size += d.sizes[source]
+		for d.size > d.maxBytes && d.recent.Len() > 1 {
+			oldest := d.recent.Remove(d.recent.Back()).(*diskCacheEntry)
+			delete(d.entries, oldest.source)
+			d.size -= d.sizes[oldest.source]
+		}
+	}
+	d.lock.Unlock()
+	close(entry.ready)
+
+	return entry.convos, entry.err
+}
+
+func (d *diskCache) read(source int32) ([][]message, error) {
+	var err error
+	for attempt := 0; attempt < DiskReadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		var convos [][]message
+		convos, err = d.opts.readSource(d.sources[source])
+		if err == nil {
+			return applyDedupMask(convos, d.masks[source]), nil
+		}
+	}
+	return nil, fmt.Errorf("load %s: %s", d.sources[source], err)
+}
+
+// convosSize estimates the memory used by decoded
+// conversations.
+func convosSize(convos [][]message) int {
+	const messageOverhead = 128
+	var res int
+	for _, convo := range convos {
+		for _, msg := range convo {
+			res += len(msg.Body) + messageOverhead
+		}
+	}
+	return res
+}
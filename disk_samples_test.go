@@ -0,0 +1,171 @@
+package chatbot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+func TestDiskCacheLRU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const numCached = 4
+	for i := 0; i < numCached+1; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("%d.csv", i)),
+			fmt.Sprintf("human,hi %d\nbot,hello %d\n", i, i))
+	}
+	samples, err := NewDiskSampleSet(dir, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := samples.cache
+	cache.maxBytes = numCached * cache.sizes[0]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := int32(0); source < numCached; source++ {
+				if _, err := cache.Get(source); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Using source 0 again makes source 1 the least
+	// recently used one.
+	cache.Get(0)
+	cache.Get(numCached)
+	if _, ok := cache.entries[1]; ok {
+		t.Error("least recently used source was not evicted")
+	}
+	if _, ok := cache.entries[0]; !ok {
+		t.Error("recently used source was evicted")
+	}
+	if len(cache.entries) != numCached {
+		t.Errorf("expected %d entries but got %d", numCached, len(cache.entries))
+	}
+	if cache.size != cache.maxBytes {
+		t.Errorf("expected size %d but got %d", cache.maxBytes, cache.size)
+	}
+}
+
+func TestDiskSampleSetMatchesSampleSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "a.csv"),
+		"human,hi there,bob,2016-01-01T00:00:00Z\n"+
+			"human,hey,carol,2016-01-01T00:00:30Z\n"+
+			"bot,hello to you both,,2016-01-01T02:00:00Z\n"+
+			"human,this message is long enough to be cut,bob\n"+
+			"bot,ok\n")
+	writeTestFile(t, filepath.Join(dir, "b.json"),
+		`[{"sender":"human","body":"yo"},{"sender":"bot","body":"what's up"}]`)
+	writeTestFile(t, filepath.Join(dir, "c.csv"), "human,hi there,bob\nbot,ok\n")
+
+	newOpts := func() *LoadOptions {
+		return &LoadOptions{
+			Arch:     &Architecture{StateSizes: []int{10}, Speakers: 2, TimeGaps: true},
+			Dedup:    &Deduplicator{Messages: true, MinLength: 1},
+			Snippets: SnippetOptions{TruncateHistory: true, MinContext: 5},
+		}
+	}
+	expected, err := NewSampleSetOptions(dir, 30, newOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := NewDiskSampleSet(dir, 30, newOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.Len() != expected.Len() {
+		t.Fatalf("expected %d samples but got %d", expected.Len(), actual.Len())
+	}
+	for i := 0; i < expected.Len(); i++ {
+		if !reflect.DeepEqual(actual.GetSample(i), expected.GetSample(i)) {
+			t.Errorf("sample %d differs", i)
+		}
+		if actual.SampleLength(i) != expected.SampleLength(i) {
+			t.Errorf("sample %d: expected length %d but got %d", i,
+				expected.SampleLength(i), actual.SampleLength(i))
+		}
+	}
+}
+
+func TestDiskSampleSetReshuffle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("%d.csv", i)),
+			strings.Repeat(fmt.Sprintf("human,hi %d\nbot,hello %d\n", i, i), 5))
+	}
+	samples, err := NewDiskSampleSet(dir, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples.cache.maxBytes = 4 * samples.cache.sizes[0]
+	count := samples.Len()
+	samples.Reshuffle()
+	if samples.Len() != count {
+		t.Fatalf("expected %d samples but got %d", count, samples.Len())
+	}
+
+	// With room for two sources in each group, every
+	// group of 20 samples comes from two sources.
+	for start := 0; start < count; start += 20 {
+		sources := map[int32]bool{}
+		for _, sn := range samples.snippets[start : start+20] {
+			sources[sn.Source] = true
+		}
+		if len(sources) != 2 {
+			t.Errorf("samples %d-%d come from %d sources", start, start+20, len(sources))
+		}
+	}
+}
+
+func TestDiskSampleSetMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.csv")
+	writeTestFile(t, path, "human,hi\nbot,hello\n")
+	writeTestFile(t, filepath.Join(dir, "b.csv"), "human,hey\nbot,howdy\n")
+	samples, err := NewDiskSampleSet(dir, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples.Len() == 0 || samples.snippets[0].Source != 0 {
+		t.Fatal("unexpected samples")
+	}
+	hash := samples.Hash(0)
+	os.Remove(path)
+	sample := samples.GetSample(0).(seqtoseq.Sample)
+	if len(sample.Inputs) == 0 {
+		t.Error("expected a substitute sample")
+	}
+	if !bytes.Equal(samples.Hash(0), hash) {
+		t.Error("hash changed")
+	}
+}
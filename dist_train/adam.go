@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// Adam is an Adam gradient transformer, like sgd.Adam,
+// whose moment estimates can be saved and restored.
+type Adam struct {
+	DecayRate1 float64
+	DecayRate2 float64
+	Damping    float64
+
+	// Params are the parameters whose gradients are
+	// transformed, in the order of the state's moments.
+	Params []*autofunc.Variable
+
+	State AdamState
+}
+
+// AdamState stores the moment estimates of an Adam
+// transformer.
+type AdamState struct {
+	Iteration int64
+	Moment1   []linalg.Vector
+	Moment2   []linalg.Vector
+}
+
+// NewAdam creates an Adam transformer with the default
+// decay rates and damping.
+func NewAdam(params []*autofunc.Variable) *Adam {
+	return &Adam{
+		DecayRate1: 0.9,
+		DecayRate2: 0.999,
+		Damping:    1e-8,
+		Params:     params,
+	}
+}
+
+// Restore sets the state of the transformer, checking
+// that it matches the parameters.
+func (a *Adam) Restore(state AdamState) error {
+	if state.Moment1 == nil {
+		a.State = state
+		return nil
+	}
+	if len(state.Moment1) != len(a.Params) || len(state.Moment2) != len(a.Params) {
+		return errors.New("optimizer state has the wrong number of parameters")
+	}
+	for i, p := range a.Params {
+		if len(state.Moment1[i]) != len(p.Vector) || len(state.Moment2[i]) != len(p.Vector) {
+			return errors.New("optimizer state has the wrong parameter sizes")
+		}
+	}
+	a.State = state
+	return nil
+}
+
+// Transform replaces a gradient with its Adam step
+// direction, in place.
+func (a *Adam) Transform(g autofunc.Gradient) autofunc.Gradient {
+	if a.State.Moment1 == nil {
+		a.State.Moment1 = make([]linalg.Vector, len(a.Params))
+		a.State.Moment2 = make([]linalg.Vector, len(a.Params))
+		for i, p := range a.Params {
+			a.State.Moment1[i] = make(linalg.Vector, len(p.Vector))
+			a.State.Moment2[i] = make(linalg.Vector, len(p.Vector))
+		}
+	}
+	a.State.Iteration++
+	t := float64(a.State.Iteration)
+	correction1 := 1 - math.Pow(a.DecayRate1, t)
+	correction2 := 1 - math.Pow(a.DecayRate2, t)
+	for i, p := range a.Params {
+		grad, ok := g[p]
+		if !ok {
+			continue
+		}
+		m1, m2 := a.State.Moment1[i], a.State.Moment2[i]
+		for j, x := range grad {
+			m1[j] = a.DecayRate1*m1[j] + (1-a.DecayRate1)*x
+			m2[j] = a.DecayRate2*m2[j] + (1-a.DecayRate2)*x*x
+			grad[j] = (m1[j] / correction1) / (math.Sqrt(m2[j]/correction2) + a.Damping)
+		}
+	}
+	return g
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestAdamRestore(t *testing.T) {
+	params := []*autofunc.Variable{
+		{Vector: make(linalg.Vector, 3)},
+		{Vector: make(linalg.Vector, 2)},
+	}
+	gradient := func() autofunc.Gradient {
+		return autofunc.Gradient{
+			params[0]: linalg.Vector{1, -2, 0.5},
+			params[1]: linalg.Vector{0.25, 3},
+		}
+	}
+	adam := NewAdam(params)
+	for i := 0; i < 3; i++ {
+		adam.Transform(gradient())
+	}
+
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	data, err := (&ServerState{Adam: adam.State}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadServerState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewAdam(params)
+	if err := restored.Restore(state.Adam); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.State, adam.State) {
+		t.Fatal("restored state differs from saved state")
+	}
+	expected := adam.Transform(gradient())
+	actual := restored.Transform(gradient())
+	for _, p := range params {
+		if !reflect.DeepEqual(actual[p], expected[p]) {
+			t.Errorf("expected step %v but got %v", expected[p], actual[p])
+		}
+	}
+
+	if err := NewAdam(params).Restore(AdamState{}); err != nil {
+		t.Errorf("empty state should be accepted: %s", err)
+	}
+}
+
+func TestAdamRestoreMismatch(t *testing.T) {
+	params := []*autofunc.Variable{
+		{Vector: make(linalg.Vector, 3)},
+		{Vector: make(linalg.Vector, 2)},
+	}
+	states := map[string]AdamState{
+		"missing parameter": {
+			Moment1: []linalg.Vector{make(linalg.Vector, 3)},
+			Moment2: []linalg.Vector{make(linalg.Vector, 3)},
+		},
+		"wrong size": {
+			Moment1: []linalg.Vector{make(linalg.Vector, 3), make(linalg.Vector, 3)},
+			Moment2: []linalg.Vector{make(linalg.Vector, 3), make(linalg.Vector, 3)},
+		},
+		"wrong second moment": {
+			Moment1: []linalg.Vector{make(linalg.Vector, 3), make(linalg.Vector, 2)},
+			Moment2: []linalg.Vector{make(linalg.Vector, 3)},
+		},
+	}
+	for name, state := range states {
+		adam := NewAdam(params)
+		if adam.Restore(state) == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if adam.State.Moment1 != nil {
+			t.Errorf("%s: state should not change", name)
+		}
+	}
+}
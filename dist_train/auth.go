@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authTimeHeader      = "X-Auth-Time"
+	authSignatureHeader = "X-Auth-Signature"
+	authNonceHeader     = "X-Auth-Nonce"
+	authBodyHashHeader  = "X-Auth-Body-Hash"
+
+	// MaxClockSkew is the maximum difference between the
+	// time in a signed request and the server's clock.
+	MaxClockSkew = 5 * time.Minute
+
+	// MaxRequestBytes is the largest request body which
+	// the server will read.
+	MaxRequestBytes = 1 << 28
+
+	// TokenEnvVar is the environment variable which holds
+	// the shared token if no token file is given.
+	TokenEnvVar = "DIST_TRAIN_TOKEN"
+)
+
+// SecurityOptions stores the authentication and TLS
+// settings shared by the server and its workers.
+type SecurityOptions struct {
+	// TokenFile is the path to a file containing the
+	// shared secret token.
+	// If it is empty, the token is read from TokenEnvVar.
+	TokenFile string
+
+	// CertFile and KeyFile are the server's TLS
+	// certificate and key.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is a PEM file of certificates for clients to
+	// trust, for servers with self-signed certificates.
+	CAFile string
+}
+
+// AddServeFlags adds the server's security flags to a
+// flag set.
+func (s *SecurityOptions) AddServeFlags(f *flag.FlagSet) {
+	s.addTokenFlag(f)
+	f.StringVar(&s.CertFile, "cert", "", "TLS certificate file (enables HTTPS)")
+	f.StringVar(&s.KeyFile, "key", "", "TLS private key file")
+}
+
+// AddTrainFlags adds the workers' security flags to a
+// flag set.
+func (s *SecurityOptions) AddTrainFlags(f *flag.FlagSet) {
+	s.addTokenFlag(f)
+	f.StringVar(&s.CAFile, "ca", "", "PEM file of CA certificates to trust for HTTPS")
+}
+
+func (s *SecurityOptions) addTokenFlag(f *flag.FlagSet) {
+	f.StringVar(&s.TokenFile, "token-file", "",
+		"file containing the shared auth token (default $"+TokenEnvVar+")")
+}
+
+// Token reads the shared token.
+// It returns nil if no token is configured.
+func (s *SecurityOptions) Token() ([]byte, error) {
+	if s.TokenFile == "" {
+		if token := os.Getenv(TokenEnvVar); token != "" {
+			return []byte(token), nil
+		}
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := bytes.TrimSpace(data)
+	if len(token) == 0 {
+		return nil, errors.New("empty token file: " + s.TokenFile)
+	}
+	return token, nil
+}
+
+// Client creates an HTTP client which signs its requests
+// with the token and trusts the configured CA
+// certificates.
+// Requests are tagged with the worker ID, so that the
+// server can tell workers apart.
+func (s *SecurityOptions) Client(workerID string) (*http.Client, error) {
+	token, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + s.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{
+		Transport: &clientTransport{
+			Token:    token,
+			WorkerID: workerID,
+			Base:     transport,
+		},
+	}, nil
+}
+
+// ListenAndServe serves a handler, using TLS if a
+// certificate is configured.
+func (s *SecurityOptions) ListenAndServe(addr string, h http.Handler) error {
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return errors.New("TLS requires both a certificate and a key")
+		}
+		return http.ListenAndServeTLS(addr, s.CertFile, s.KeyFile, h)
+	}
+	return http.ListenAndServe(addr, h)
+}
+
+// clientTransport adds a worker ID to every request and,
+// if there is a token, signs it with an HMAC of the token.
+type clientTransport struct {
+	Token    []byte
+	WorkerID string
+	Base     http.RoundTripper
+}
+
+func (c *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request.
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = http.Header{}
+	for k, v := range r.Header {
+		r2.Header[k] = v
+	}
+	if c.WorkerID != "" {
+		r2.Header.Set(workerIDHeader, c.WorkerID)
+	}
+	if c.Token == nil {
+		return c.Base.RoundTrip(r2)
+	}
+
+	body, err := readBody(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		r2.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r2.Header.Set(authTimeHeader, timestamp)
+	r2.Header.Set(authNonceHeader, hex.EncodeToString(nonce))
+	r2.Header.Set(authBodyHashHeader, bodyHash(body))
+	r2.Header.Set(authSignatureHeader, signature(c.Token, r2))
+	return c.Base.RoundTrip(r2)
+}
+
+// checkAuth verifies the signature on a request and
+// records its nonce, so that it cannot be replayed.
+// On success, the request body is replaced so that it may
+// be read again.
+//
+// The signature covers the headers, including a hash of
+// the body, so unsigned requests are rejected before
+// their bodies are read.
+// The body should still be limited by the caller.
+func checkAuth(token []byte, nonces *nonceSet, r *http.Request) error {
+	secs, err := strconv.ParseInt(r.Header.Get(authTimeHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid auth time")
+	}
+	nonce := r.Header.Get(authNonceHeader)
+	if nonce == "" || r.Header.Get(authSignatureHeader) == "" {
+		return errors.New("missing auth nonce or signature")
+	}
+	expected := signature(token, r)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(authSignatureHeader))) {
+		return errors.New("bad auth signature")
+	}
+	sent := time.Unix(secs, 0)
+	skew := time.Since(sent)
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return errors.New("auth time out of range")
+	}
+	if !nonces.Add(nonce, sent.Add(MaxClockSkew)) {
+		return errors.New("replayed request")
+	}
+	body, err := readBody(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal([]byte(bodyHash(body)), []byte(r.Header.Get(authBodyHashHeader))) {
+		return errors.New("body does not match auth signature")
+	}
+	return nil
+}
+
+// signature computes the hex HMAC-SHA256 of a request's
+// method, path, query, and the headers which affect how
+// it is handled: the worker ID, nonce, timestamp, body
+// hash, content type, and gradient encoding.
+func signature(token []byte, r *http.Request) string {
+	mac := hmac.New(sha256.New, token)
+	mac.Write([]byte(strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		r.Header.Get(workerIDHeader),
+		r.Header.Get(authNonceHeader),
+		r.Header.Get(authTimeHeader),
+		r.Header.Get(authBodyHashHeader),
+		r.Header.Get("Content-Type"),
+		r.Header.Get(gradientEncodingHeader),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyHash computes the hex SHA-256 hash of a body.
+func bodyHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// nonceSet remembers request nonces until the requests
+// which carried them are too old to be accepted.
+// The zero value is an empty set.
+type nonceSet struct {
+	lock      sync.Mutex
+	expires   map[string]time.Time
+	lastPrune time.Time
+}
+
+// Add records a nonce which is needed until the given
+// time.
+// It returns false if the nonce was already recorded.
+func (n *nonceSet) Add(nonce string, expires time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := time.Now()
+	if n.expires == nil {
+		n.expires = map[string]time.Time{}
+	}
+	if now.Sub(n.lastPrune) > time.Minute {
+		for k, t := range n.expires {
+			if now.After(t) {
+				delete(n.expires, k)
+			}
+		}
+		n.lastPrune = now
+	}
+	if _, ok := n.expires[nonce]; ok {
+		return false
+	}
+	n.expires[nonce] = expires
+	return true
+}
+
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAuth(t *testing.T) {
+	token := []byte("secret")
+	var nonces nonceSet
+	var signed []*http.Request
+	transport := &clientTransport{
+		Token:    token,
+		WorkerID: "worker",
+		Base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			signed = append(signed, r)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/upload?x=1", strings.NewReader("body"))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(gradientEncodingHeader, "float16")
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(r *http.Request) error {
+		return checkAuth(token, &nonces, r)
+	}
+	if err := check(signed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(signed[0].Body); string(data) != "body" {
+		t.Errorf("unexpected body after check: %q", data)
+	}
+	if err := check(resetBody(signed[0], "body")); err == nil {
+		t.Error("replayed request was accepted")
+	}
+
+	r := signed[1]
+	for _, tamper := range []func(r *http.Request){
+		func(r *http.Request) { r.Header.Set(workerIDHeader, "other") },
+		func(r *http.Request) { r.URL.RawQuery = "x=2" },
+		func(r *http.Request) { r.Header.Del(authNonceHeader) },
+		func(r *http.Request) { r.Header.Set(authTimeHeader, "0") },
+		func(r *http.Request) { r.Header.Set(gradientEncodingHeader, "dense") },
+		func(r *http.Request) { r.Header.Del(gradientEncodingHeader) },
+		func(r *http.Request) { r.Header.Set("Content-Type", "application/json") },
+	} {
+		r2 := resetBody(r.Clone(r.Context()), "body")
+		tamper(r2)
+		if err := check(r2); err == nil {
+			t.Error("tampered request was accepted")
+		}
+	}
+	if err := check(resetBody(r, "body")); err != nil {
+		t.Error(err)
+	}
+
+	// The headers are checked before the body, so a bad
+	// body uses up the request's nonce.
+	if err := check(resetBody(signed[2], "other")); err == nil {
+		t.Error("request with a tampered body was accepted")
+	}
+	if err := check(resetBody(signed[2], "body")); err == nil {
+		t.Error("replayed request was accepted")
+	}
+
+	unsigned := httptest.NewRequest("POST", "/upload", &failingReader{})
+	unsigned.Header = signed[2].Header.Clone()
+	unsigned.Header.Set(authNonceHeader, "fresh")
+	if err := check(unsigned); err == nil || err.Error() != "bad auth signature" {
+		t.Errorf("expected a signature error but got %v", err)
+	}
+}
+
+// failingReader panics if it is read.
+type failingReader struct{}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	panic("body was read")
+}
+
+func TestNonceSet(t *testing.T) {
+	var n nonceSet
+	if !n.Add("a", time.Now().Add(-time.Second)) {
+		t.Fatal("new nonce rejected")
+	}
+	if n.Add("a", time.Now()) {
+		t.Fatal("duplicate nonce accepted")
+	}
+	n.lastPrune = time.Time{}
+	if !n.Add("b", time.Now().Add(time.Minute)) || !n.Add("a", time.Now()) {
+		t.Fatal("expired nonce was not pruned")
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (r roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
+
+func resetBody(r *http.Request, body string) *http.Request {
+	r.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	return r
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A CheckpointFile is one of the files in a checkpoint.
+type CheckpointFile struct {
+	Path string
+	Data []byte
+}
+
+// A Checkpointer saves snapshots of a network in the
+// background, at most once every SaveUpdates updates or
+// SaveInterval, whichever comes first.
+type Checkpointer struct {
+	// Snapshot encodes the files of a checkpoint.
+	// It is responsible for any locking needed to get a
+	// consistent snapshot.
+	// The files are written in order, so a file which
+	// refers to the others should come last.
+	Snapshot func() ([]CheckpointFile, error)
+
+	// SaveUpdates is the number of updates after which a
+	// checkpoint is saved, or 0 for no limit.
+	SaveUpdates int
+
+	// SaveInterval is the time after which pending updates
+	// are saved, or 0 for no limit.
+	SaveInterval time.Duration
+
+	saveLock sync.Mutex
+
+	lock     sync.Mutex
+	pending  int
+	lastSave time.Time
+	lastErr  error
+	notify   chan struct{}
+	closed   chan struct{}
+	done     chan struct{}
+}
+
+// NewCheckpointer creates a Checkpointer and starts its
+// background goroutine.
+func NewCheckpointer(saveUpdates int, saveInterval time.Duration,
+	snapshot func() ([]CheckpointFile, error)) *Checkpointer {
+	c := &Checkpointer{
+		Snapshot:     snapshot,
+		SaveUpdates:  saveUpdates,
+		SaveInterval: saveInterval,
+		lastSave:     time.Now(),
+		notify:       make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// Updated records an update to the network.
+// It never blocks on a save.
+func (c *Checkpointer) Updated() {
+	c.lock.Lock()
+	c.pending++
+	c.lock.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Checkpoint saves a snapshot immediately.
+func (c *Checkpointer) Checkpoint() error {
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	c.lock.Lock()
+	pending := c.pending
+	c.lock.Unlock()
+
+	files, err := c.Snapshot()
+	for _, f := range files {
+		if err != nil {
+			break
+		}
+		err = writeFileAtomic(f.Path, f.Data)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastErr = err
+	if err == nil {
+		c.pending -= pending
+		c.lastSave = time.Now()
+	}
+	return err
+}
+
+// Close stops the background goroutine and saves any
+// pending updates.
+// It may only be called once.
+func (c *Checkpointer) Close() error {
+	close(c.closed)
+	<-c.done
+	c.lock.Lock()
+	pending := c.pending
+	c.lock.Unlock()
+	if pending == 0 {
+		return nil
+	}
+	return c.Checkpoint()
+}
+
+// LastSave returns the time of the latest successful
+// save, or the time when c was created if there has not
+// been one.
+func (c *Checkpointer) LastSave() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastSave
+}
+
+// LastError returns the error from the latest save, or
+// nil if it succeeded.
+func (c *Checkpointer) LastError() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastErr
+}
+
+func (c *Checkpointer) loop() {
+	defer close(c.done)
+	var tick <-chan time.Time
+	if c.SaveInterval > 0 {
+		ticker := time.NewTicker(c.SaveInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-c.notify:
+		case <-tick:
+		case <-c.closed:
+			return
+		}
+		if !c.shouldSave() {
+			continue
+		}
+		if err := c.Checkpoint(); err != nil {
+			log.Println("Failed to save checkpoint:", err)
+		}
+	}
+}
+
+func (c *Checkpointer) shouldSave() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending == 0 {
+		return false
+	}
+	if c.SaveUpdates == 0 && c.SaveInterval == 0 {
+		return true
+	}
+	return (c.SaveUpdates > 0 && c.pending >= c.SaveUpdates) ||
+		(c.SaveInterval > 0 && time.Since(c.lastSave) >= c.SaveInterval)
+}
+
+// writeFileAtomic writes a file by writing a temporary
+// file in the same directory and renaming it, so that
+// readers never see a partial file.
+func writeFileAtomic(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0755); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
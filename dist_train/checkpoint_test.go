@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "net")
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != data {
+			t.Errorf("expected %q but got %q", data, actual)
+		}
+	}
+	listing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing) != 1 {
+		t.Errorf("expected only the file, but got %d entries", len(listing))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "net"), nil); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestCheckpointerShouldSave(t *testing.T) {
+	tests := []struct {
+		saveUpdates  int
+		saveInterval time.Duration
+		pending      int
+		sinceSave    time.Duration
+		expected     bool
+	}{
+		{0, 0, 0, 0, false},
+		{0, 0, 1, 0, true},
+		{10, 0, 9, time.Hour, false},
+		{10, 0, 10, 0, true},
+		{0, time.Minute, 1, time.Second, false},
+		{0, time.Minute, 1, 2 * time.Minute, true},
+		{0, time.Minute, 0, 2 * time.Minute, false},
+		{10, time.Minute, 3, 2 * time.Minute, true},
+		{10, time.Minute, 10, time.Second, true},
+		{10, time.Minute, 3, time.Second, false},
+	}
+	for i, test := range tests {
+		c := &Checkpointer{
+			SaveUpdates:  test.saveUpdates,
+			SaveInterval: test.saveInterval,
+			pending:      test.pending,
+			lastSave:     time.Now().Add(-test.sinceSave),
+		}
+		if actual := c.shouldSave(); actual != test.expected {
+			t.Errorf("test %d: expected %v but got %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckpointerBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "net")
+	c := NewCheckpointer(2, 0, func() ([]CheckpointFile, error) {
+		return []CheckpointFile{{Path: path, Data: []byte("net")}}, nil
+	})
+	defer c.Close()
+	c.Updated()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("saved before enough updates")
+	}
+	c.Updated()
+	for i := 0; i < 100; i++ {
+		if data, _ := ioutil.ReadFile(path); bytes.Equal(data, []byte("net")) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("checkpoint was not saved")
+}
+
+func TestCheckpointerClose(t *testing.T) {
+	var saves int
+	c := NewCheckpointer(100, 0, func() ([]CheckpointFile, error) {
+		saves++
+		return nil, nil
+	})
+	c.Updated()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if saves != 1 {
+		t.Errorf("expected 1 save on close but got %d", saves)
+	}
+}
+
+// BenchmarkUpdateSyncSave measures update throughput when
+// every tenth update saves a checkpoint before returning.
+func BenchmarkUpdateSyncSave(b *testing.B) {
+	snapshot, cleanup := benchmarkSnapshot(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if (i+1)%10 == 0 {
+			files, _ := snapshot()
+			for _, f := range files {
+				if err := writeFileAtomic(f.Path, f.Data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkUpdateCheckpointer measures update throughput
+// when a Checkpointer saves every tenth update in the
+// background.
+func BenchmarkUpdateCheckpointer(b *testing.B) {
+	snapshot, cleanup := benchmarkSnapshot(b)
+	defer cleanup()
+	c := NewCheckpointer(10, 0, snapshot)
+	defer c.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Updated()
+	}
+}
+
+func benchmarkSnapshot(b *testing.B) (func() ([]CheckpointFile, error), func()) {
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 1<<22)
+	return func() ([]CheckpointFile, error) {
+		return []CheckpointFile{
+			{Path: filepath.Join(dir, "net"), Data: data},
+		}, nil
+	}, func() { os.RemoveAll(dir) }
+}
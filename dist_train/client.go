@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+)
+
+// A ServerClient sends a worker's requests to a parameter
+// server.
+type ServerClient struct {
+	URL *url.URL
+
+	// Client makes the requests, typically signing them
+	// with a transport from SecurityOptions.Client.
+	Client *http.Client
+
+	// WorkerID identifies the worker to the server.
+	WorkerID string
+}
+
+// NewServerClient creates a ServerClient for a server URL.
+func NewServerClient(paramServer string, client *http.Client,
+	workerID string) (*ServerClient, error) {
+	u, err := url.Parse(paramServer)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerClient{URL: u, Client: client, WorkerID: workerID}, nil
+}
+
+// Get sends a GET request for a path on the server.
+func (s *ServerClient) Get(path string) (*http.Response, error) {
+	return s.Client.Get(s.resolve(path))
+}
+
+// Post sends a POST request to a path on the server.
+func (s *ServerClient) Post(path, contentType string, body []byte,
+	header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("POST", s.resolve(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	return s.Client.Do(req)
+}
+
+func (s *ServerClient) resolve(path string) string {
+	return s.URL.ResolveReference(&url.URL{Path: path}).String()
+}
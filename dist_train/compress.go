@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// Gradient encodings for compressed uploads.
+const (
+	EncodingDense   = "dense"
+	EncodingFloat16 = "float16"
+	EncodingInt8    = "int8"
+	EncodingTopK    = "topk"
+)
+
+// SupportedEncodings lists the gradient encodings which
+// the server accepts.
+var SupportedEncodings = []string{EncodingDense, EncodingFloat16, EncodingInt8, EncodingTopK}
+
+const gradientEncodingHeader = "X-Gradient-Encoding"
+
+// CompressOptions configures compressed gradient uploads
+// from a worker.
+type CompressOptions struct {
+	// Encoding is the gradient encoding, or "" for the
+	// dense encoding.
+	Encoding string
+
+	// TopK is the fraction of entries sent by the topk
+	// encoding.
+	TopK float64
+}
+
+// AddFlags adds flags for the options to a flag set.
+func (c *CompressOptions) AddFlags(f *flag.FlagSet) {
+	f.StringVar(&c.Encoding, "compress", EncodingDense,
+		"gradient encoding (dense, float16, int8, or topk)")
+	f.Float64Var(&c.TopK, "topk", 0.01, "fraction of gradient entries sent by -compress topk")
+}
+
+// A GradientCompressor encodes gradients for upload.
+//
+// Gradients are encoded as a list of parameter vectors in
+// the order of Params, which must match the order of the
+// server's parameters.
+type GradientCompressor struct {
+	Encoding string
+	Params   []*autofunc.Variable
+
+	// TopK is the fraction of entries which the topk
+	// encoding sends.
+	// The entries which are not sent are kept and added to
+	// the next gradient (error feedback).
+	TopK float64
+
+	residuals []linalg.Vector
+}
+
+// Encode encodes a gradient.
+func (c *GradientCompressor) Encode(g autofunc.Gradient) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, p := range c.Params {
+		vec := g[p]
+		if vec == nil {
+			vec = make(linalg.Vector, len(p.Vector))
+		}
+		switch c.Encoding {
+		case EncodingDense:
+			binary.Write(&buf, binary.LittleEndian, []float64(vec))
+		case EncodingFloat16:
+			halves := make([]uint16, len(vec))
+			for j, x := range vec {
+				halves[j] = float16Bits(float32(x))
+			}
+			binary.Write(&buf, binary.LittleEndian, halves)
+		case EncodingInt8:
+			encodeInt8(&buf, vec)
+		case EncodingTopK:
+			c.encodeTopK(&buf, i, vec)
+		default:
+			return nil, fmt.Errorf("unknown gradient encoding: %s", c.Encoding)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeInt8(buf *bytes.Buffer, vec linalg.Vector) {
+	var scale float64
+	for _, x := range vec {
+		scale = math.Max(scale, math.Abs(x))
+	}
+	binary.Write(buf, binary.LittleEndian, float32(scale))
+	for _, x := range vec {
+		var q int8
+		if scale != 0 {
+			q = int8(math.Floor(x/scale*127 + 0.5))
+		}
+		buf.WriteByte(byte(q))
+	}
+}
+
+func (c *GradientCompressor) encodeTopK(buf *bytes.Buffer, paramIdx int, vec linalg.Vector) {
+	if c.residuals == nil {
+		c.residuals = make([]linalg.Vector, len(c.Params))
+	}
+	if c.residuals[paramIdx] == nil {
+		c.residuals[paramIdx] = make(linalg.Vector, len(vec))
+	}
+	residual := c.residuals[paramIdx]
+	for i, x := range vec {
+		residual[i] += x
+	}
+
+	k := int(math.Ceil(c.TopK * float64(len(residual))))
+	if k > len(residual) {
+		k = len(residual)
+	}
+	indices := make([]int, len(residual))
+	for i := range indices {
+		indices[i] = i
+	}
+	selectLargest(indices, k, residual)
+	indices = indices[:k]
+	sort.Ints(indices)
+
+	binary.Write(buf, binary.LittleEndian, uint32(k))
+	for _, idx := range indices {
+		binary.Write(buf, binary.LittleEndian, uint32(idx))
+		binary.Write(buf, binary.LittleEndian, float32(residual[idx]))
+		residual[idx] = 0
+	}
+}
+
+// selectLargest reorders indices so that the first k
+// index the entries of vec with the largest magnitudes,
+// in no particular order.
+// Ties go to the lower index.
+// It takes linear time on average.
+func selectLargest(indices []int, k int, vec linalg.Vector) {
+	// Breaking ties keeps equal entries (e.g. zeros) from
+	// making partitions lopsided.
+	less := func(i, j int) bool {
+		x, y := math.Abs(vec[indices[i]]), math.Abs(vec[indices[j]])
+		return x > y || (x == y && indices[i] < indices[j])
+	}
+	start, end := 0, len(indices)
+	for end-start > 1 && k > start && k < end {
+		// Partition around the median of three entries.
+		mid := start + (end-start)/2
+		if less(mid, start) {
+			indices[mid], indices[start] = indices[start], indices[mid]
+		}
+		if less(end-1, start) {
+			indices[end-1], indices[start] = indices[start], indices[end-1]
+		}
+		if less(end-1, mid) {
+			indices[end-1], indices[mid] = indices[mid], indices[end-1]
+		}
+		indices[mid], indices[end-1] = indices[end-1], indices[mid]
+		pivot := end - 1
+		store := start
+		for i := start; i < pivot; i++ {
+			if less(i, pivot) {
+				indices[i], indices[store] = indices[store], indices[i]
+				store++
+			}
+		}
+		indices[store], indices[pivot] = indices[pivot], indices[store]
+
+		if store < k {
+			start = store + 1
+		} else {
+			end = store
+		}
+	}
+}
+
+// writeParams writes the parameters as dense vectors.
+func writeParams(w io.Writer, params []*autofunc.Variable) error {
+	for _, p := range params {
+		if err := binary.Write(w, binary.LittleEndian, []float64(p.Vector)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readParams reads parameters written by writeParams.
+func readParams(r io.Reader, params []*autofunc.Variable) error {
+	for _, p := range params {
+		if err := binary.Read(r, binary.LittleEndian, []float64(p.Vector)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEncoding makes sure the server accepts a gradient
+// encoding.
+func checkEncoding(server *ServerClient, encoding string) error {
+	resp, err := server.Get("/encodings")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("list encodings: " + resp.Status)
+	}
+	var encodings []string
+	if err := json.NewDecoder(resp.Body).Decode(&encodings); err != nil {
+		return err
+	}
+	for _, e := range encodings {
+		if e == encoding {
+			return nil
+		}
+	}
+	return fmt.Errorf("server does not support encoding: %s", encoding)
+}
+
+// fetchParams downloads the server's parameters.
+func fetchParams(server *ServerClient, params []*autofunc.Variable) error {
+	resp, err := server.Get("/params")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return readParams(resp.Body, params)
+}
+
+// uploadGradient sends an encoded gradient to the server.
+func uploadGradient(server *ServerClient, encoding string, data []byte) error {
+	resp, err := server.Post("/upload", "application/octet-stream", data,
+		http.Header{gradientEncodingHeader: {encoding}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// decodeGradient decodes a gradient for the parameters.
+// It fails if any entry is NaN or infinite.
+func decodeGradient(encoding string, data []byte,
+	params []*autofunc.Variable) (autofunc.Gradient, error) {
+	r := bytes.NewReader(data)
+	res := autofunc.Gradient{}
+	for _, p := range params {
+		vec := make(linalg.Vector, len(p.Vector))
+		var err error
+		switch encoding {
+		case EncodingDense:
+			err = binary.Read(r, binary.LittleEndian, []float64(vec))
+		case EncodingFloat16:
+			halves := make([]uint16, len(vec))
+			err = binary.Read(r, binary.LittleEndian, halves)
+			for i, h := range halves {
+				vec[i] = float64(float16Value(h))
+			}
+		case EncodingInt8:
+			err = decodeInt8(r, vec)
+		case EncodingTopK:
+			err = decodeTopK(r, vec)
+		default:
+			return nil, fmt.Errorf("unknown gradient encoding: %s", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range vec {
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				return nil, errors.New("gradient has non-finite entries")
+			}
+		}
+		res[p] = vec
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("gradient has trailing data")
+	}
+	return res, nil
+}
+
+func decodeInt8(r *bytes.Reader, vec linalg.Vector) error {
+	var scale float32
+	if err := binary.Read(r, binary.LittleEndian, &scale); err != nil {
+		return err
+	}
+	if math.IsNaN(float64(scale)) || math.IsInf(float64(scale), 0) {
+		return errors.New("gradient scale is not finite")
+	}
+	quantized := make([]int8, len(vec))
+	if err := binary.Read(r, binary.LittleEndian, quantized); err != nil {
+		return err
+	}
+	for i, q := range quantized {
+		vec[i] = float64(q) / 127 * float64(scale)
+	}
+	return nil
+}
+
+func decodeTopK(r *bytes.Reader, vec linalg.Vector) error {
+	var k uint32
+	if err := binary.Read(r, binary.LittleEndian, &k); err != nil {
+		return err
+	}
+	if int(k) > len(vec) {
+		return errors.New("too many gradient entries")
+	}
+	for i := 0; i < int(k); i++ {
+		var entry struct {
+			Index uint32
+			Value float32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &entry); err != nil {
+			return err
+		}
+		if int(entry.Index) >= len(vec) {
+			return errors.New("gradient index out of range")
+		}
+		vec[entry.Index] = float64(entry.Value)
+	}
+	return nil
+}
+
+// float16Bits converts a float32 to the bits of the
+// nearest IEEE half-precision float.
+// Finite values beyond the half-precision range are
+// clamped to the largest finite half, so that large
+// gradients are not turned into infinities.
+func float16Bits(f float32) uint16 {
+	const maxHalf = 0x7bff
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+	switch {
+	case bits&0x7fffffff == 0:
+		return sign
+	case exp >= 0x1f:
+		if bits>>23&0xff == 0xff {
+			if mant != 0 {
+				return sign | 0x7e00
+			}
+			return sign | 0x7c00
+		}
+		return sign | maxHalf
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := uint16(mant >> shift)
+		if mant>>(shift-1)&1 != 0 {
+			half++
+		}
+		return sign | half
+	}
+	half := sign | uint16(exp)<<10 | uint16(mant>>13)
+	if mant&0x1000 != 0 {
+		// Rounding may carry into the exponent, which still
+		// gives the right result unless it overflows.
+		half++
+		if half&0x7fff == 0x7c00 {
+			half = sign | maxHalf
+		}
+	}
+	return half
+}
+
+// float16Value converts the bits of a half-precision
+// float to a float32.
+func float16Value(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
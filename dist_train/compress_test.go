@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/chatbot"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+func TestSelectLargest(t *testing.T) {
+	for trial := 0; trial < 100; trial++ {
+		vec := make(linalg.Vector, rand.Intn(50)+1)
+		for i := range vec {
+			// Use few distinct values to exercise ties.
+			vec[i] = float64(rand.Intn(7) - 3)
+		}
+		k := rand.Intn(len(vec) + 1)
+
+		expected := make([]int, len(vec))
+		for i := range expected {
+			expected[i] = i
+		}
+		sort.SliceStable(expected, func(i, j int) bool {
+			return math.Abs(vec[expected[i]]) > math.Abs(vec[expected[j]])
+		})
+		expected = expected[:k]
+		sort.Ints(expected)
+
+		actual := make([]int, len(vec))
+		for i := range actual {
+			actual[i] = i
+		}
+		selectLargest(actual, k, vec)
+		actual = actual[:k]
+		sort.Ints(actual)
+
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Fatalf("vec %v, k=%d: expected %v but got %v", vec, k, expected, actual)
+			}
+		}
+	}
+}
+
+func TestGradientCompressorRoundTrip(t *testing.T) {
+	params := []*autofunc.Variable{
+		{Vector: make(linalg.Vector, 10)},
+		{Vector: make(linalg.Vector, 3)},
+	}
+	grad := autofunc.Gradient{
+		params[0]: linalg.Vector{1, -2, 3, -4, 5, -6, 7, -8, 9, -10},
+		params[1]: linalg.Vector{0.5, -0.25, 0},
+	}
+	for _, encoding := range SupportedEncodings {
+		c := &GradientCompressor{Encoding: encoding, Params: params, TopK: 0.5}
+		data, err := c.Encode(grad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeGradient(encoding, data, params)
+		if err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		for _, p := range params {
+			for i, x := range grad[p] {
+				y := decoded[p][i]
+				if encoding == EncodingTopK && y == 0 {
+					continue
+				}
+				if math.Abs(x-y) > 0.1*math.Abs(x)+1e-3 {
+					t.Errorf("%s: expected %f but got %f", encoding, x, y)
+				}
+			}
+		}
+		if encoding == EncodingTopK {
+			if decoded[params[0]][9] != -10 || decoded[params[0]][0] != 0 {
+				t.Errorf("topk kept the wrong entries: %v", decoded[params[0]])
+			}
+		}
+	}
+}
+
+func TestDecodeGradientNonFinite(t *testing.T) {
+	params := []*autofunc.Variable{{Vector: make(linalg.Vector, 2)}}
+	float32Bits := func(f float32) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, f)
+		return buf.Bytes()
+	}
+	float64Bits := func(f float64) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, f)
+		return buf.Bytes()
+	}
+	topK := func(value float32) []byte {
+		data := []byte{1, 0, 0, 0, 1, 0, 0, 0}
+		return append(data, float32Bits(value)...)
+	}
+	for i, test := range []struct {
+		Encoding string
+		Data     []byte
+	}{
+		{EncodingDense, append(float64Bits(1), float64Bits(math.NaN())...)},
+		{EncodingDense, append(float64Bits(math.Inf(-1)), float64Bits(1)...)},
+		{EncodingFloat16, []byte{0, 0, 0, 0x7c}},
+		{EncodingFloat16, []byte{0, 0x7e, 0, 0}},
+		{EncodingInt8, append(float32Bits(float32(math.NaN())), 0, 0)},
+		{EncodingInt8, append(float32Bits(float32(math.Inf(1))), 0, 0)},
+		{EncodingTopK, topK(float32(math.Inf(1)))},
+		{EncodingTopK, topK(float32(math.NaN()))},
+	} {
+		if _, err := decodeGradient(test.Encoding, test.Data, params); err == nil {
+			t.Errorf("test %d: %s gradient was not rejected", i, test.Encoding)
+		}
+	}
+}
+
+func BenchmarkEncodeTopK(b *testing.B) {
+	params := []*autofunc.Variable{{Vector: make(linalg.Vector, 1<<20)}}
+	grad := autofunc.Gradient{params[0]: randomVector(len(params[0].Vector))}
+	c := &GradientCompressor{Encoding: EncodingTopK, Params: params, TopK: 0.01}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Encode(grad)
+	}
+}
+
+func TestFloat16Clamp(t *testing.T) {
+	tests := []struct {
+		value    float32
+		expected uint16
+	}{
+		{65504, 0x7bff},
+		{65520, 0x7bff},
+		{1e6, 0x7bff},
+		{-1e30, 0xfbff},
+		{float32(math.Inf(1)), 0x7c00},
+	}
+	for _, test := range tests {
+		if actual := float16Bits(test.value); actual != test.expected {
+			t.Errorf("%g: expected %#x but got %#x", test.value, test.expected, actual)
+		}
+	}
+
+	params := []*autofunc.Variable{{Vector: make(linalg.Vector, 2)}}
+	c := &GradientCompressor{Encoding: EncodingFloat16, Params: params}
+	data, err := c.Encode(autofunc.Gradient{params[0]: linalg.Vector{1e6, -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeGradient(EncodingFloat16, data, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vec := decoded[params[0]]; vec[0] != 65504 || vec[1] != -1 {
+		t.Errorf("unexpected gradient: %v", vec)
+	}
+}
+
+// BenchmarkCompressedDescent measures the bytes per update
+// for each encoding, and the cost of a tiny bot after a
+// fixed number of gradient descent steps on a toy corpus
+// with compressed gradients.
+func BenchmarkCompressedDescent(b *testing.B) {
+	const (
+		steps    = 50
+		stepSize = 0.001
+	)
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corpus := writeTestCorpus(b, dir)
+	arch := &chatbot.Architecture{StateSizes: []int{32}}
+	samples, err := chatbot.NewSampleSetOptions(corpus, MaxBufferChars,
+		&chatbot.LoadOptions{Arch: arch})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, encoding := range SupportedEncodings {
+		b.Run(encoding, func(b *testing.B) {
+			var bytes, cost float64
+			for i := 0; i < b.N; i++ {
+				// Every encoding starts from the same network.
+				rand.Seed(1)
+				bot := chatbot.NewBotArchitecture(arch)
+				bot.Dropout(false)
+				params := bot.Block.(sgd.Learner).Parameters()
+				grad := &seqtoseq.Gradienter{
+					SeqFunc:  &rnn.BlockSeqFunc{B: bot.Block},
+					Learner:  bot.Block.(sgd.Learner),
+					CostFunc: neuralnet.DotCost{},
+				}
+				c := &GradientCompressor{Encoding: encoding, Params: params, TopK: 0.05}
+				bytes = 0
+				for step := 0; step < steps; step++ {
+					start := (step * BatchSize) % (samples.Len() - BatchSize + 1)
+					batch := samples.Subset(start, start+BatchSize)
+					data, err := c.Encode(grad.Gradient(batch))
+					if err != nil {
+						b.Fatal(err)
+					}
+					bytes += float64(len(data))
+					decoded, err := decodeGradient(encoding, data, params)
+					if err != nil {
+						b.Fatal(err)
+					}
+					decoded.AddToVars(-stepSize)
+				}
+				cost = seqtoseq.TotalCostBlock(bot.Block, BatchSize, samples,
+					neuralnet.DotCost{}) / float64(samples.Len())
+			}
+			b.ReportMetric(bytes/steps, "bytes/update")
+			b.ReportMetric(cost, "cost/sample")
+		})
+	}
+}
+
+func randomVector(size int) linalg.Vector {
+	res := make(linalg.Vector, size)
+	for i := range res {
+		res[i] = rand.NormFloat64()
+	}
+	return res
+}
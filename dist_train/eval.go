@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/chatbot"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+const paramVersionHeader = "X-Param-Version"
+
+// An EvalReport is sent by an eval worker after it
+// scores a version of the parameters.
+type EvalReport struct {
+	Version    int64
+	Time       time.Time
+	Validation float64
+
+	// Replies maps prompts to the bot's replies.
+	Replies map[string]string
+
+	// Net is the encoded bot which was evaluated.
+	// It is only sent when the bot beats the best
+	// validation cost so far.
+	Net []byte `json:",omitempty"`
+}
+
+// An EvalStatus summarizes the reports from eval
+// workers.
+type EvalStatus struct {
+	Latest      *EvalReport `json:",omitempty"`
+	HasBest     bool
+	Best        float64
+	BestVersion int64
+}
+
+// An EvalTracker keeps the latest eval report and saves
+// the best bot it has been sent.
+type EvalTracker struct {
+	BestFile string
+
+	lock   sync.Mutex
+	status EvalStatus
+}
+
+// Report records an eval report, saving its bot if it is
+// the best so far.
+// It returns the updated status.
+func (e *EvalTracker) Report(r *EvalReport) (EvalStatus, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	latest := *r
+	latest.Net = nil
+	e.status.Latest = &latest
+	if r.Net != nil && (!e.status.HasBest || r.Validation < e.status.Best) {
+		if err := writeFileAtomic(e.BestFile, r.Net); err != nil {
+			return e.status, err
+		}
+		log.Printf("New best validation cost %f at version %d", r.Validation, r.Version)
+		e.status.HasBest = true
+		e.status.Best = r.Validation
+		e.status.BestVersion = r.Version
+	}
+	return e.status, nil
+}
+
+// Restore sets the status, for resuming training.
+func (e *EvalTracker) Restore(status EvalStatus) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.status = status
+}
+
+// Status returns the current status.
+func (e *EvalTracker) Status() EvalStatus {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.status
+}
+
+// Eval runs an eval worker, which scores the server's
+// parameters on the full validation set every interval,
+// until stop is closed.
+func Eval(server *ServerClient, stop <-chan struct{}, sampleFiles []string,
+	loadOpts *chatbot.LoadOptions, temperature float64, interval time.Duration,
+	prompts []string) error {
+	arch, err := fetchArchitecture(server)
+	if err != nil {
+		return fmt.Errorf("fetch architecture: %s", err)
+	}
+
+	log.Println("Loading samples...")
+	loadOpts.Arch = arch
+	samples, err := chatbot.LoadWeightedSamples(sampleFiles, MaxBufferChars, loadOpts,
+		temperature)
+	if err != nil {
+		return err
+	}
+	defer chatbot.CloseSamples(samples)
+	_, validation := chatbot.HashSplit(samples, 0.9)
+	if validation.Len() == 0 {
+		return errors.New("no validation samples")
+	}
+	log.Println("Evaluating on", validation.Len(), "samples...")
+
+	var status EvalStatus
+	for {
+		report, err := evaluate(server, validation, prompts, status)
+		if err == nil {
+			log.Printf("version %d: validation=%f", report.Version, report.Validation)
+			err = postJSON(server, "/eval", report, &status)
+		}
+		if err != nil {
+			log.Println("Evaluation failed:", err)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// evaluate fetches the current bot from the server and
+// scores it.
+func evaluate(server *ServerClient, validation sgd.SampleSet, prompts []string,
+	status EvalStatus) (*EvalReport, error) {
+	data, version, err := fetchNet(server)
+	if err != nil {
+		return nil, err
+	}
+	bot, err := chatbot.DecodeBot(data)
+	if err != nil {
+		return nil, err
+	}
+	bot.Dropout(false)
+	cost := seqtoseq.TotalCostBlock(bot.Block, BatchSize, validation, neuralnet.DotCost{})
+	report := &EvalReport{
+		Version:    version,
+		Time:       time.Now(),
+		Validation: cost / float64(validation.Len()),
+		Replies:    map[string]string{},
+	}
+	for _, prompt := range prompts {
+		chat := chatbot.NewChat(bot, "")
+		chat.Send(0, prompt)
+		report.Replies[prompt], _ = chat.Receive()
+	}
+	if !status.HasBest || report.Validation < status.Best {
+		report.Net = data
+	}
+	return report, nil
+}
+
+// fetchNet downloads the encoded bot and its parameter
+// version from the server.
+func fetchNet(server *ServerClient) ([]byte, int64, error) {
+	resp, err := server.Get("/net")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.New(resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, _ := strconv.ParseInt(resp.Header.Get(paramVersionHeader), 10, 64)
+	return data, version, nil
+}
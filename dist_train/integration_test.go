@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/chatbot"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+// TestDistributedTraining trains a tiny bot with several
+// workers against an in-process parameter server.
+func TestDistributedTraining(t *testing.T) {
+	if testing.Short() {
+		t.Skip("trains a network")
+	}
+	const (
+		numWorkers = 3
+		numUpdates = 300
+	)
+
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	corpus := writeTestCorpus(t, dir)
+	arch := &chatbot.Architecture{StateSizes: []int{32}}
+	archData, _ := json.Marshal(arch)
+	archFile := filepath.Join(dir, "arch.json")
+	tokenFile := filepath.Join(dir, "token")
+	for path, data := range map[string][]byte{archFile: archData, tokenFile: []byte("secret")} {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	netFile := filepath.Join(dir, "net")
+	security := SecurityOptions{TokenFile: tokenFile}
+	s, err := NewServer(netFile, &ServeOptions{
+		Security:    security,
+		SaveUpdates: 50,
+		NumShards:   4,
+		ArchFile:    archFile,
+		Schedule:    Schedule{State: ScheduleState{BaseRate: 0.01}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	samples, err := chatbot.NewSampleSetOptions(corpus, MaxBufferChars,
+		&chatbot.LoadOptions{Arch: arch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initialCost := testNetCost(t, netFile, samples)
+
+	stop := make(chan struct{})
+	errs := make(chan error, numWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workerID := fmt.Sprintf("worker%d", i)
+		client, err := security.Client(workerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		worker, err := NewServerClient(server.URL, client, workerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compression := &CompressOptions{}
+		if i == 0 {
+			compression.Encoding = EncodingTopK
+			compression.TopK = 0.1
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Train(worker, stop, []string{corpus}, &chatbot.LoadOptions{}, compression, 1)
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Minute)
+	for s.status().Updates < numUpdates {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for updates")
+		}
+		select {
+		case err := <-errs:
+			t.Fatal("worker stopped early:", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("worker failed:", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	finalCost := testNetCost(t, netFile, samples)
+	if finalCost >= initialCost {
+		t.Errorf("cost did not decrease: %f -> %f", initialCost, finalCost)
+	}
+	state, err := LoadServerState(stateFile(netFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version < numUpdates {
+		t.Errorf("expected at least %d updates in saved state but got %d", numUpdates,
+			state.Version)
+	}
+}
+
+// writeTestCorpus writes a tiny corpus of conversations
+// to a new directory in dir, and returns its path.
+func writeTestCorpus(tb testing.TB, dir string) string {
+	corpus := filepath.Join(dir, "corpus")
+	if err := os.Mkdir(corpus, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		convo := fmt.Sprintf("human,hi %d,,,\nbot,hello there,,,\nhuman,bye,,,\nbot,see you,,,\n", i)
+		path := filepath.Join(corpus, fmt.Sprintf("convo%d.csv", i))
+		if err := ioutil.WriteFile(path, []byte(convo), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return corpus
+}
+
+// testNetCost loads a saved bot and computes its total
+// cost on some samples.
+func testNetCost(t *testing.T, netFile string, samples *chatbot.SampleSet) float64 {
+	bot, err := chatbot.LoadBot(netFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Dropout(false)
+	return seqtoseq.TotalCostBlock(bot.Block, BatchSize, samples, neuralnet.DotCost{})
+}
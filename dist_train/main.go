@@ -1,36 +1,117 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/chatbot"
 )
 
 func main() {
-	if len(os.Args) != 4 {
+	if len(os.Args) < 2 {
 		dieUsage()
 	}
 	switch os.Args[1] {
 	case "train":
-		Train(os.Args[2], os.Args[3])
+		var loadOpts chatbot.LoadOptions
+		var security SecurityOptions
+		var compression CompressOptions
+		fs := flag.NewFlagSet("train", flag.ExitOnError)
+		loadOpts.AddFlags(fs)
+		security.AddTrainFlags(fs)
+		compression.AddFlags(fs)
+		temperature := fs.Float64("temperature", 1, "mixing temperature for unweighted corpora")
+		fs.Usage = dieUsage
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 2 {
+			dieUsage()
+		}
+		checkTemperature(*temperature)
+		rand.Seed(time.Now().UnixNano())
+		server := serverClient(fs.Arg(0), &security, defaultWorkerID())
+		err := Train(server, nil, fs.Args()[1:], &loadOpts, &compression, *temperature)
+		if err != nil {
+			die(err)
+		}
+	case "eval":
+		var loadOpts chatbot.LoadOptions
+		var security SecurityOptions
+		fs := flag.NewFlagSet("eval", flag.ExitOnError)
+		loadOpts.AddFlags(fs)
+		security.AddTrainFlags(fs)
+		temperature := fs.Float64("temperature", 1, "mixing temperature for unweighted corpora")
+		interval := fs.Duration("interval", 5*time.Minute, "time between evaluations")
+		prompts := fs.String("prompts", "hi,how are you?",
+			"comma-separated prompts to sample replies to")
+		fs.Usage = dieUsage
+		fs.Parse(os.Args[2:])
+		if fs.NArg() < 2 {
+			dieUsage()
+		}
+		checkTemperature(*temperature)
+		var promptList []string
+		if *prompts != "" {
+			promptList = strings.Split(*prompts, ",")
+		}
+		server := serverClient(fs.Arg(0), &security, "eval-"+defaultWorkerID())
+		err := Eval(server, nil, fs.Args()[1:], &loadOpts, *temperature, *interval,
+			promptList)
+		if err != nil {
+			die(err)
+		}
 	case "serve":
-		port, err := strconv.Atoi(os.Args[2])
+		var opts ServeOptions
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		opts.AddFlags(fs)
+		fs.Usage = dieUsage
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 2 {
+			dieUsage()
+		}
+		port, err := strconv.Atoi(fs.Arg(0))
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Invalid port:", err)
 			os.Exit(1)
 		}
-		Serve(port, os.Args[3])
+		if err := Serve(port, fs.Arg(1), &opts); err != nil {
+			die(err)
+		}
 	default:
 		dieUsage()
 	}
 }
 
 func dieUsage() {
-	fmt.Fprintln(os.Stderr, "Usage: dist_train train <param_url> <samples>")
-	fmt.Fprintln(os.Stderr, "       dist_train serve <port> <net_file>")
+	fmt.Fprintln(os.Stderr, "Usage: dist_train train [flags] <param_url> <samples[:weight]>...")
+	fmt.Fprintln(os.Stderr, "       dist_train eval [flags] <param_url> <samples[:weight]>...")
+	fmt.Fprintln(os.Stderr, "       dist_train serve [flags] <port> <net_file>")
 	os.Exit(1)
 }
 
+func serverClient(paramServer string, security *SecurityOptions,
+	workerID string) *ServerClient {
+	client, err := security.Client(workerID)
+	if err != nil {
+		die("Failed to set up client:", err)
+	}
+	server, err := NewServerClient(paramServer, client, workerID)
+	if err != nil {
+		die(err)
+	}
+	return server
+}
+
+func checkTemperature(temperature float64) {
+	if !(temperature > 0) {
+		die("Invalid temperature:", temperature)
+	}
+}
+
 func die(args ...interface{}) {
 	fmt.Fprintln(os.Stderr, args...)
 	os.Exit(1)
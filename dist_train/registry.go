@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// HeartbeatInterval is how often workers send
+	// heartbeats.
+	HeartbeatInterval = 10 * time.Second
+
+	// HeartbeatTimeout is how long a worker may go without
+	// a heartbeat before its shards are given to others.
+	HeartbeatTimeout = 4 * HeartbeatInterval
+)
+
+// A ShardAssignment tells a worker which shards of the
+// conversations to train on.
+type ShardAssignment struct {
+	NumShards int
+	Shards    []int
+
+	// Synchronous is set if the server trains
+	// synchronously, in which case workers should fetch
+	// the parameters after every gradient they upload.
+	Synchronous bool
+}
+
+// A Heartbeat reports a worker's recent costs.
+type Heartbeat struct {
+	WorkerID   string
+	Cost       float64
+	Validation float64
+}
+
+// A Registry tracks the live workers and assigns each of
+// them a share of the conversation shards.
+type Registry struct {
+	NumShards int
+
+	lock    sync.Mutex
+	workers map[string]*workerInfo
+}
+
+type workerInfo struct {
+	Shards        []int
+	LastHeartbeat time.Time
+	Cost          float64
+	Validation    float64
+}
+
+// NewRegistry creates a Registry with no workers.
+func NewRegistry(numShards int) *Registry {
+	return &Registry{NumShards: numShards, workers: map[string]*workerInfo{}}
+}
+
+// Register adds a worker and returns its shards.
+// Registering a worker which is already registered
+// returns its current shards.
+func (r *Registry) Register(id string) ShardAssignment {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+	if _, ok := r.workers[id]; !ok {
+		log.Println("Worker registered:", id)
+		r.workers[id] = &workerInfo{LastHeartbeat: time.Now()}
+		r.rebalance()
+	}
+	return r.assignment(id)
+}
+
+// Heartbeat records a heartbeat and returns the worker's
+// current shards.
+// It returns false if the worker is not registered, for
+// example because it timed out.
+func (r *Registry) Heartbeat(h *Heartbeat) (ShardAssignment, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+	w, ok := r.workers[h.WorkerID]
+	if !ok {
+		return ShardAssignment{}, false
+	}
+	w.LastHeartbeat = time.Now()
+	w.Cost = h.Cost
+	w.Validation = h.Validation
+	return r.assignment(h.WorkerID), true
+}
+
+// Expire removes workers whose heartbeats have timed out.
+func (r *Registry) Expire() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+}
+
+// Live returns the number of workers whose heartbeats
+// have not timed out.
+func (r *Registry) Live() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.expire()
+	return len(r.workers)
+}
+
+// Report fills in the shards and costs of the workers in
+// a StatusReport.
+func (r *Registry) Report(s *StatusReport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s.Registered = map[string]RegisteredWorker{}
+	for id, w := range r.workers {
+		s.Registered[id] = RegisteredWorker{
+			Shards:        append([]int{}, w.Shards...),
+			LastHeartbeat: w.LastHeartbeat,
+			Cost:          w.Cost,
+			Validation:    w.Validation,
+		}
+	}
+}
+
+func (r *Registry) expire() {
+	var changed bool
+	for id, w := range r.workers {
+		if time.Since(w.LastHeartbeat) > HeartbeatTimeout {
+			log.Println("Worker timed out:", id)
+			delete(r.workers, id)
+			changed = true
+		}
+	}
+	if changed {
+		r.rebalance()
+	}
+}
+
+func (r *Registry) assignment(id string) ShardAssignment {
+	return ShardAssignment{
+		NumShards: r.NumShards,
+		Shards:    append([]int{}, r.workers[id].Shards...),
+	}
+}
+
+// rebalance spreads the shards evenly over the workers,
+// moving as few shards as possible.
+func (r *Registry) rebalance() {
+	if len(r.workers) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(r.workers))
+	for id := range r.workers {
+		ids = append(ids, id)
+	}
+
+	// The extra shards go to the workers which already
+	// have the most, so that no worker gains shards when
+	// another worker joins.
+	sort.Slice(ids, func(i, j int) bool {
+		count1, count2 := len(r.workers[ids[i]].Shards), len(r.workers[ids[j]].Shards)
+		if count1 != count2 {
+			return count1 > count2
+		}
+		return ids[i] < ids[j]
+	})
+
+	targets := map[string]int{}
+	for i, id := range ids {
+		targets[id] = r.NumShards / len(ids)
+		if i < r.NumShards%len(ids) {
+			targets[id]++
+		}
+	}
+
+	assigned := make([]bool, r.NumShards)
+	for _, id := range ids {
+		w := r.workers[id]
+		if len(w.Shards) > targets[id] {
+			w.Shards = w.Shards[:targets[id]]
+		}
+		for _, shard := range w.Shards {
+			assigned[shard] = true
+		}
+	}
+	var free []int
+	for shard, ok := range assigned {
+		if !ok {
+			free = append(free, shard)
+		}
+	}
+	for _, id := range ids {
+		w := r.workers[id]
+		for len(w.Shards) < targets[id] {
+			w.Shards = append(w.Shards, free[0])
+			free = free[1:]
+		}
+		sort.Ints(w.Shards)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRegistryRebalance(t *testing.T) {
+	for _, numShards := range []int{5, 16} {
+		r := NewRegistry(numShards)
+		var live []string
+		for step := 0; step < 50; step++ {
+			if len(live) > 0 && rand.Intn(3) == 0 {
+				idx := rand.Intn(len(live))
+				id := live[idx]
+				live = append(live[:idx], live[idx+1:]...)
+				r.workers[id].LastHeartbeat = time.Now().Add(-HeartbeatTimeout - time.Second)
+				r.Expire()
+			} else {
+				before := registryShards(r)
+				id := fmt.Sprintf("worker%d", rand.Intn(1000))
+				r.Register(id)
+				if _, ok := before[id]; !ok {
+					live = append(live, id)
+				}
+				for other, shards := range before {
+					for _, shard := range registryShards(r)[other] {
+						if !containsShard(shards, shard) {
+							t.Fatalf("%d shards: %s gained shard %d when %s joined",
+								numShards, other, shard, id)
+						}
+					}
+				}
+			}
+			checkRegistry(t, r, numShards, len(live))
+		}
+	}
+}
+
+func TestRegistryHeartbeatTimeout(t *testing.T) {
+	r := NewRegistry(4)
+	r.Register("a")
+	r.Register("b")
+	if a, ok := r.Heartbeat(&Heartbeat{WorkerID: "a"}); !ok || len(a.Shards) != 2 {
+		t.Fatalf("unexpected heartbeat result: %v %v", a, ok)
+	}
+	r.workers["a"].LastHeartbeat = time.Now().Add(-HeartbeatTimeout - time.Second)
+	if _, ok := r.Heartbeat(&Heartbeat{WorkerID: "a"}); ok {
+		t.Error("heartbeat succeeded after timing out")
+	}
+	if b, ok := r.Heartbeat(&Heartbeat{WorkerID: "b"}); !ok || len(b.Shards) != 4 {
+		t.Errorf("remaining worker did not get every shard: %v %v", b, ok)
+	}
+	if _, ok := r.Heartbeat(&Heartbeat{WorkerID: "c"}); ok {
+		t.Error("heartbeat from an unknown worker succeeded")
+	}
+}
+
+// checkRegistry checks that every shard is owned by
+// exactly one worker and that shards are spread evenly.
+func checkRegistry(t *testing.T, r *Registry, numShards, numWorkers int) {
+	shards := registryShards(r)
+	if len(shards) != numWorkers {
+		t.Fatalf("expected %d workers but got %d", numWorkers, len(shards))
+	}
+	if numWorkers == 0 {
+		return
+	}
+	owners := make([]int, numShards)
+	min, max := numShards, 0
+	for _, workerShards := range shards {
+		for _, shard := range workerShards {
+			owners[shard]++
+		}
+		if len(workerShards) < min {
+			min = len(workerShards)
+		}
+		if len(workerShards) > max {
+			max = len(workerShards)
+		}
+	}
+	for shard, count := range owners {
+		if count != 1 {
+			t.Fatalf("shard %d has %d owners: %v", shard, count, shards)
+		}
+	}
+	if max-min > 1 {
+		t.Fatalf("unbalanced shards: %v", shards)
+	}
+}
+
+func registryShards(r *Registry) map[string][]int {
+	res := map[string][]int{}
+	for id, w := range r.workers {
+		res[id] = append([]int{}, w.Shards...)
+	}
+	return res
+}
+
+func containsShard(shards []int, shard int) bool {
+	for _, x := range shards {
+		if x == shard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+)
+
+// A Schedule computes the step size for each update from
+// a base rate, a linear warmup, an exponential decay, and
+// reductions when the validation cost plateaus.
+type Schedule struct {
+	// WarmupSteps is the number of updates over which the
+	// rate grows linearly from zero to the base rate.
+	WarmupSteps int64
+
+	// DecayHalfLife, if non-zero, is the number of updates
+	// over which the rate halves.
+	DecayHalfLife int64
+
+	// PlateauPatience, if non-zero, is the number of
+	// validation costs without an improvement after which
+	// the rate is multiplied by PlateauFactor.
+	// Only costs reported to /eval count; the validation
+	// costs in worker heartbeats are only reported in the
+	// server status.
+	PlateauPatience int
+	PlateauFactor   float64
+
+	// MinRate is the smallest rate the schedule produces
+	// after warmup.
+	MinRate float64
+
+	State ScheduleState
+}
+
+// ScheduleState is the part of a Schedule which changes
+// during training.
+type ScheduleState struct {
+	// BaseRate is the rate after warmup, before any
+	// decay or plateau reductions.
+	BaseRate float64
+
+	// PlateauScale is the product of the plateau
+	// reductions so far.
+	PlateauScale float64
+
+	HasBest  bool
+	Best     float64
+	BadEvals int
+}
+
+// AddFlags adds flags for the schedule to a flag set.
+func (s *Schedule) AddFlags(f *flag.FlagSet) {
+	f.Float64Var(&s.State.BaseRate, "rate", StepSize,
+		"base step size for new runs (resumed runs keep theirs; see /set_rate)")
+	f.Int64Var(&s.WarmupSteps, "warmup", 0, "updates of linear warmup")
+	f.Int64Var(&s.DecayHalfLife, "decay-half-life", 0,
+		"updates over which the step size halves (0 for no decay)")
+	f.IntVar(&s.PlateauPatience, "plateau-patience", 0,
+		"/eval reports without improvement before the step size drops (0 to disable; "+
+			"heartbeat validation costs are not used)")
+	f.Float64Var(&s.PlateauFactor, "plateau-factor", 0.5, "step size multiplier on a plateau")
+	f.Float64Var(&s.MinRate, "min-rate", 0, "minimum step size after warmup")
+}
+
+// Rate returns the step size for the given update.
+func (s *Schedule) Rate(step int64) float64 {
+	scale := s.State.PlateauScale
+	if scale == 0 {
+		scale = 1
+	}
+	rate := s.State.BaseRate * scale
+	if s.DecayHalfLife > 0 {
+		rate *= math.Pow(0.5, float64(step)/float64(s.DecayHalfLife))
+	}
+	if rate < s.MinRate {
+		rate = s.MinRate
+	}
+	if step < s.WarmupSteps {
+		rate *= float64(step+1) / float64(s.WarmupSteps)
+	}
+	return rate
+}
+
+// Validation records a validation cost, reducing the rate
+// if the cost has plateaued.
+func (s *Schedule) Validation(cost float64) {
+	if !s.State.HasBest || cost < s.State.Best {
+		s.State.HasBest = true
+		s.State.Best = cost
+		s.State.BadEvals = 0
+		return
+	}
+	s.State.BadEvals++
+	if s.PlateauPatience > 0 && s.State.BadEvals >= s.PlateauPatience {
+		if s.State.PlateauScale == 0 {
+			s.State.PlateauScale = 1
+		}
+		s.State.PlateauScale *= s.PlateauFactor
+		s.State.BadEvals = 0
+		log.Printf("Validation plateaued; step size scale is now %f", s.State.PlateauScale)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScheduleRate(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		step     int64
+		expected float64
+	}{
+		{Schedule{State: ScheduleState{BaseRate: 0.1}}, 1000, 0.1},
+
+		// The rate grows linearly during warmup.
+		{Schedule{WarmupSteps: 4, State: ScheduleState{BaseRate: 0.1}}, 0, 0.025},
+		{Schedule{WarmupSteps: 4, State: ScheduleState{BaseRate: 0.1}}, 2, 0.075},
+		{Schedule{WarmupSteps: 4, State: ScheduleState{BaseRate: 0.1}}, 4, 0.1},
+
+		// The rate halves every half-life.
+		{Schedule{DecayHalfLife: 10, State: ScheduleState{BaseRate: 0.1}}, 10, 0.05},
+		{Schedule{DecayHalfLife: 10, State: ScheduleState{BaseRate: 0.1}}, 25,
+			0.1 * math.Pow(0.5, 2.5)},
+
+		// The rate never decays below MinRate, but the
+		// floor is still warmed up.
+		{Schedule{DecayHalfLife: 10, MinRate: 0.03, State: ScheduleState{BaseRate: 0.1}},
+			20, 0.03},
+		{Schedule{WarmupSteps: 10, MinRate: 0.03, State: ScheduleState{BaseRate: 0.01}},
+			4, 0.015},
+
+		// Plateau reductions scale the base rate.
+		{Schedule{State: ScheduleState{BaseRate: 0.1, PlateauScale: 0.25}}, 0, 0.025},
+		{Schedule{DecayHalfLife: 10, State: ScheduleState{BaseRate: 0.1, PlateauScale: 0.5}},
+			10, 0.025},
+	}
+	for i, test := range tests {
+		actual := test.schedule.Rate(test.step)
+		if math.Abs(actual-test.expected) > 1e-8 {
+			t.Errorf("test %d: expected rate %f but got %f", i, test.expected, actual)
+		}
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	s := &Schedule{
+		PlateauPatience: 2,
+		PlateauFactor:   0.5,
+		State:           ScheduleState{BaseRate: 1},
+	}
+	steps := []struct {
+		cost  float64
+		scale float64
+	}{
+		{3, 1},
+		{2, 1},
+		{2.5, 1},
+		// The second cost without an improvement is a
+		// plateau.
+		{2, 0.5},
+		{2.5, 0.5},
+		{1, 0.5},
+		{1.5, 0.5},
+		{1.5, 0.25},
+	}
+	for i, step := range steps {
+		s.Validation(step.cost)
+		if actual := s.Rate(0); actual != step.scale {
+			t.Errorf("cost %d: expected rate %f but got %f", i, step.scale, actual)
+		}
+	}
+	if !s.State.HasBest || s.State.Best != 1 || s.State.BadEvals != 0 {
+		t.Errorf("unexpected state %+v", s.State)
+	}
+
+	s = &Schedule{PlateauFactor: 0.5, State: ScheduleState{BaseRate: 1}}
+	for i := 0; i < 10; i++ {
+		s.Validation(1)
+	}
+	if s.Rate(0) != 1 {
+		t.Error("plateau reduction should be disabled without patience")
+	}
+}
@@ -1,9 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/chatbot"
@@ -11,35 +23,235 @@ import (
 	"github.com/unixpickle/sgd/asyncsgd"
 )
 
-const StepSize = 0.001
+const (
+	StepSize = 0.001
 
-func Serve(port int, netFile string) {
-	net, err := chatbot.LoadBot(netFile)
+	// StalenessLogInterval is how often the staleness
+	// histogram is logged.
+	StalenessLogInterval = time.Minute
+)
+
+// ServeOptions configures a parameter server.
+type ServeOptions struct {
+	Security SecurityOptions
+
+	// Bind is the address to listen on, or "" for all
+	// interfaces.
+	Bind string
+
+	SaveUpdates  int
+	SaveInterval time.Duration
+	NumShards    int
+
+	MaxStaleness int
+	ScaleStale   bool
+
+	// SyncWorkers, if greater than 1, makes training
+	// synchronous, with one step for every SyncWorkers
+	// gradients.
+	SyncWorkers int
+
+	// ArchFile is a JSON Architecture for the bot which is
+	// created if the net file does not exist.
+	// If it is empty, the default architecture is used.
+	ArchFile string
+
+	Schedule Schedule
+}
+
+// AddFlags adds flags for the options to a flag set.
+func (s *ServeOptions) AddFlags(f *flag.FlagSet) {
+	s.Security.AddServeFlags(f)
+	f.StringVar(&s.Bind, "bind", "", "address to listen on (default all interfaces)")
+	f.IntVar(&s.SaveUpdates, "save-updates", 100, "updates between checkpoints (0 for no limit)")
+	f.DurationVar(&s.SaveInterval, "save-interval", time.Minute,
+		"maximum time between checkpoints (0 for no limit)")
+	f.IntVar(&s.NumShards, "shards", 64,
+		"conversation shards to split between workers (0 to disable)")
+	f.IntVar(&s.MaxStaleness, "max-staleness", 0,
+		"reject gradients more than this many updates old (0 for no limit)")
+	f.BoolVar(&s.ScaleStale, "scale-stale", false,
+		"scale the step size for gradients which are s > 1 updates old by 1/s")
+	f.IntVar(&s.SyncWorkers, "sync", 0,
+		"average this many gradients per step and hold workers between steps")
+	f.StringVar(&s.ArchFile, "arch", "", "architecture JSON for a new net (default built-in)")
+	s.Schedule.AddFlags(f)
+}
+
+// Serve runs a parameter server until it fails.
+func Serve(port int, netFile string, opts *ServeOptions) error {
+	s, err := NewServer(netFile, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if s.Token == nil {
+		log.Println("Warning: no auth token; anyone who can reach the server can use it")
+	}
+	go s.every(HeartbeatInterval, func() {
+		s.Registry.Expire()
+		s.flushSync()
+	})
+	go s.every(StalenessLogInterval, s.Staleness.LogHistogram)
+	addr := net.JoinHostPort(opts.Bind, strconv.Itoa(port))
+	return opts.Security.ListenAndServe(addr, s)
+}
+
+// NewServer creates a Server for a net file, resuming
+// from its saved state or creating and saving a new bot.
+//
+// Unlike Serve, it does not listen for requests or expire
+// workers in the background.
+func NewServer(netFile string, opts *ServeOptions) (*Server, error) {
+	token, err := opts.Security.Token()
+	if err != nil {
+		return nil, fmt.Errorf("read token: %s", err)
+	}
+	bot, err := loadOrCreateBot(netFile, opts.ArchFile)
+	if err != nil {
+		return nil, err
+	}
+	state, err := LoadServerState(stateFile(netFile))
 	if err != nil {
-		die(err)
+		return nil, fmt.Errorf("load server state: %s", err)
 	}
+	params := bot.Block.(sgd.Learner).Parameters()
+	adam := NewAdam(params)
+	schedule := opts.Schedule
 	s := &Server{
-		NetFile: netFile,
-		Bot:     net,
-		Updater: &asyncsgd.TransformerUpdater{
-			StepSize:    StepSize,
-			Transformer: &sgd.Adam{},
-		},
+		Token:     token,
+		NetFile:   netFile,
+		Bot:       bot,
+		Params:    params,
+		Stats:     NewStats(),
+		Registry:  NewRegistry(opts.NumShards),
+		Staleness: NewStalenessTracker(opts.MaxStaleness, opts.ScaleStale),
+		Eval:      &EvalTracker{BestFile: netFile + ".best"},
+		Schedule:  &schedule,
+		Adam:      adam,
+		Updater:   &asyncsgd.TransformerUpdater{Transformer: adam},
+		closed:    make(chan struct{}),
+	}
+	if state != nil {
+		netData, err := ioutil.ReadFile(netFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !state.MatchesNet(netData) {
+			log.Println("Warning: server state does not match the net file;",
+				"it may be from an earlier checkpoint")
+		}
+		log.Println("Resuming from update", state.Version)
+		if err := adam.Restore(state.Adam); err != nil {
+			return nil, fmt.Errorf("restore optimizer: %s", err)
+		}
+		schedule.State = state.Schedule
+		s.Staleness.SetVersion(state.Version)
+		s.Eval.Restore(state.Eval)
+	}
+	s.Updater.StepSize = schedule.Rate(s.Staleness.Version())
+	if opts.SyncWorkers > 1 {
+		s.Sync = NewSyncRound(opts.SyncWorkers, s.Registry)
+	}
+	s.Checkpointer = NewCheckpointer(opts.SaveUpdates, opts.SaveInterval, s.snapshot)
+	if state == nil {
+		if err := s.Checkpointer.Checkpoint(); err != nil {
+			return nil, fmt.Errorf("save net: %s", err)
+		}
 	}
-	s.PS = asyncsgd.NewParamServer(net.Block.(sgd.Learner).Parameters(), s)
-	http.ListenAndServe(":"+strconv.Itoa(port), s)
+	s.PS = asyncsgd.NewParamServer(params, s)
+	return s, nil
 }
 
 type Server struct {
-	PS       *asyncsgd.ParamServer
-	RateLock sync.Mutex
-	NetFile  string
-	Bot      *chatbot.Bot
-	Updater  *asyncsgd.TransformerUpdater
+	// Token is the shared secret which signs requests.
+	// If it is nil, requests are not authenticated.
+	Token []byte
+
+	// nonces holds the nonces of recent signed requests.
+	nonces nonceSet
+
+	PS           *asyncsgd.ParamServer
+	RateLock     sync.Mutex
+	Params       []*autofunc.Variable
+	NetFile      string
+	Bot          *chatbot.Bot
+	Updater      *asyncsgd.TransformerUpdater
+	Checkpointer *Checkpointer
+	Stats        *Stats
+	Registry     *Registry
+	Staleness    *StalenessTracker
+
+	// Sync is used for synchronous training, and is nil
+	// for asynchronous training.
+	Sync *SyncRound
+
+	Eval *EvalTracker
+
+	// Schedule and Adam are protected by RateLock.
+	Schedule *Schedule
+	Adam     *Adam
+
+	// uploadLock serializes gradient uploads so that
+	// Update knows which worker sent each gradient.
+	// This relies on the parameter server applying a
+	// gradient before its handler returns.
+	uploadLock   sync.Mutex
+	uploadWorker string
+
+	// Paused is set while gradients are being discarded.
+	// It is protected by RateLock.
+	Paused bool
+
+	closed chan struct{}
+}
+
+// Close stops the server's background tasks and saves a
+// final checkpoint if there are unsaved updates.
+// It does not stop the server from handling requests.
+// It may only be called once.
+func (s *Server) Close() error {
+	close(s.closed)
+	return s.Checkpointer.Close()
+}
+
+// every calls f periodically until the server is closed.
+func (s *Server) every(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-s.closed:
+			return
+		}
+	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/set_rate" {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBytes)
+	}
+	if s.Token != nil {
+		if err := checkAuth(s.Token, &s.nonces, r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	switch r.URL.Path {
+	case "/architecture":
+		arch := s.Bot.Arch
+		if arch == nil {
+			arch = chatbot.DefaultArchitecture()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(arch)
+	case "/set_rate":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 		rateParam, err := strconv.ParseFloat(r.FormValue("rate"), 64)
 		if err != nil {
 			http.Error(w, "invalid rate", http.StatusBadRequest)
@@ -47,15 +259,352 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		s.RateLock.Lock()
 		defer s.RateLock.Unlock()
-		s.Updater.StepSize = rateParam
-	} else {
+		s.Schedule.State.BaseRate = rateParam
+		s.Updater.StepSize = s.Schedule.Rate(s.Staleness.Version())
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.status())
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.status().WriteMetrics(w)
+	case "/pause", "/resume":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.RateLock.Lock()
+		s.Paused = (r.URL.Path == "/pause")
+		s.RateLock.Unlock()
+		log.Println("Updates paused:", r.URL.Path == "/pause")
+	case "/register", "/heartbeat":
+		var hb Heartbeat
+		if err := json.NewDecoder(r.Body).Decode(&hb); err != nil || hb.WorkerID == "" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		var assignment ShardAssignment
+		if r.URL.Path == "/register" {
+			assignment = s.Registry.Register(hb.WorkerID)
+		} else {
+			var ok bool
+			assignment, ok = s.Registry.Heartbeat(&hb)
+			if !ok {
+				http.Error(w, "unknown worker", http.StatusNotFound)
+				return
+			}
+		}
+		assignment.Synchronous = s.Sync != nil
+		s.Stats.Request(hb.WorkerID, false)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&assignment)
+	case "/net":
+		s.RateLock.Lock()
+		data, err := s.Bot.Encode()
+		version := s.Staleness.Version()
+		s.RateLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(paramVersionHeader, strconv.FormatInt(version, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case "/eval":
+		var report EvalReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil ||
+			math.IsNaN(report.Validation) || math.IsInf(report.Validation, 0) {
+			http.Error(w, "invalid report", http.StatusBadRequest)
+			return
+		}
+		if report.Net != nil {
+			if err := s.checkNet(report.Net); err != nil {
+				http.Error(w, "invalid net: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s.RateLock.Lock()
+		s.Schedule.Validation(report.Validation)
+		s.RateLock.Unlock()
+		status, err := s.Eval.Report(&report)
+		if err != nil {
+			log.Println("Failed to save best net:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&status)
+	case "/encodings":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SupportedEncodings)
+	case "/params":
+		worker := workerID(r)
+		s.Stats.Request(worker, false)
+		if s.Sync != nil {
+			s.Sync.Wait(worker)
+			s.flushSync()
+		}
+		var buf bytes.Buffer
+		s.RateLock.Lock()
+		s.Staleness.Synced(worker)
+		err := writeParams(&buf, s.Params)
+		version := s.Staleness.Version()
+		s.RateLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(paramVersionHeader, strconv.FormatInt(version, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf.Bytes())
+	case "/upload":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g, err := decodeGradient(r.Header.Get(gradientEncodingHeader), data, s.Params)
+		if err != nil {
+			http.Error(w, "invalid gradient: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		worker := workerID(r)
+		s.Stats.Request(worker, true)
+		s.Stats.Uploaded(int64(len(data)))
+		s.uploadLock.Lock()
+		defer s.uploadLock.Unlock()
+		s.uploadWorker = worker
+		s.Update(g)
+		s.uploadWorker = ""
+	case "/checkpoint":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Checkpointer.Checkpoint(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		worker := workerID(r)
+		upload := r.Method != "GET"
+		s.Stats.Request(worker, upload)
+		if upload && r.ContentLength > 0 {
+			s.Stats.Uploaded(r.ContentLength)
+		}
+		if !upload {
+			if s.Sync != nil {
+				s.Sync.Wait(worker)
+				s.flushSync()
+			}
+			// Updates change the parameters under RateLock,
+			// so they must not change while they are sent.
+			s.RateLock.Lock()
+			defer s.RateLock.Unlock()
+			s.Staleness.Synced(worker)
+			s.PS.ServeHTTP(w, r)
+			return
+		}
+		s.uploadLock.Lock()
+		defer s.uploadLock.Unlock()
+		s.uploadWorker = worker
 		s.PS.ServeHTTP(w, r)
+		s.uploadWorker = ""
 	}
 }
 
 func (s *Server) Update(g autofunc.Gradient) {
 	s.RateLock.Lock()
 	defer s.RateLock.Unlock()
+	if s.Paused {
+		s.Stats.Drop()
+		return
+	}
+	scale := s.Staleness.Weigh(s.uploadWorker)
+	if scale == 0 {
+		return
+	}
+	if s.Sync != nil {
+		// A round takes one step with the sum of its
+		// gradients, so stale gradients are weighted within
+		// the sum instead.
+		if scale != 1 {
+			g.Scale(scale)
+		}
+		s.flushSyncLocked()
+		if g = s.Sync.Add(s.uploadWorker, g); g == nil {
+			return
+		}
+		defer s.Sync.Finish()
+		s.apply(g, 1)
+		return
+	}
+	s.apply(g, scale)
+}
+
+// flushSync applies the pending synchronous round early
+// if it is ready to be flushed.
+func (s *Server) flushSync() {
+	s.RateLock.Lock()
+	defer s.RateLock.Unlock()
+	s.flushSyncLocked()
+}
+
+// flushSyncLocked is like flushSync, but the caller must
+// hold RateLock.
+func (s *Server) flushSyncLocked() {
+	g := s.Sync.Flush()
+	if g == nil {
+		return
+	}
+	if s.Paused {
+		s.Stats.Drop()
+	} else {
+		s.apply(g, 1)
+	}
+	s.Sync.Finish()
+}
+
+// apply takes a step with a gradient, scaling the
+// scheduled step size by scale.
+// Scaling the step rather than the gradient keeps Adam
+// from normalizing the scale away.
+// The caller must hold RateLock.
+func (s *Server) apply(g autofunc.Gradient, scale float64) {
+	s.Updater.StepSize = scale * s.Schedule.Rate(s.Staleness.Version())
 	s.Updater.Update(g)
-	s.Bot.Save(s.NetFile)
+	s.Staleness.Applied()
+	s.Stats.Update()
+	s.Checkpointer.Updated()
+}
+
+// checkNet makes sure that an encoded bot from an eval
+// worker has the architecture and parameter sizes of the
+// server's bot, so that it can be saved as the best net.
+func (s *Server) checkNet(data []byte) error {
+	bot, err := chatbot.DecodeBot(data)
+	if err != nil {
+		return err
+	}
+	archData, _ := json.Marshal(defaultArch(bot.Arch))
+	expectedData, _ := json.Marshal(defaultArch(s.Bot.Arch))
+	if !bytes.Equal(archData, expectedData) {
+		return errors.New("architecture does not match")
+	}
+	learner, ok := bot.Block.(sgd.Learner)
+	if !ok {
+		return errors.New("net has no parameters")
+	}
+	params := learner.Parameters()
+	expected := s.Bot.Block.(sgd.Learner).Parameters()
+	if len(params) != len(expected) {
+		return errors.New("parameter count does not match")
+	}
+	for i, p := range params {
+		if len(p.Vector) != len(expected[i].Vector) {
+			return fmt.Errorf("parameter %d has size %d (expected %d)", i, len(p.Vector),
+				len(expected[i].Vector))
+		}
+	}
+	return nil
+}
+
+// defaultArch returns arch, or the default architecture
+// if arch is nil.
+func defaultArch(arch *chatbot.Architecture) *chatbot.Architecture {
+	if arch == nil {
+		return chatbot.DefaultArchitecture()
+	}
+	return arch
+}
+
+// snapshot encodes the bot and the training state
+// between updates.
+func (s *Server) snapshot() ([]CheckpointFile, error) {
+	eval := s.Eval.Status()
+	eval.Latest = nil
+
+	s.RateLock.Lock()
+	defer s.RateLock.Unlock()
+	netData, err := s.Bot.Encode()
+	if err != nil {
+		return nil, err
+	}
+	netHash := sha256.Sum256(netData)
+	state := &ServerState{
+		Version:  s.Staleness.Version(),
+		Adam:     s.Adam.State,
+		Schedule: s.Schedule.State,
+		Eval:     eval,
+		NetHash:  netHash[:],
+	}
+	stateData, err := state.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// The state is written last, so that a crash between
+	// the two writes leaves a state which does not match
+	// the net, rather than a net which is behind the
+	// state.
+	return []CheckpointFile{
+		{Path: s.NetFile, Data: netData},
+		{Path: stateFile(s.NetFile), Data: stateData},
+	}, nil
+}
+
+// loadOrCreateBot loads a bot, or creates one if the file
+// does not exist.
+func loadOrCreateBot(netFile, archFile string) (*chatbot.Bot, error) {
+	bot, err := chatbot.LoadBot(netFile)
+	if !os.IsNotExist(err) {
+		return bot, err
+	}
+	log.Println("Creating bot...")
+	arch := chatbot.DefaultArchitecture()
+	if archFile != "" {
+		data, err := ioutil.ReadFile(archFile)
+		if err != nil {
+			return nil, err
+		}
+		arch = &chatbot.Architecture{}
+		if err := json.Unmarshal(data, arch); err != nil {
+			return nil, fmt.Errorf("parse %s: %s", archFile, err)
+		}
+		if err := arch.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid architecture: %s", err)
+		}
+	}
+	return chatbot.NewBotArchitecture(arch), nil
+}
+
+func (s *Server) status() *StatusReport {
+	var res StatusReport
+	s.RateLock.Lock()
+	res.StepSize = s.Updater.StepSize
+	res.Paused = s.Paused
+	s.RateLock.Unlock()
+	s.Stats.Report(&res)
+	s.Registry.Report(&res)
+	res.StaleRejected = s.Staleness.Rejected()
+	res.Eval = s.Eval.Status()
+	res.LastCheckpoint = s.Checkpointer.LastSave()
+	if err := s.Checkpointer.LastError(); err != nil {
+		res.CheckpointErr = err.Error()
+	}
+	return &res
+}
+
+// workerID identifies the worker which sent a request,
+// falling back on its address for old workers.
+func workerID(r *http.Request) string {
+	if id := r.Header.Get(workerIDHeader); id != "" {
+		return id
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
 }
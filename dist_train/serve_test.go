@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/chatbot"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd/asyncsgd"
+)
+
+func TestServerAuth(t *testing.T) {
+	s, server := newTestServer(t, []byte("secret"))
+	defer s.Close()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned request: expected 401 but got %s", resp.Status)
+	}
+
+	bad := testClient([]byte("wrong"))
+	if resp := testRequest(t, bad, "POST", server.URL+"/pause", nil); resp.StatusCode !=
+		http.StatusUnauthorized {
+		t.Errorf("bad token: expected 401 but got %s", resp.Status)
+	}
+	if s.Paused {
+		t.Error("paused by an unauthenticated request")
+	}
+
+	client := testClient(s.Token)
+	if resp := testRequest(t, client, "GET", server.URL+"/status", nil); resp.StatusCode !=
+		http.StatusOK {
+		t.Errorf("signed request: expected 200 but got %s", resp.Status)
+	}
+}
+
+func TestServerPause(t *testing.T) {
+	s, server := newTestServer(t, nil)
+	defer s.Close()
+	defer server.Close()
+	client := testClient(nil)
+
+	for _, path := range []string{"/pause", "/resume", "/checkpoint", "/upload"} {
+		resp := testRequest(t, client, "GET", server.URL+path, nil)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: expected 405 but got %s", path, resp.Status)
+		}
+	}
+
+	testRequest(t, client, "POST", server.URL+"/pause", nil)
+	upload := make([]byte, 8*len(s.Params[0].Vector))
+	for i := 0; i < 2; i++ {
+		resp := testRequest(t, client, "POST", server.URL+"/upload", upload)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload: %s", resp.Status)
+		}
+	}
+	status := testStatus(t, client, server.URL)
+	if !status.Paused || status.DroppedUpdates != 2 || status.Updates != 0 {
+		t.Errorf("unexpected status while paused: %+v", status)
+	}
+
+	testRequest(t, client, "POST", server.URL+"/resume", nil)
+	testRequest(t, client, "POST", server.URL+"/upload", upload)
+	status = testStatus(t, client, server.URL)
+	if status.Paused || status.DroppedUpdates != 2 || status.Updates != 1 {
+		t.Errorf("unexpected status after resuming: %+v", status)
+	}
+	if status.UploadBytes != int64(3*len(upload)) {
+		t.Errorf("expected %d upload bytes but got %d", 3*len(upload), status.UploadBytes)
+	}
+
+	if resp := testRequest(t, client, "POST", server.URL+"/checkpoint", nil); resp.StatusCode !=
+		http.StatusOK {
+		t.Errorf("checkpoint: %s", resp.Status)
+	}
+}
+
+func TestServerNonFinite(t *testing.T) {
+	s, server := newTestServer(t, nil)
+	defer s.Close()
+	defer server.Close()
+	client := testClient(nil)
+
+	var size int
+	for _, p := range s.Params {
+		size += 8 * len(p.Vector)
+	}
+	upload := make([]byte, size)
+	binary.LittleEndian.PutUint64(upload, math.Float64bits(math.NaN()))
+	resp := testRequest(t, client, "POST", server.URL+"/upload", upload)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 but got %s", resp.Status)
+	}
+	if status := testStatus(t, client, server.URL); status.Updates != 0 {
+		t.Errorf("expected no updates but got %d", status.Updates)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s, server := newTestServer(t, nil)
+	defer s.Close()
+	defer server.Close()
+	client := testClient(nil)
+
+	s.Stats.Drop()
+	resp := testRequest(t, client, "GET", server.URL+"/metrics", nil)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	values := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		fields := strings.Fields(line)
+		if fields[0] == "#" {
+			if len(fields) < 4 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				t.Errorf("bad comment line: %q", line)
+			} else if fields[1] == "TYPE" && fields[3] != "counter" && fields[3] != "gauge" {
+				t.Errorf("bad metric type: %q", line)
+			}
+			continue
+		}
+		if len(fields) != 2 {
+			t.Errorf("bad sample line: %q", line)
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Errorf("bad sample value: %q", line)
+		}
+		values[fields[0]] = value
+	}
+	if values["dist_train_dropped_updates_total"] != 1 {
+		t.Errorf("expected one dropped update in metrics:\n%s", body)
+	}
+	if _, ok := values["dist_train_paused"]; !ok {
+		t.Errorf("missing paused metric:\n%s", body)
+	}
+}
+
+func TestServerEval(t *testing.T) {
+	s, server := newTestServer(t, nil)
+	defer s.Close()
+	defer server.Close()
+	client := testClient(nil)
+
+	dir, err := ioutil.TempDir("", "dist_train")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.Eval.BestFile = filepath.Join(dir, "net.best")
+	s.Bot = chatbot.NewBotArchitecture(&chatbot.Architecture{StateSizes: []int{4}})
+	good, err := s.Bot.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := chatbot.NewBotArchitecture(&chatbot.Architecture{StateSizes: []int{5}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		report      EvalReport
+		status      int
+		best        float64
+		bestVersion int64
+	}{
+		{EvalReport{Version: 1, Validation: 2, Net: good}, http.StatusOK, 2, 1},
+		{EvalReport{Version: 2, Validation: 3}, http.StatusOK, 2, 1},
+		{EvalReport{Version: 3, Validation: 3, Net: good}, http.StatusOK, 2, 1},
+		{EvalReport{Version: 4, Validation: 1, Net: other}, http.StatusBadRequest, 2, 1},
+		{EvalReport{Version: 5, Validation: 1, Net: []byte("garbage")},
+			http.StatusBadRequest, 2, 1},
+		{EvalReport{Version: 6, Validation: 1, Net: good}, http.StatusOK, 1, 6},
+	}
+	for i, test := range tests {
+		body, _ := json.Marshal(&test.report)
+		resp := testRequest(t, client, "POST", server.URL+"/eval", body)
+		if resp.StatusCode != test.status {
+			t.Errorf("report %d: expected status %d but got %s", i, test.status, resp.Status)
+		}
+		status := s.Eval.Status()
+		if !status.HasBest || status.Best != test.best || status.BestVersion != test.bestVersion {
+			t.Errorf("report %d: unexpected status %+v", i, status)
+		}
+	}
+	saved, err := ioutil.ReadFile(s.Eval.BestFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(saved, good) {
+		t.Error("best net file does not match the best report")
+	}
+}
+
+func newTestServer(t *testing.T, token []byte) (*Server, *httptest.Server) {
+	params := []*autofunc.Variable{{Vector: linalg.Vector{1, 2, 3}}}
+	adam := NewAdam(params)
+	s := &Server{
+		Token:     token,
+		Params:    params,
+		Stats:     NewStats(),
+		Registry:  NewRegistry(0),
+		Staleness: NewStalenessTracker(0, false),
+		Eval:      &EvalTracker{},
+		Schedule:  &Schedule{State: ScheduleState{BaseRate: StepSize}},
+		Adam:      adam,
+		Updater:   &asyncsgd.TransformerUpdater{Transformer: adam},
+		closed:    make(chan struct{}),
+	}
+	s.Checkpointer = NewCheckpointer(0, 0, func() ([]CheckpointFile, error) {
+		return nil, nil
+	})
+	s.PS = asyncsgd.NewParamServer(params, s)
+	return s, httptest.NewServer(s)
+}
+
+func testClient(token []byte) *http.Client {
+	return &http.Client{
+		Transport: &clientTransport{
+			Token:    token,
+			WorkerID: "worker",
+			Base:     http.DefaultTransport,
+		},
+	}
+}
+
+func testRequest(t *testing.T, c *http.Client, method, url string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(gradientEncodingHeader, EncodingDense)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp
+}
+
+func testStatus(t *testing.T, c *http.Client, url string) *StatusReport {
+	var status StatusReport
+	resp := testRequest(t, c, "GET", url+"/status", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return &status
+}
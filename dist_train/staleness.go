@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"strings"
+	"sync"
+)
+
+// A StalenessTracker measures how many updates old the
+// parameters behind each gradient are, and decides how
+// much weight stale gradients get.
+//
+// A gradient's staleness is the number of updates which
+// were applied between the worker's latest sync and the
+// upload of the gradient.
+type StalenessTracker struct {
+	// MaxStaleness, if non-zero, is the largest staleness
+	// for which gradients are applied.
+	MaxStaleness int
+
+	// Scale causes the step taken with a gradient with
+	// staleness s > 1 to be scaled by 1/s.
+	Scale bool
+
+	lock     sync.Mutex
+	version  int64
+	synced   map[string]int64
+	rejected int64
+
+	// histogram[i] counts the gradients whose staleness
+	// has bit length i, so the buckets are 0, 1, 2-3, 4-7,
+	// and so on.
+	histogram []int64
+}
+
+// NewStalenessTracker creates a StalenessTracker with no
+// workers.
+func NewStalenessTracker(maxStaleness int, scale bool) *StalenessTracker {
+	return &StalenessTracker{
+		MaxStaleness: maxStaleness,
+		Scale:        scale,
+		synced:       map[string]int64{},
+	}
+}
+
+// Synced records that a worker fetched the parameters.
+func (s *StalenessTracker) Synced(worker string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced[worker] = s.version
+}
+
+// Weigh records a gradient from a worker and returns the
+// factor to scale its step by, or 0 if it is too stale to
+// be applied.
+//
+// Gradients from workers which have never synced are
+// treated as fresh.
+func (s *StalenessTracker) Weigh(worker string) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var staleness int
+	if version, ok := s.synced[worker]; ok {
+		staleness = int(s.version - version)
+	}
+	bucket := bits.Len(uint(staleness))
+	for len(s.histogram) <= bucket {
+		s.histogram = append(s.histogram, 0)
+	}
+	s.histogram[bucket]++
+
+	if s.MaxStaleness > 0 && staleness > s.MaxStaleness {
+		s.rejected++
+		return 0
+	}
+	if s.Scale && staleness > 1 {
+		return 1 / float64(staleness)
+	}
+	return 1
+}
+
+// Applied records that a gradient was applied.
+func (s *StalenessTracker) Applied() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version++
+}
+
+// SetVersion sets the number of applied gradients, for
+// resuming training.
+func (s *StalenessTracker) SetVersion(version int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version = version
+}
+
+// Version returns the number of applied gradients.
+func (s *StalenessTracker) Version() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+// Rejected returns the number of gradients which have
+// been rejected for being too stale.
+func (s *StalenessTracker) Rejected() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rejected
+}
+
+// LogHistogram logs the staleness histogram since the
+// last call, and then resets it.
+func (s *StalenessTracker) LogHistogram() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var parts []string
+	for i, count := range s.histogram {
+		if count == 0 {
+			continue
+		}
+		var label string
+		if i < 2 {
+			label = fmt.Sprint(i)
+		} else {
+			label = fmt.Sprintf("%d-%d", 1<<uint(i-1), 1<<uint(i)-1)
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d", label, count))
+	}
+	if len(parts) > 0 {
+		log.Printf("staleness: %s (rejected %d total)", strings.Join(parts, " "), s.rejected)
+	}
+	s.histogram = nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStalenessTrackerWeigh(t *testing.T) {
+	tests := []struct {
+		maxStaleness int
+		scale        bool
+		synced       bool
+		staleness    int
+		expected     float64
+	}{
+		{0, false, true, 10, 1},
+		{0, true, true, 0, 1},
+		{0, true, true, 1, 1},
+		{0, true, true, 4, 0.25},
+		{3, false, true, 3, 1},
+		{3, false, true, 4, 0},
+		{3, true, true, 2, 0.5},
+		{3, true, false, 10, 1},
+	}
+	for i, test := range tests {
+		s := NewStalenessTracker(test.maxStaleness, test.scale)
+		if test.synced {
+			s.Synced("worker")
+		}
+		for j := 0; j < test.staleness; j++ {
+			s.Applied()
+		}
+		if actual := s.Weigh("worker"); actual != test.expected {
+			t.Errorf("test %d: expected weight %f but got %f", i, test.expected, actual)
+		}
+		var rejected int64
+		if test.expected == 0 {
+			rejected = 1
+		}
+		if s.Rejected() != rejected {
+			t.Errorf("test %d: expected %d rejected but got %d", i, rejected, s.Rejected())
+		}
+	}
+}
+
+func TestStalenessTrackerSetVersion(t *testing.T) {
+	s := NewStalenessTracker(2, false)
+	s.SetVersion(100)
+	s.Synced("worker")
+	s.Applied()
+	if s.Version() != 101 {
+		t.Errorf("expected version 101 but got %d", s.Version())
+	}
+	if s.Weigh("worker") != 1 {
+		t.Error("gradient after resuming was rejected")
+	}
+}
+
+func TestStalenessTrackerLogHistogram(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	s := NewStalenessTracker(0, false)
+	for _, worker := range []string{"a", "b", "c", "d"} {
+		s.Synced(worker)
+	}
+	s.Weigh("a")
+	s.Applied()
+	s.Weigh("b")
+	for i := 0; i < 2; i++ {
+		s.Applied()
+	}
+	s.Weigh("c")
+	for i := 0; i < 4; i++ {
+		s.Applied()
+	}
+	s.Weigh("d")
+	s.LogHistogram()
+
+	expected := "staleness: 0:1 1:1 2-3:1 4-7:1 (rejected 0 total)"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected %q in log but got %q", expected, buf.String())
+	}
+	buf.Reset()
+	s.LogHistogram()
+	if buf.Len() != 0 {
+		t.Errorf("histogram was not reset: %q", buf.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"os"
+)
+
+// ServerState is the training state which a parameter
+// server saves next to its net file, so that training
+// resumes where it left off.
+type ServerState struct {
+	// Version is the number of applied gradients.
+	Version int64
+
+	Adam     AdamState
+	Schedule ScheduleState
+
+	// Eval holds the best validation cost so far.
+	Eval EvalStatus
+
+	// NetHash is the SHA-256 hash of the net file which
+	// was saved with the state.
+	NetHash []byte
+}
+
+// MatchesNet checks if the state was saved with a net
+// file's data.
+// States saved before NetHash was recorded match any
+// net file.
+func (s *ServerState) MatchesNet(netData []byte) bool {
+	if s.NetHash == nil {
+		return true
+	}
+	hash := sha256.Sum256(netData)
+	return bytes.Equal(hash[:], s.NetHash)
+}
+
+// stateFile returns the path of the state file for a net
+// file.
+func stateFile(netFile string) string {
+	return netFile + ".state"
+}
+
+// LoadServerState reads a state file.
+// It returns nil if the file does not exist.
+func LoadServerState(path string) (*ServerState, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res ServerState
+	if err := gob.NewDecoder(f).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Encode serializes the state.
+func (s *ServerState) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
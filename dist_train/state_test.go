@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestServerStateMatchesNet(t *testing.T) {
+	var old ServerState
+	if !old.MatchesNet([]byte("net")) {
+		t.Error("state without a hash should match any net")
+	}
+	hash := sha256.Sum256([]byte("net"))
+	state := &ServerState{NetHash: hash[:]}
+	if !state.MatchesNet([]byte("net")) {
+		t.Error("state should match its net")
+	}
+	if state.MatchesNet([]byte("newer net")) || state.MatchesNet(nil) {
+		t.Error("state should not match another net")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	workerIDHeader = "X-Worker-ID"
+
+	// RateWindow is the number of seconds over which
+	// updates per second are averaged.
+	RateWindow = 60
+
+	// WorkerTimeout is how long a worker may go without a
+	// request before it is no longer considered connected.
+	WorkerTimeout = 2 * time.Minute
+)
+
+// Stats tracks the activity of a parameter server.
+type Stats struct {
+	lock      sync.Mutex
+	startTime time.Time
+	updates   int64
+	dropped   int64
+	uploaded  int64
+	workers   map[string]*WorkerStats
+
+	// rateCounts[i] counts the updates during the Unix
+	// second rateSecs[i], where i is that second modulo
+	// RateWindow.
+	rateCounts [RateWindow]int64
+	rateSecs   [RateWindow]int64
+}
+
+// WorkerStats describes a worker's activity.
+type WorkerStats struct {
+	LastRequest time.Time
+	LastUpdate  time.Time
+	Updates     int64
+}
+
+// NewStats creates an empty Stats.
+func NewStats() *Stats {
+	return &Stats{startTime: time.Now(), workers: map[string]*WorkerStats{}}
+}
+
+// Request records a request from a worker.
+// Gradient uploads should be flagged as updates.
+func (s *Stats) Request(worker string, update bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ws, ok := s.workers[worker]
+	if !ok {
+		ws = &WorkerStats{}
+		s.workers[worker] = ws
+	}
+	now := time.Now()
+	ws.LastRequest = now
+	if update {
+		ws.LastUpdate = now
+		ws.Updates++
+	}
+}
+
+// Update records an update to the parameters.
+func (s *Stats) Update() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.updates++
+	sec := time.Now().Unix()
+	idx := int(sec % RateWindow)
+	if s.rateSecs[idx] != sec {
+		s.rateSecs[idx] = sec
+		s.rateCounts[idx] = 0
+	}
+	s.rateCounts[idx]++
+}
+
+// Drop records a gradient which was not applied.
+func (s *Stats) Drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropped++
+}
+
+// Uploaded records the size of an uploaded gradient.
+func (s *Stats) Uploaded(bytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploaded += bytes
+}
+
+// A StatusReport is a snapshot of a server's state.
+type StatusReport struct {
+	Updates        int64
+	DroppedUpdates int64
+	StaleRejected  int64
+	UploadBytes    int64
+	UpdatesPerSec  float64
+	StepSize       float64
+	Paused         bool
+	Uptime         float64
+	LastCheckpoint time.Time
+	CheckpointErr  string `json:",omitempty"`
+
+	// Workers maps the ID of every connected worker to its
+	// stats.
+	Workers map[string]WorkerStats
+
+	// Registered maps the ID of every registered worker to
+	// its shards and latest costs.
+	Registered map[string]RegisteredWorker
+
+	Eval EvalStatus
+}
+
+// RegisteredWorker describes a worker in a Registry.
+type RegisteredWorker struct {
+	Shards        []int
+	LastHeartbeat time.Time
+	Cost          float64
+	Validation    float64
+}
+
+// Report fills in the fields of a StatusReport which
+// come from the stats.
+func (s *Stats) Report(r *StatusReport) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	r.Updates = s.updates
+	r.DroppedUpdates = s.dropped
+	r.UploadBytes = s.uploaded
+	r.Uptime = now.Sub(s.startTime).Seconds()
+
+	var recent int64
+	sec := now.Unix()
+	for i, count := range s.rateCounts {
+		// The current second is incomplete, so it is left
+		// out of the average.
+		if s.rateSecs[i] < sec && s.rateSecs[i] >= sec-RateWindow {
+			recent += count
+		}
+	}
+	window := RateWindow
+	if up := int(sec - s.startTime.Unix()); up < window {
+		window = up
+	}
+	if window > 0 {
+		r.UpdatesPerSec = float64(recent) / float64(window)
+	}
+
+	r.Workers = map[string]WorkerStats{}
+	for id, ws := range s.workers {
+		if now.Sub(ws.LastRequest) < WorkerTimeout {
+			r.Workers[id] = *ws
+		}
+	}
+}
+
+type metric struct {
+	Name  string
+	Type  string
+	Help  string
+	Value float64
+}
+
+// WriteMetrics writes a report in the Prometheus text
+// exposition format.
+func (r *StatusReport) WriteMetrics(w io.Writer) error {
+	var paused float64
+	if r.Paused {
+		paused = 1
+	}
+	metrics := []metric{
+		{"dist_train_updates_total", "counter", "Gradients applied.", float64(r.Updates)},
+		{"dist_train_dropped_updates_total", "counter", "Gradients discarded while paused.",
+			float64(r.DroppedUpdates)},
+		{"dist_train_stale_rejected_total", "counter", "Gradients rejected as too stale.",
+			float64(r.StaleRejected)},
+		{"dist_train_upload_bytes_total", "counter", "Bytes of uploaded gradients.",
+			float64(r.UploadBytes)},
+		{"dist_train_updates_per_second", "gauge", "Recent rate of applied gradients.",
+			r.UpdatesPerSec},
+		{"dist_train_step_size", "gauge", "Current step size.", r.StepSize},
+		{"dist_train_paused", "gauge", "Whether updates are paused.", paused},
+		{"dist_train_uptime_seconds", "gauge", "Time since the server started.", r.Uptime},
+		{"dist_train_last_checkpoint_timestamp_seconds", "gauge",
+			"Time of the latest successful checkpoint.", unixSeconds(r.LastCheckpoint)},
+		{"dist_train_workers", "gauge", "Connected workers.", float64(len(r.Workers))},
+		{"dist_train_registered_workers", "gauge", "Workers with live heartbeats.",
+			float64(len(r.Registered))},
+	}
+	if r.Eval.Latest != nil {
+		metrics = append(metrics, []metric{
+			{"dist_train_eval_validation_cost", "gauge",
+				"Mean validation cost from the latest evaluation.", r.Eval.Latest.Validation},
+			{"dist_train_eval_param_version", "gauge",
+				"Parameter version of the latest evaluation.", float64(r.Eval.Latest.Version)},
+		}...)
+	}
+	if r.Eval.HasBest {
+		metrics = append(metrics, metric{"dist_train_eval_best_validation_cost", "gauge",
+			"Best mean validation cost so far.", r.Eval.Best})
+	}
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.Name, m.Help,
+			m.Name, m.Type, m.Name, formatMetric(m.Value))
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(r.Workers))
+	for id := range r.Workers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	workerMetrics := []struct {
+		Name  string
+		Type  string
+		Help  string
+		Value func(ws WorkerStats) float64
+	}{
+		{"dist_train_worker_updates_total", "counter", "Gradients uploaded by a worker.",
+			func(ws WorkerStats) float64 { return float64(ws.Updates) }},
+		{"dist_train_worker_last_update_timestamp_seconds", "gauge",
+			"Time of a worker's latest gradient upload.",
+			func(ws WorkerStats) float64 { return unixSeconds(ws.LastUpdate) }},
+	}
+	for _, m := range workerMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help,
+			m.Name, m.Type); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, err := fmt.Fprintf(w, "%s{worker=%s} %s\n", m.Name, strconv.Quote(id),
+				formatMetric(m.Value(r.Workers[id])))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ids = ids[:0]
+	for id := range r.Registered {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	registeredMetrics := []struct {
+		Name  string
+		Help  string
+		Value func(rw RegisteredWorker) float64
+	}{
+		{"dist_train_worker_shards", "Shards assigned to a worker.",
+			func(rw RegisteredWorker) float64 { return float64(len(rw.Shards)) }},
+		{"dist_train_worker_cost", "Latest training cost reported by a worker.",
+			func(rw RegisteredWorker) float64 { return rw.Cost }},
+		{"dist_train_worker_validation_cost", "Latest validation cost reported by a worker.",
+			func(rw RegisteredWorker) float64 { return rw.Validation }},
+	}
+	for _, m := range registeredMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.Name, m.Help,
+			m.Name); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, err := fmt.Fprintf(w, "%s{worker=%s} %s\n", m.Name, strconv.Quote(id),
+				formatMetric(m.Value(r.Registered[id])))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func formatMetric(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/autofunc"
+)
+
+// SyncTimeout is the longest a worker waits for a
+// synchronous round to finish before it is given the
+// current parameters anyway.
+const SyncTimeout = HeartbeatTimeout
+
+// A SyncRound collects gradients for synchronous
+// training, where one averaged step is taken for every
+// Workers gradients.
+// If fewer than Workers workers are live in the Registry,
+// a round only waits for the live workers.
+//
+// Workers which contributed to the pending round are
+// held back from fetching parameters until the round is
+// applied, so that every gradient in a round is computed
+// from the same parameters.
+// Each worker contributes at most one gradient to a
+// round, so a round never has more gradients than
+// distinct workers.
+type SyncRound struct {
+	Workers  int
+	Registry *Registry
+
+	lock        sync.Mutex
+	sum         autofunc.Gradient
+	count       int
+	start       time.Time
+	round       int64
+	done        chan struct{}
+	contributed map[string]int64
+}
+
+// NewSyncRound creates a SyncRound which averages the
+// given number of gradients per step.
+// The registry may be nil, in which case every round
+// waits for the full number of gradients.
+func NewSyncRound(workers int, registry *Registry) *SyncRound {
+	return &SyncRound{
+		Workers:     workers,
+		Registry:    registry,
+		done:        make(chan struct{}),
+		contributed: map[string]int64{},
+	}
+}
+
+// Add adds a gradient from a worker to the round.
+// If the round is full, it returns the average gradient,
+// which should be applied before calling Finish.
+//
+// A second gradient from a worker in the same round is
+// discarded, since it was not computed from the round's
+// parameters.
+func (s *SyncRound) Add(worker string, g autofunc.Gradient) autofunc.Gradient {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if round, ok := s.contributed[worker]; ok && worker != "" && round == s.round {
+		log.Println("Discarding second gradient in synchronous round from", worker)
+		return nil
+	}
+	if s.sum == nil {
+		s.sum = g.Copy()
+		s.start = time.Now()
+	} else {
+		s.sum.Add(g)
+	}
+	s.count++
+	if worker != "" {
+		s.contributed[worker] = s.round
+	}
+	if s.count < s.size() {
+		return nil
+	}
+	s.sum.Scale(1 / float64(s.count))
+	return s.sum
+}
+
+// Flush returns the average gradient of a partial round
+// which should be applied early, either because workers
+// have left the registry since it started or because it
+// has been pending for SyncTimeout.
+// Otherwise, it returns nil.
+//
+// As with Add, the gradient should be applied before
+// calling Finish.
+func (s *SyncRound) Flush() autofunc.Gradient {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	if s.count < s.size() && time.Since(s.start) < SyncTimeout {
+		return nil
+	}
+	log.Printf("Applying synchronous round with %d gradients", s.count)
+	s.sum.Scale(1 / float64(s.count))
+	return s.sum
+}
+
+// Finish starts a new round, releasing the workers which
+// are waiting for the last one.
+func (s *SyncRound) Finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sum = nil
+	s.count = 0
+	s.round++
+	close(s.done)
+	s.done = make(chan struct{})
+}
+
+// size returns the number of gradients in a full round.
+func (s *SyncRound) size() int {
+	size := s.Workers
+	if s.Registry != nil {
+		if live := s.Registry.Live(); live < size {
+			size = live
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// Wait blocks while the worker has a gradient in the
+// pending round.
+// After it times out, the caller should Flush the round
+// before serving parameters, so that the worker's next
+// gradient starts a new round rather than being
+// discarded.
+func (s *SyncRound) Wait(worker string) {
+	s.lock.Lock()
+	round, ok := s.contributed[worker]
+	pending := ok && round == s.round && s.count > 0
+	done := s.done
+	s.lock.Unlock()
+	if !pending {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(SyncTimeout):
+		log.Println("Timed out waiting for synchronous round from", worker)
+	}
+}
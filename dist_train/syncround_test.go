@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestSyncRoundDistinctWorkers(t *testing.T) {
+	s := NewSyncRound(2, nil)
+	g := autofunc.Gradient{}
+	if s.Add("a", g) != nil {
+		t.Fatal("round finished after one gradient")
+	}
+	if s.Add("a", g) != nil {
+		t.Fatal("round finished with one worker")
+	}
+	if s.count != 1 {
+		t.Errorf("expected 1 gradient in round but got %d", s.count)
+	}
+	if s.Add("b", g) == nil {
+		t.Fatal("round did not finish with two workers")
+	}
+	s.Finish()
+	if s.Add("a", g) != nil || s.count != 1 {
+		t.Error("worker could not contribute to the next round")
+	}
+}
+
+func TestSyncRoundDeregister(t *testing.T) {
+	registry := NewRegistry(0)
+	for _, id := range []string{"a", "b", "c"} {
+		registry.Register(id)
+	}
+	s := NewSyncRound(3, registry)
+	v := &autofunc.Variable{Vector: linalg.Vector{0}}
+	if s.Add("a", autofunc.Gradient{v: linalg.Vector{1}}) != nil ||
+		s.Add("b", autofunc.Gradient{v: linalg.Vector{3}}) != nil {
+		t.Fatal("round finished before all live workers contributed")
+	}
+	if s.Flush() != nil {
+		t.Fatal("flushed a round which was still waiting for a live worker")
+	}
+
+	registry.workers["c"].LastHeartbeat = time.Now().Add(-2 * HeartbeatTimeout)
+	registry.Expire()
+	g := s.Flush()
+	if g == nil {
+		t.Fatal("round was not flushed after a worker left")
+	}
+	if g[v][0] != 2 {
+		t.Errorf("expected average 2 but got %f", g[v][0])
+	}
+	s.Finish()
+
+	if s.Add("a", autofunc.Gradient{v: linalg.Vector{1}}) != nil {
+		t.Fatal("round finished after one gradient")
+	}
+	if s.Add("b", autofunc.Gradient{v: linalg.Vector{1}}) == nil {
+		t.Error("round did not finish with both live workers")
+	}
+}
+
+func TestSyncRoundTimeout(t *testing.T) {
+	s := NewSyncRound(2, nil)
+	v := &autofunc.Variable{Vector: linalg.Vector{0}}
+	s.Add("a", autofunc.Gradient{v: linalg.Vector{1}})
+	if s.Flush() != nil {
+		t.Fatal("flushed a round before it timed out")
+	}
+	s.start = time.Now().Add(-SyncTimeout)
+	if g := s.Flush(); g == nil || g[v][0] != 1 {
+		t.Fatal("timed out round was not flushed")
+	}
+	s.Finish()
+	if s.Add("a", autofunc.Gradient{v: linalg.Vector{1}}) != nil || s.count != 1 {
+		t.Error("worker could not contribute after a timed out round")
+	}
+}
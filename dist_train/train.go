@@ -1,14 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
-	"net/url"
-	"time"
+	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/unixpickle/chatbot"
 	"github.com/unixpickle/sgd"
-	"github.com/unixpickle/sgd/asyncsgd"
 	"github.com/unixpickle/weakai/neuralnet"
 	"github.com/unixpickle/weakai/rnn"
 	"github.com/unixpickle/weakai/rnn/seqtoseq"
@@ -20,61 +22,224 @@ const (
 	SyncInterval   = 4
 )
 
-func Train(paramServer, sampleFile string) {
-	rand.Seed(time.Now().UnixNano())
+// Train runs a worker until it fails or stop is closed.
+//
+// Gradients are uploaded with the compression encoding,
+// or with the dense encoding if it is "".
+func Train(server *ServerClient, stop <-chan struct{}, sampleFiles []string,
+	loadOpts *chatbot.LoadOptions, compression *CompressOptions, temperature float64) error {
+	arch, err := fetchArchitecture(server)
+	if err != nil {
+		return fmt.Errorf("fetch architecture: %s", err)
+	}
+	bot := chatbot.NewBotArchitecture(arch)
+	bot.Dropout(true)
+	loadOpts.Arch = arch
 
-	log.Println("Loading samples...")
-	samples, err := chatbot.NewSampleSet(sampleFile, MaxBufferChars)
+	session, err := registerWorker(server, stop)
 	if err != nil {
-		die(err)
-	} else if samples.Len() == 0 {
-		die("no samples")
+		return fmt.Errorf("register: %s", err)
 	}
+	defer session.Close()
 
-	log.Println("Partitioning", samples.Len(), "samples...")
-	training, validation := sgd.HashSplit(samples, 0.9)
+	encoding := compression.Encoding
+	if encoding == "" {
+		encoding = EncodingDense
+	}
+	if err := checkEncoding(server, encoding); err != nil {
+		return fmt.Errorf("check encoding: %s", err)
+	}
+	opts := &CompressOptions{Encoding: encoding, TopK: compression.TopK}
+	for {
+		if session.Stopped() {
+			return nil
+		}
+		assignment := session.Assignment()
+		if assignment.NumShards > 0 && len(assignment.Shards) == 0 {
+			log.Println("No shards assigned; waiting for more shards...")
+			session.WaitReassigned()
+			continue
+		}
+		loadOpts.NumShards = assignment.NumShards
+		loadOpts.Shards = assignment.Shards
 
-	bot := chatbot.NewBot()
-	u, err := url.Parse(paramServer)
-	if err != nil {
-		die(err)
+		log.Println("Loading samples...")
+		if assignment.NumShards > 0 {
+			log.Printf("Using %d of %d shards", len(assignment.Shards), assignment.NumShards)
+		}
+		samples, err := chatbot.LoadWeightedSamples(sampleFiles, MaxBufferChars, loadOpts,
+			temperature)
+		if err != nil {
+			return err
+		} else if samples.Len() == 0 {
+			chatbot.CloseSamples(samples)
+			if assignment.NumShards == 0 {
+				return errors.New("no samples")
+			}
+			log.Println("No samples in shards; waiting for new shards...")
+			session.WaitReassigned()
+			continue
+		}
+
+		// Synchronous rounds only use a worker's first
+		// gradient after each fetch.
+		syncInterval := SyncInterval
+		if assignment.Synchronous {
+			syncInterval = 1
+		}
+		err = trainCompressed(server, bot, samples, session, opts, syncInterval)
+		chatbot.CloseSamples(samples)
+		if err == errReassigned {
+			log.Println("Shards reassigned; reloading samples...")
+			continue
+		} else if err == errStopped {
+			return nil
+		}
+		return fmt.Errorf("training: %s", err)
 	}
-	bot.Dropout(true)
+}
 
-	client := &asyncsgd.ParamClient{
-		BaseURL: u,
+// trainCompressed trains on some samples until the
+// worker's shards are reassigned, the worker is stopped,
+// or an error occurs.
+// Parameters are fetched every syncInterval batches, and
+// gradients are uploaded with the given encoding.
+//
+// The gradients between parameter fetches are computed
+// from the last fetched parameters.
+func trainCompressed(server *ServerClient, bot *chatbot.Bot, samples sgd.SampleSet,
+	session *workerSession, compression *CompressOptions, syncInterval int) error {
+	log.Println("Partitioning", samples.Len(), "samples...")
+	training, validation := chatbot.HashSplit(samples, 0.9)
+	if training.Len() == 0 {
+		return errors.New("no training samples")
 	}
+
 	params := bot.Block.(sgd.Learner).Parameters()
-	costFunc := neuralnet.DotCost{}
 	grad := &seqtoseq.Gradienter{
 		SeqFunc:  &rnn.BlockSeqFunc{B: bot.Block},
 		Learner:  bot.Block.(sgd.Learner),
-		CostFunc: costFunc,
-	}
-
-	var iteration int
-	slave := asyncsgd.NewSlave(grad, training, BatchSize, client, params)
-	slave.Sync()
-	err = slave.Loop(SyncInterval, func(next, last sgd.SampleSet) {
-		if iteration%4 == 0 {
-			bot.Dropout(false)
-			defer bot.Dropout(true)
-			var lastCost float64
-			if last != nil {
-				lastCost = seqtoseq.TotalCostBlock(bot.Block, BatchSize, last, costFunc)
+		CostFunc: neuralnet.DotCost{},
+	}
+	compressor := &GradientCompressor{
+		Encoding: compression.Encoding,
+		Params:   params,
+		TopK:     compression.TopK,
+	}
+	logger := &costLogger{bot: bot, validation: validation, session: session}
+
+	var last sgd.SampleSet
+	var batchStart int
+	var uploaded int64
+	for iteration := 0; ; iteration++ {
+		if err := session.Interrupted(); err != nil {
+			return err
+		}
+		if iteration%syncInterval == 0 {
+			if err := fetchParams(server, params); err != nil {
+				return err
 			}
-			newCost := seqtoseq.TotalCostBlock(bot.Block, BatchSize, next, costFunc)
+		}
+		if batchStart == 0 {
+			chatbot.ShuffleEpoch(training)
+		}
+		batchEnd := batchStart + BatchSize
+		if batchEnd > training.Len() {
+			batchEnd = training.Len()
+		}
+		next := training.Subset(batchStart, batchEnd)
+		batchStart = batchEnd % training.Len()
+
+		logger.Step(next, last)
+		last = next
 
-			sgd.ShuffleSampleSet(validation)
-			validationCost := seqtoseq.TotalCostBlock(bot.Block, BatchSize,
-				validation.Subset(0, BatchSize), costFunc)
+		data, err := compressor.Encode(grad.Gradient(next))
+		if err != nil {
+			return err
+		}
+		if err := uploadGradient(server, compression.Encoding, data); err != nil {
+			return err
+		}
+		uploaded += int64(len(data))
+		if iteration%100 == 0 {
+			log.Printf("uploaded %d bytes per update", uploaded/int64(iteration+1))
+		}
+	}
+}
+
+// costLogger periodically logs and reports the cost of
+// the batches a worker trains on.
+type costLogger struct {
+	bot        *chatbot.Bot
+	validation sgd.SampleSet
+	session    *workerSession
+	iteration  int
+}
+
+// Step is called before each batch is trained on.
+func (c *costLogger) Step(next, last sgd.SampleSet) {
+	defer func() {
+		c.iteration++
+	}()
+	if c.iteration%4 != 0 {
+		return
+	}
+	c.bot.Dropout(false)
+	defer c.bot.Dropout(true)
+	costFunc := neuralnet.DotCost{}
+	var lastCost float64
+	if last != nil {
+		lastCost = seqtoseq.TotalCostBlock(c.bot.Block, BatchSize, last, costFunc)
+	}
+	newCost := seqtoseq.TotalCostBlock(c.bot.Block, BatchSize, next, costFunc)
 
-			log.Printf("iter %d: validation=%f cost=%f last=%f", iteration, validationCost,
-				newCost, lastCost)
+	var validationCost float64
+	if c.validation.Len() > 0 {
+		sgd.ShuffleSampleSet(c.validation)
+		n := BatchSize
+		if n > c.validation.Len() {
+			n = c.validation.Len()
 		}
-		iteration++
-	})
+		validationCost = seqtoseq.TotalCostBlock(c.bot.Block, BatchSize,
+			c.validation.Subset(0, n), costFunc)
+	}
+
+	log.Printf("iter %d: validation=%f cost=%f last=%f", c.iteration, validationCost,
+		newCost, lastCost)
+	c.session.ReportCosts(newCost, validationCost)
+}
+
+// errReassigned stops training when the worker's shards
+// are reassigned.
+var errReassigned = errors.New("shards reassigned")
+
+// errStopped stops training when the worker is stopped.
+var errStopped = errors.New("worker stopped")
+
+func fetchArchitecture(server *ServerClient) (*chatbot.Architecture, error) {
+	resp, err := server.Get("/architecture")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var arch chatbot.Architecture
+	if err := json.NewDecoder(resp.Body).Decode(&arch); err != nil {
+		return nil, err
+	}
+	if err := arch.Validate(); err != nil {
+		return nil, err
+	}
+	return &arch, nil
+}
+
+// defaultWorkerID identifies this process to the server.
+func defaultWorkerID() string {
+	host, err := os.Hostname()
 	if err != nil {
-		die("Training error:", err)
+		host = "unknown"
 	}
+	return host + ":" + strconv.Itoa(os.Getpid())
 }
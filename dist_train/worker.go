@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// errNotRegistered is returned by heartbeats when the
+// server has forgotten the worker.
+var errNotRegistered = errors.New("worker not registered")
+
+// A workerSession keeps a worker registered with the
+// server and tracks the worker's shard assignment.
+type workerSession struct {
+	ID     string
+	Server *ServerClient
+
+	lock       sync.Mutex
+	assignment ShardAssignment
+	changed    bool
+	costs      Heartbeat
+	stop       <-chan struct{}
+	closed     chan struct{}
+}
+
+// registerWorker registers with the server and starts
+// sending heartbeats in the background until the session
+// is closed.
+// The worker is stopped when stop is closed.
+func registerWorker(server *ServerClient, stop <-chan struct{}) (*workerSession, error) {
+	id := server.WorkerID
+	w := &workerSession{ID: id, Server: server, stop: stop, closed: make(chan struct{})}
+	if err := postJSON(server, "/register", &Heartbeat{WorkerID: id}, &w.assignment); err != nil {
+		return nil, err
+	}
+	go w.heartbeatLoop()
+	return w, nil
+}
+
+// Close stops sending heartbeats.
+func (w *workerSession) Close() {
+	close(w.closed)
+}
+
+// Assignment returns the current shard assignment and
+// clears the reassignment flag.
+func (w *workerSession) Assignment() ShardAssignment {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.changed = false
+	return w.assignment
+}
+
+// Reassigned checks if the assignment has changed since
+// it was last fetched.
+func (w *workerSession) Reassigned() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.changed
+}
+
+// Stopped checks if the worker has been stopped.
+func (w *workerSession) Stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Interrupted returns errStopped if the worker has been
+// stopped, or errReassigned if the assignment has changed
+// since it was last fetched.
+func (w *workerSession) Interrupted() error {
+	if w.Stopped() {
+		return errStopped
+	} else if w.Reassigned() {
+		return errReassigned
+	}
+	return nil
+}
+
+// WaitReassigned blocks until the assignment changes or
+// the worker is stopped.
+func (w *workerSession) WaitReassigned() {
+	for !w.Reassigned() && !w.Stopped() {
+		time.Sleep(time.Second)
+	}
+}
+
+// ReportCosts sets the costs for the next heartbeat.
+func (w *workerSession) ReportCosts(cost, validation float64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.costs.Cost = cost
+	w.costs.Validation = validation
+}
+
+func (w *workerSession) heartbeatLoop() {
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+		w.lock.Lock()
+		hb := w.costs
+		w.lock.Unlock()
+		hb.WorkerID = w.ID
+
+		var assignment ShardAssignment
+		err := postJSON(w.Server, "/heartbeat", &hb, &assignment)
+		if err == errNotRegistered {
+			log.Println("Server forgot worker; registering again...")
+			err = postJSON(w.Server, "/register", &hb, &assignment)
+		}
+		if err != nil {
+			log.Println("Heartbeat failed:", err)
+			continue
+		}
+
+		w.lock.Lock()
+		if !reflect.DeepEqual(assignment, w.assignment) {
+			w.assignment = assignment
+			w.changed = true
+		}
+		w.lock.Unlock()
+	}
+}
+
+func postJSON(server *ServerClient, path string, req, resp interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := server.Post(path, "application/json", data, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusNotFound && path == "/heartbeat" {
+		return errNotRegistered
+	} else if r.StatusCode != http.StatusOK {
+		return errors.New(r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
@@ -0,0 +1,75 @@
+package chatbot
+
+import (
+	"math/rand"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/neuralstruct"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn"
+)
+
+// DropoutBlock returns a block which shares the bot's
+// layers and parameters, but draws its dropout masks from
+// r instead of the global random source.
+//
+// Gradients computed concurrently with separate blocks
+// from DropoutBlock do not depend on how the goroutines
+// are scheduled, so training with a fixed seed can be
+// reproduced.
+// Dropout is still turned on and off with b.Dropout.
+func (b *Bot) DropoutBlock(r *rand.Rand) rnn.Block {
+	structBlock, ok := b.Block.(*neuralstruct.Block)
+	if !ok {
+		return b.Block
+	}
+	sb := structBlock.Block.(rnn.StackedBlock)
+	res := make(rnn.StackedBlock, len(sb))
+	for i, x := range sb {
+		res[i] = x
+		if n, ok := x.(*rnn.NetworkBlock); ok {
+			net := n.Network()
+			if len(net) == 1 {
+				if do, ok := net[0].(*neuralnet.DropoutLayer); ok {
+					layer := &seededDropout{DropoutLayer: do, Rand: r}
+					res[i] = rnn.NewNetworkBlock(neuralnet.Network{layer}, 0)
+				}
+			}
+		}
+	}
+	return &neuralstruct.Block{Block: res, Struct: structBlock.Struct}
+}
+
+// seededDropout is a dropout layer which draws its masks
+// from its own random source.
+type seededDropout struct {
+	*neuralnet.DropoutLayer
+	Rand *rand.Rand
+}
+
+// Apply applies the layer to an input.
+func (s *seededDropout) Apply(in autofunc.Result) autofunc.Result {
+	if !s.Training {
+		return s.DropoutLayer.Apply(in)
+	}
+	return autofunc.Mul(in, s.mask(len(in.Output())))
+}
+
+// ApplyR applies the layer to an input.
+func (s *seededDropout) ApplyR(v autofunc.RVector, in autofunc.RResult) autofunc.RResult {
+	if !s.Training {
+		return s.DropoutLayer.ApplyR(v, in)
+	}
+	return autofunc.MulR(in, autofunc.NewRVariable(s.mask(len(in.Output())), v))
+}
+
+func (s *seededDropout) mask(size int) *autofunc.Variable {
+	res := make(linalg.Vector, size)
+	for i := range res {
+		if s.Rand.Float64() < s.KeepProbability {
+			res[i] = 1
+		}
+	}
+	return &autofunc.Variable{Vector: res}
+}
@@ -0,0 +1,225 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	var e EmbeddingLayer
+	serializer.RegisterTypedDeserializer(e.SerializerType(),
+		func(d []byte) (serializer.Serializer, error) {
+			return DeserializeEmbeddingLayer(d)
+		})
+}
+
+// An EmbeddingLayer maps token indices to learned
+// vectors.
+//
+// The first component of an input vector is the index of
+// a token, which is replaced by the token's embedding in
+// the output.
+// Any other input components are passed through as-is,
+// so that extra inputs (e.g. from a neuralstruct.Block)
+// may follow the token index.
+type EmbeddingLayer struct {
+	TokenCount int
+	Size       int
+
+	// Vectors stores the embeddings one after another.
+	Vectors *autofunc.Variable
+}
+
+// NewEmbeddingLayer creates an EmbeddingLayer with random
+// embeddings.
+func NewEmbeddingLayer(tokenCount, size int) *EmbeddingLayer {
+	res := &EmbeddingLayer{
+		TokenCount: tokenCount,
+		Size:       size,
+		Vectors:    &autofunc.Variable{Vector: make(linalg.Vector, tokenCount*size)},
+	}
+	for i := range res.Vectors.Vector {
+		res.Vectors.Vector[i] = rand.NormFloat64()
+	}
+	return res
+}
+
+// DeserializeEmbeddingLayer deserializes an
+// EmbeddingLayer.
+// It fails if the embeddings do not match the layer's
+// dimensions.
+func DeserializeEmbeddingLayer(d []byte) (*EmbeddingLayer, error) {
+	var obj struct {
+		TokenCount int
+		Size       int
+		Vectors    []float64
+	}
+	if err := json.Unmarshal(d, &obj); err != nil {
+		return nil, err
+	}
+	if obj.TokenCount <= 0 || obj.Size <= 0 {
+		return nil, errors.New("embedding layer has non-positive dimensions")
+	}
+	if len(obj.Vectors) != obj.TokenCount*obj.Size {
+		return nil, fmt.Errorf("embedding layer has %d values but expected %d (%d tokens of size %d)",
+			len(obj.Vectors), obj.TokenCount*obj.Size, obj.TokenCount, obj.Size)
+	}
+	return &EmbeddingLayer{
+		TokenCount: obj.TokenCount,
+		Size:       obj.Size,
+		Vectors:    &autofunc.Variable{Vector: obj.Vectors},
+	}, nil
+}
+
+// Apply applies the layer to an input.
+//
+// It panics if the input's token index is not an index
+// into the embeddings.
+func (e *EmbeddingLayer) Apply(in autofunc.Result) autofunc.Result {
+	token := e.token(in.Output())
+	return &embeddingResult{
+		Layer:     e,
+		Input:     in,
+		Token:     token,
+		OutputVec: e.output(token, in.Output(), e.Vectors.Vector),
+	}
+}
+
+// ApplyR applies the layer to an input.
+// Like Apply, it panics for bad token indices.
+func (e *EmbeddingLayer) ApplyR(rv autofunc.RVector, in autofunc.RResult) autofunc.RResult {
+	rVectors := rv[e.Vectors]
+	if rVectors == nil {
+		rVectors = make(linalg.Vector, len(e.Vectors.Vector))
+	}
+	token := e.token(in.Output())
+	return &embeddingRResult{
+		Layer:      e,
+		Input:      in,
+		Token:      token,
+		OutputVec:  e.output(token, in.Output(), e.Vectors.Vector),
+		ROutputVec: e.output(token, in.ROutput(), rVectors),
+	}
+}
+
+// Parameters returns the embedding variable.
+func (e *EmbeddingLayer) Parameters() []*autofunc.Variable {
+	return []*autofunc.Variable{e.Vectors}
+}
+
+// SerializerType returns the unique ID used to serialize
+// EmbeddingLayers with the serializer package.
+func (e *EmbeddingLayer) SerializerType() string {
+	return "github.com/unixpickle/chatbot.EmbeddingLayer"
+}
+
+// Serialize serializes the layer.
+func (e *EmbeddingLayer) Serialize() ([]byte, error) {
+	return json.Marshal(struct {
+		TokenCount int
+		Size       int
+		Vectors    []float64
+	}{e.TokenCount, e.Size, e.Vectors.Vector})
+}
+
+// token reads the token index from an input vector.
+func (e *EmbeddingLayer) token(in linalg.Vector) int {
+	x := in[0]
+	if !(x >= 0 && x < float64(e.TokenCount)) {
+		panic(fmt.Sprintf("embedding layer: token %v out of range [0, %d)", x, e.TokenCount))
+	}
+	return int(x)
+}
+
+// output concatenates the row of vecs for a token with
+// all but the first input component.
+func (e *EmbeddingLayer) output(token int, in, vecs linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, e.Size+len(in)-1)
+	copy(res, vecs[token*e.Size:(token+1)*e.Size])
+	copy(res[e.Size:], in[1:])
+	return res
+}
+
+// upstreamRow adds the embedding portion of an upstream
+// vector to a gradient for the embeddings.
+func (e *EmbeddingLayer) upstreamRow(grad linalg.Vector, token int, upstream linalg.Vector) {
+	row := grad[token*e.Size : (token+1)*e.Size]
+	for i, x := range upstream[:e.Size] {
+		row[i] += x
+	}
+}
+
+// upstreamInput converts an upstream vector to a gradient
+// for the layer's input.
+func (e *EmbeddingLayer) upstreamInput(upstream linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, len(upstream)-e.Size+1)
+	copy(res[1:], upstream[e.Size:])
+	return res
+}
+
+type embeddingResult struct {
+	Layer     *EmbeddingLayer
+	Input     autofunc.Result
+	Token     int
+	OutputVec linalg.Vector
+}
+
+func (e *embeddingResult) Output() linalg.Vector {
+	return e.OutputVec
+}
+
+func (e *embeddingResult) Constant(g autofunc.Gradient) bool {
+	_, ok := g[e.Layer.Vectors]
+	return !ok && e.Input.Constant(g)
+}
+
+func (e *embeddingResult) PropagateGradient(upstream linalg.Vector, g autofunc.Gradient) {
+	if grad, ok := g[e.Layer.Vectors]; ok {
+		e.Layer.upstreamRow(grad, e.Token, upstream)
+	}
+	if !e.Input.Constant(g) {
+		e.Input.PropagateGradient(e.Layer.upstreamInput(upstream), g)
+	}
+}
+
+type embeddingRResult struct {
+	Layer      *EmbeddingLayer
+	Input      autofunc.RResult
+	Token      int
+	OutputVec  linalg.Vector
+	ROutputVec linalg.Vector
+}
+
+func (e *embeddingRResult) Output() linalg.Vector {
+	return e.OutputVec
+}
+
+func (e *embeddingRResult) ROutput() linalg.Vector {
+	return e.ROutputVec
+}
+
+func (e *embeddingRResult) Constant(rg autofunc.RGradient, g autofunc.Gradient) bool {
+	_, ok := g[e.Layer.Vectors]
+	_, rok := rg[e.Layer.Vectors]
+	return !ok && !rok && e.Input.Constant(rg, g)
+}
+
+func (e *embeddingRResult) PropagateRGradient(upstream, upstreamR linalg.Vector,
+	rg autofunc.RGradient, g autofunc.Gradient) {
+	if grad, ok := g[e.Layer.Vectors]; ok {
+		e.Layer.upstreamRow(grad, e.Token, upstream)
+	}
+	if grad, ok := rg[e.Layer.Vectors]; ok {
+		e.Layer.upstreamRow(grad, e.Token, upstreamR)
+	}
+	if !e.Input.Constant(rg, g) {
+		e.Input.PropagateRGradient(e.Layer.upstreamInput(upstream),
+			e.Layer.upstreamInput(upstreamR), rg, g)
+	}
+}
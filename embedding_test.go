@@ -0,0 +1,185 @@
+package chatbot
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+const (
+	gradCheckDelta = 1e-5
+	gradCheckPrec  = 1e-5
+)
+
+func TestEmbeddingLayerGradient(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	layer, input, vars := testEmbeddingLayer(gen)
+	upstream := randomVector(gen, layer.Size+len(input.Vector)-1)
+
+	grad := autofunc.NewGradient(vars)
+	layer.Apply(input).PropagateGradient(upstream, grad)
+
+	cost := func() float64 {
+		return layer.Apply(input).Output().Dot(upstream)
+	}
+	for _, v := range vars {
+		for i := range v.Vector {
+			if v == input && i == 0 {
+				// The token index has no gradient.
+				continue
+			}
+			checkPartial(t, v, i, grad[v][i], cost)
+		}
+	}
+	if grad[input][0] != 0 {
+		t.Errorf("token index has gradient %f", grad[input][0])
+	}
+}
+
+func TestEmbeddingLayerRGradient(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	layer, input, vars := testEmbeddingLayer(gen)
+	outSize := layer.Size + len(input.Vector) - 1
+	upstream := randomVector(gen, outSize)
+	upstreamR := randomVector(gen, outSize)
+	rv := autofunc.RVector{}
+	for _, v := range vars {
+		rv[v] = randomVector(gen, len(v.Vector))
+	}
+	rv[input][0] = 0
+
+	out := layer.ApplyR(rv, autofunc.NewRVariable(input, rv))
+	if !vectorsClose(out.Output(), layer.Apply(input).Output()) {
+		t.Error("ApplyR output differs from Apply output")
+	}
+
+	// The output is linear in the embeddings and the extra
+	// inputs, so its R-output is the output for the R
+	// vector itself.
+	expectedR := layer.output(int(input.Vector[0]), rv[input], rv[layer.Vectors])
+	if !vectorsClose(out.ROutput(), expectedR) {
+		t.Errorf("expected R-output %v but got %v", expectedR, out.ROutput())
+	}
+
+	grad := autofunc.NewGradient(vars)
+	rgrad := autofunc.NewRGradient(vars)
+	out.PropagateRGradient(upstream, upstreamR, rgrad, grad)
+
+	// Likewise, the R-gradient is the gradient of the
+	// R-upstream, and the gradient matches Apply.
+	expectedGrad := autofunc.NewGradient(vars)
+	layer.Apply(input).PropagateGradient(upstream, expectedGrad)
+	expectedRGrad := autofunc.NewGradient(vars)
+	layer.Apply(input).PropagateGradient(upstreamR, expectedRGrad)
+	for _, v := range vars {
+		if !vectorsClose(grad[v], expectedGrad[v]) {
+			t.Errorf("expected gradient %v but got %v", expectedGrad[v], grad[v])
+		}
+		if !vectorsClose(rgrad[v], expectedRGrad[v]) {
+			t.Errorf("expected R-gradient %v but got %v", expectedRGrad[v], rgrad[v])
+		}
+	}
+}
+
+func TestDeserializeEmbeddingLayer(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	layer, _, _ := testEmbeddingLayer(gen)
+	data, err := layer.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeEmbeddingLayer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TokenCount != layer.TokenCount || decoded.Size != layer.Size ||
+		!vectorsClose(decoded.Vectors.Vector, layer.Vectors.Vector) {
+		t.Error("decoded layer differs from original")
+	}
+
+	for _, bad := range []string{
+		`{"TokenCount": 5, "Size": 3, "Vectors": [1, 2, 3]}`,
+		`{"TokenCount": 0, "Size": 3, "Vectors": []}`,
+		`{"TokenCount": -1, "Size": -3, "Vectors": [1, 2, 3]}`,
+		`{"TokenCount": 1, "Size": 0, "Vectors": []}`,
+	} {
+		if _, err := DeserializeEmbeddingLayer([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func TestEmbeddingLayerBadToken(t *testing.T) {
+	gen := rand.New(rand.NewSource(1337))
+	layer, _, _ := testEmbeddingLayer(gen)
+	for _, token := range []float64{-1, 5, 100, math.NaN()} {
+		input := &autofunc.Variable{Vector: linalg.Vector{token, 0.5, -0.3}}
+		rv := autofunc.RVector{}
+		for name, apply := range map[string]func(){
+			"Apply": func() { layer.Apply(input) },
+			"ApplyR": func() {
+				layer.ApplyR(rv, autofunc.NewRVariable(input, rv))
+			},
+		} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s: expected a panic for token %v", name, token)
+					}
+				}()
+				apply()
+			}()
+		}
+	}
+}
+
+func testEmbeddingLayer(gen *rand.Rand) (*EmbeddingLayer, *autofunc.Variable,
+	[]*autofunc.Variable) {
+	layer := &EmbeddingLayer{
+		TokenCount: 5,
+		Size:       3,
+		Vectors:    &autofunc.Variable{Vector: randomVector(gen, 15)},
+	}
+	input := &autofunc.Variable{Vector: linalg.Vector{2, 0.5, -0.3}}
+	return layer, input, []*autofunc.Variable{layer.Vectors, input}
+}
+
+// checkPartial compares one partial derivative of a cost
+// function against a central finite difference.
+func checkPartial(t *testing.T, v *autofunc.Variable, idx int, actual float64,
+	cost func() float64) {
+	old := v.Vector[idx]
+	v.Vector[idx] = old + gradCheckDelta
+	plus := cost()
+	v.Vector[idx] = old - gradCheckDelta
+	minus := cost()
+	v.Vector[idx] = old
+	expected := (plus - minus) / (2 * gradCheckDelta)
+	if math.Abs(expected-actual) > gradCheckPrec*math.Max(1, math.Abs(expected)) {
+		t.Errorf("partial %d of %d-dim variable: expected %f but got %f", idx,
+			len(v.Vector), expected, actual)
+	}
+}
+
+func vectorsClose(v1, v2 linalg.Vector) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i, x := range v1 {
+		if math.Abs(x-v2[i]) > gradCheckPrec*math.Max(1, math.Abs(x)) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomVector(gen *rand.Rand, size int) linalg.Vector {
+	res := make(linalg.Vector, size)
+	for i := range res {
+		res[i] = gen.NormFloat64()
+	}
+	return res
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"time"
@@ -22,15 +23,25 @@ const (
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, "Usage: facebook <bot_file> <fb_username>")
+	persona := flag.String("persona", "", "persona for the bot to speak as")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: facebook [flags] <bot_file> <fb_username>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	bot, err := chatbot.LoadBot(os.Args[1])
+	bot, err := chatbot.LoadBot(flag.Arg(0))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to load bot:", err)
 		os.Exit(1)
 	}
+	if *persona != "" && bot.Arch.PersonaIndex(*persona) < 0 {
+		fmt.Fprintln(os.Stderr, "Unknown persona:", *persona)
+		os.Exit(1)
+	}
 
 	fmt.Print("FB password: ")
 	passwd, err := gopass.GetPasswd()
@@ -39,23 +50,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	sess, err := fbmsgr.Auth(os.Args[2], string(passwd))
+	sess, err := fbmsgr.Auth(flag.Arg(1), string(passwd))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Could not authenticate:", err)
 		os.Exit(1)
 	}
 
-	messageLoop(sess, bot)
+	messageLoop(sess, bot, *persona)
 }
 
-func messageLoop(sess *fbmsgr.Session, bot *chatbot.Bot) {
-	chats := map[string]chan<- fbmsgr.Event{}
+func messageLoop(sess *fbmsgr.Session, bot *chatbot.Bot, persona string) {
+	chats := map[string]chan<- timedEvent{}
 	for {
 		event, err := sess.ReadEvent()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error reading event:", err)
 			os.Exit(1)
 		}
+		eventTime := time.Now()
 		var threadID string
 		var group bool
 		switch event := event.(type) {
@@ -81,22 +93,33 @@ func messageLoop(sess *fbmsgr.Session, bot *chatbot.Bot) {
 		if threadID != "" {
 			ch := chats[threadID]
 			if ch == nil {
-				newChan := make(chan fbmsgr.Event, 10)
+				newChan := make(chan timedEvent, 10)
 				chats[threadID] = newChan
-				go handleThread(threadID, group, newChan, sess, bot)
+				go handleThread(threadID, group, newChan, sess, bot, persona)
 				ch = newChan
 			}
-			ch <- event
+			ch <- timedEvent{Event: event, Time: eventTime}
 		}
 	}
 }
 
-func handleThread(thread string, group bool, events <-chan fbmsgr.Event, sess *fbmsgr.Session,
-	bot *chatbot.Bot) {
-	chat := chatbot.NewChat(bot)
+// A timedEvent is an event with the time at which it was
+// read.
+// Messages are given this time rather than the time they
+// are handled, since a thread may not handle a message
+// until the bot finishes replying.
+type timedEvent struct {
+	Event fbmsgr.Event
+	Time  time.Time
+}
+
+func handleThread(thread string, group bool, events <-chan timedEvent, sess *fbmsgr.Session,
+	bot *chatbot.Bot, persona string) {
+	chat := chatbot.NewChat(bot, persona)
+	speakers := map[string]int{}
 
 	state := WaitingForHuman
-	readHistory(thread, sess, chat)
+	readHistory(thread, sess, chat, speakers)
 
 	var noResponseCount int
 	for {
@@ -109,12 +132,12 @@ func handleThread(thread string, group bool, events <-chan fbmsgr.Event, sess *f
 					sendTyping(sess, thread, group, true)
 				}
 			case e := <-events:
-				if startedTyping(e) {
+				if startedTyping(e.Event) {
 					state = HumanTyping
-				} else if msg := eventMessage(e); msg != "" {
+				} else if msg := eventMessage(e.Event); msg != "" {
 					noResponseCount = 0
-					markMessageRead(sess, e)
-					if chat.Send(msg) {
+					markMessageRead(sess, e.Event)
+					if chat.SendAt(speakerIndex(speakers, eventSender(e.Event)), msg, e.Time) {
 						state = WaitingForHuman
 					} else {
 						state = BotTyping
@@ -136,11 +159,11 @@ func handleThread(thread string, group bool, events <-chan fbmsgr.Event, sess *f
 					state = WaitingForHuman
 				}
 			case e := <-events:
-				if startedTyping(e) {
+				if startedTyping(e.Event) {
 					sendTyping(sess, thread, group, false)
 					state = HumanTyping
-				} else if msg := eventMessage(e); msg != "" {
-					if chat.Send(msg) {
+				} else if msg := eventMessage(e.Event); msg != "" {
+					if chat.SendAt(speakerIndex(speakers, eventSender(e.Event)), msg, e.Time) {
 						state = WaitingForHuman
 						sendTyping(sess, thread, group, false)
 					}
@@ -148,12 +171,12 @@ func handleThread(thread string, group bool, events <-chan fbmsgr.Event, sess *f
 			}
 		case HumanTyping:
 			e := <-events
-			if stoppedTyping(e) {
+			if stoppedTyping(e.Event) {
 				state = WaitingForHuman
-			} else if msg := eventMessage(e); msg != "" {
-				markMessageRead(sess, e)
+			} else if msg := eventMessage(e.Event); msg != "" {
+				markMessageRead(sess, e.Event)
 				noResponseCount = 0
-				if chat.Send(msg) {
+				if chat.SendAt(speakerIndex(speakers, eventSender(e.Event)), msg, e.Time) {
 					state = WaitingForHuman
 				} else {
 					state = BotTyping
@@ -164,7 +187,8 @@ func handleThread(thread string, group bool, events <-chan fbmsgr.Event, sess *f
 	}
 }
 
-func readHistory(threadID string, sess *fbmsgr.Session, chat *chatbot.Chat) (shouldSend bool) {
+func readHistory(threadID string, sess *fbmsgr.Session, chat *chatbot.Chat,
+	speakers map[string]int) (shouldSend bool) {
 	history, err := sess.ActionLog(threadID, time.Time{}, 0, 20)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "List actions:", err)
@@ -174,9 +198,10 @@ func readHistory(threadID string, sess *fbmsgr.Session, chat *chatbot.Chat) (sho
 		if msg, ok := action.(*fbmsgr.MessageAction); ok {
 			if msg.Body != "" {
 				if msg.AuthorFBID() == sess.FBID() {
-					shouldSend = chat.ReceiveMessage(msg.Body)
+					shouldSend = chat.ReceiveMessageAt(msg.Body, msg.ActionTime())
 				} else {
-					shouldSend = !chat.Send(msg.Body)
+					speaker := speakerIndex(speakers, msg.AuthorFBID())
+					shouldSend = !chat.SendAt(speaker, msg.Body, msg.ActionTime())
 				}
 			}
 		}
@@ -208,6 +233,25 @@ func eventMessage(e fbmsgr.Event) string {
 	return ""
 }
 
+func eventSender(e fbmsgr.Event) string {
+	if evt, ok := e.(fbmsgr.MessageEvent); ok {
+		return evt.SenderFBID
+	}
+	return ""
+}
+
+// speakerIndex numbers the other people in a thread in
+// the order that they are seen, so that the bot can tell
+// them apart in group threads.
+func speakerIndex(speakers map[string]int, fbid string) int {
+	if idx, ok := speakers[fbid]; ok {
+		return idx
+	}
+	idx := len(speakers)
+	speakers[fbid] = idx
+	return idx
+}
+
 func markMessageRead(sess *fbmsgr.Session, e fbmsgr.Event) {
 	msg := e.(fbmsgr.MessageEvent)
 	if msg.GroupThread != "" {
@@ -0,0 +1,634 @@
+package chatbot
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/unixpickle/sgd"
+)
+
+// LoadOptions controls which files are read when a
+// sample set is loaded from a directory, and how errors
+// in those files are handled.
+type LoadOptions struct {
+	// Recursive causes subdirectories to be searched for
+	// conversation files.
+	// If it is false, subdirectories are ignored.
+	Recursive bool
+
+	// Include, if non-empty, is a list of glob patterns.
+	// Only files matching at least one pattern are read.
+	// If it is empty, only files ending in ".csv", ".json",
+	// or ".srt" and files without extensions, which are
+	// read as CSV, are read from directories (possibly
+	// compressed), and other files are reported to Warn.
+	//
+	// Patterns are matched against both the file name and
+	// the path relative to the loaded directory.
+	Include []string
+
+	// Exclude is a list of glob patterns for files and
+	// directories which should not be read.
+	// It takes precedence over Include.
+	Exclude []string
+
+	// SkipBadFiles causes files which cannot be read to be
+	// skipped rather than failing the entire load.
+	SkipBadFiles bool
+
+	// Warn is called with the error for every file that
+	// is skipped because of SkipBadFiles, and for files
+	// skipped because they lack a conversation extension.
+	// If it is nil, warnings are written to the standard
+	// logger.
+	Warn func(err error)
+
+	// Preprocessor, if non-nil, is applied to every message
+	// before samples are generated.
+	Preprocessor Preprocessor
+
+	// Dedup, if non-nil, removes duplicate conversations
+	// and stops duplicate messages from being trained on
+	// after they are preprocessed.
+	Dedup *Deduplicator
+
+	// Arch is the architecture of the Bot which the samples
+	// will be used with.
+	// It determines how the samples are encoded, and
+	// loading fails if the samples, Persona, or Tagger use
+	// labels which it does not have.
+	Arch *Architecture
+
+	// Persona is the persona label for conversations which
+	// do not specify one.
+	Persona string
+
+	// Tagger, if non-nil, adds attributes to every message
+	// after it is preprocessed.
+	Tagger AttributeTagger
+
+	// Snippets controls how training snippets are
+	// generated from the conversations.
+	Snippets SnippetOptions
+
+	// Lazy causes LoadSamples to produce a DiskSampleSet
+	// instead of loading every conversation into memory.
+	Lazy bool
+
+	// NumShards, if non-zero, splits the conversations
+	// into shards by a hash of their messages, and only
+	// the conversations in the listed Shards are loaded.
+	// Sample caches are split by the index of each
+	// conversation instead, since a cache stores
+	// conversations after they are preprocessed.
+	NumShards int
+	Shards    []int
+}
+
+// LoadSamples loads a sample set from a path.
+//
+// If the path is a cache file from WriteSampleCache, the
+// result is a *CacheSampleSet, which should be closed when
+// it is no longer needed.
+// Since a cache stores conversations after they are
+// preprocessed, deduplicated, tagged, and split into
+// snippets, it is an error for opts to set any options
+// for those steps.
+// Otherwise, if opts.Lazy is set, the result is a
+// *DiskSampleSet, and if not, it is a *SampleSet.
+func LoadSamples(path string, maxBuffer int, opts *LoadOptions) (sgd.SampleSet, error) {
+	if IsSampleCache(path) {
+		if opts != nil {
+			if err := opts.checkCacheOptions(); err != nil {
+				return nil, fmt.Errorf("load %s: %s", path, err)
+			}
+		}
+		res, err := OpenCacheSampleSet(path, maxBuffer)
+		if err != nil {
+			return nil, err
+		}
+		if opts != nil {
+			if err := res.cache.checkLabels(opts); err != nil {
+				res.Close()
+				return nil, fmt.Errorf("load %s: %s", path, err)
+			}
+			res.arch = opts.Arch
+			if opts.NumShards > 0 {
+				res.indices = res.cache.shard(opts.NumShards, opts.Shards)
+			}
+		}
+		return res, nil
+	} else if opts != nil && opts.Lazy {
+		return NewDiskSampleSet(path, maxBuffer, opts)
+	}
+	return NewSampleSetOptions(path, maxBuffer, opts)
+}
+
+// checkCacheOptions makes sure that none of the options
+// which are applied when a cache is written are set.
+func (l *LoadOptions) checkCacheOptions() error {
+	var names []string
+	if l.Preprocessor != nil {
+		names = append(names, "Preprocessor")
+	}
+	if l.Dedup != nil {
+		names = append(names, "Dedup")
+	}
+	if l.Persona != "" {
+		names = append(names, "Persona")
+	}
+	if l.Tagger != nil {
+		names = append(names, "Tagger")
+	}
+	if l.Snippets != (SnippetOptions{}) {
+		names = append(names, "Snippets")
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("cannot apply %s to a sample cache (pass them when writing it)",
+			strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// NewSampleSetOptions loads a sample set from a directory
+// of conversation files or from a single conversation
+// file.
+//
+// A conversation file must be formatted using CSV with
+// two columns: the sender and the message.
+// The sender is either "bot" or "human".
+// An optional third column identifies the speaker of a
+// human message, for conversations with several people,
+// an optional fourth column gives the time at which the
+// message was sent, and an optional fifth column lists
+// attribute labels separated by spaces.
+// Times may be in RFC 3339 format or Unix seconds.
+//
+// A row whose sender is "persona" gives the label of the
+// persona which the bot speaks as in the conversation.
+//
+// Files ending in ".json" contain an array of messages,
+// each with "sender", "body", and optionally "speaker"
+// "time", and "attributes" fields.
+// The array may be wrapped in an object as its "messages"
+// field, with a "persona" field for the persona label.
+// Files ending in ".srt" are read as subtitles, and a
+// directory containing the Cornell Movie-Dialogs corpus
+// is read as such.
+// See readSRT and readCornell for details.
+// Files ending in ".gz" or ".zst" are decompressed
+// before they are read.
+//
+// Files without extensions are read as CSV.
+// Files and directories whose names start with a "." are
+// always ignored, and so are files in a directory with
+// other extensions unless opts.Include matches them.
+//
+// The maxBuffer size specifies the maximum number of
+// characters in a generated training sequence.
+//
+// If opts is nil, default options are used.
+func NewSampleSetOptions(path string, maxBuffer int, opts *LoadOptions) (*SampleSet, error) {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	convos, err := opts.readConversations(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSampleSetConvos(convos, maxBuffer, opts)
+}
+
+// AddFlags registers command-line flags which set the
+// fields of l.
+func (l *LoadOptions) AddFlags(f *flag.FlagSet) {
+	f.BoolVar(&l.Recursive, "recursive", false, "search subdirectories for sample files")
+	f.Var((*globList)(&l.Include), "include", "comma-separated globs of sample files to read (default *.csv, *.json, *.srt, and extensionless files)")
+	f.Var((*globList)(&l.Exclude), "exclude", "comma-separated globs of sample files to skip")
+	f.BoolVar(&l.SkipBadFiles, "skip-bad", false, "skip sample files which fail to load")
+	f.BoolVar(&l.Lazy, "lazy", false, "read samples from disk as they are needed")
+	f.StringVar(&l.Persona, "persona", "", "persona label for conversations without one")
+	f.Var(taggerFlag{l}, "tag", "tag messages with length, emoji, and formality attributes")
+	f.Var(dedupFlag{l}, "dedup", "remove duplicate conversations and don't train on duplicate messages")
+	f.BoolVar(&l.Snippets.TruncateHistory, "truncate-history", false,
+		"fill snippets with the end of the oldest message that does not fit")
+	f.Var(&l.Snippets.EmptyMessages, "empty-messages",
+		"handling of empty messages (stop, skip, or keep)")
+	f.IntVar(&l.Snippets.MinContext, "min-context", 0,
+		"bytes of history to reserve by cutting long messages (0 drops them)")
+}
+
+func (l *LoadOptions) readConversations(path string) ([][]message, error) {
+	var convos [][]message
+	err := l.walkSources(path, func(source string) error {
+		sourceConvos, err := l.readSource(source)
+		if err != nil {
+			return err
+		}
+		convos = append(convos, l.dedup(sourceConvos)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convos, nil
+}
+
+// walkSources calls f for every conversation file and
+// Cornell corpus directory that should be loaded from a
+// path.
+// Errors from f are handled according to SkipBadFiles.
+//
+// Symbolic links to directories are followed, but each
+// directory is only visited once.
+func (l *LoadOptions) walkSources(path string, f func(source string) error) error {
+	if err := l.checkControls(InputControls{Persona: l.Persona}); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || isCornellCorpus(path) {
+		if err := f(path); err != nil {
+			return l.fileError(path, err)
+		}
+		return nil
+	}
+	return l.walkDir(path, path, map[string]bool{}, f)
+}
+
+func (l *LoadOptions) walkDir(root, dir string, visited map[string]bool,
+	f func(source string) error) error {
+	if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+		if visited[realDir] {
+			return nil
+		}
+		visited[realDir] = true
+	}
+	listing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return l.fileError(dir, err)
+	}
+	for _, info := range listing {
+		subPath := filepath.Join(dir, info.Name())
+		relPath, _ := filepath.Rel(root, subPath)
+		if strings.HasPrefix(info.Name(), ".") || l.excluded(relPath) {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = os.Stat(subPath)
+			if err != nil {
+				if err := l.fileError(subPath, err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if info.IsDir() {
+			if !l.Recursive {
+				continue
+			}
+			if isCornellCorpus(subPath) {
+				err = f(subPath)
+			} else {
+				err = l.walkDir(root, subPath, visited, f)
+			}
+		} else if l.included(relPath) {
+			err = f(subPath)
+		} else {
+			if len(l.Include) == 0 {
+				l.warn(fmt.Errorf("skip %s: %w", subPath, errNotConversationFile))
+			}
+			continue
+		}
+		if err != nil {
+			if err := l.fileError(subPath, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSource reads and prepares the conversations from a
+// source produced by walkSources.
+//
+// It fails if the conversations use labels which Arch
+// does not have.
+func (l *LoadOptions) readSource(source string) ([][]message, error) {
+	convos, err := readConversationSource(source)
+	if err != nil {
+		return nil, err
+	}
+	convos = l.prepare(convos)
+	for _, convo := range convos {
+		for _, msg := range convo {
+			err := l.checkControls(InputControls{
+				Persona:    msg.Persona,
+				Attributes: msg.Attributes,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return convos, nil
+}
+
+// checkControls checks that Arch has the labels in some
+// controls.
+// If Arch is nil, any labels are allowed, since the
+// samples may be used with any architecture.
+func (l *LoadOptions) checkControls(c InputControls) error {
+	if l.Arch == nil {
+		return nil
+	}
+	return l.Arch.CheckControls(c)
+}
+
+// prepare removes conversations outside of the shards,
+// preprocesses and tags conversations, assigns the
+// default persona, and removes empty messages if the
+// snippet options call for it.
+func (l *LoadOptions) prepare(convos [][]message) [][]message {
+	convos = l.shard(convos)
+	preprocessConversations(l.Preprocessor, convos)
+	tagConversations(l.Tagger, convos)
+	if l.Persona != "" {
+		for _, convo := range convos {
+			if len(convo) > 0 && convo[0].Persona == "" {
+				setPersona(convo, l.Persona)
+			}
+		}
+	}
+	return l.Snippets.filterEmpty(convos)
+}
+
+func (l *LoadOptions) shard(convos [][]message) [][]message {
+	if l.NumShards == 0 {
+		return convos
+	}
+	var res [][]message
+	for _, convo := range convos {
+		shard := conversationShard(convo, l.NumShards)
+		for _, s := range l.Shards {
+			if s == shard {
+				res = append(res, convo)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// conversationShard hashes the messages of a raw
+// conversation to pick its shard.
+func conversationShard(convo []message, numShards int) int {
+	h := fnv.New64a()
+	for _, msg := range convo {
+		if msg.FromBot {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(msg.Body))
+	}
+	return int(h.Sum64() % uint64(numShards))
+}
+
+func (l *LoadOptions) dedup(convos [][]message) [][]message {
+	if l.Dedup == nil {
+		return convos
+	}
+	return l.Dedup.filter(convos)
+}
+
+// readConversationSource reads the conversations from a
+// source produced by walkSources.
+func readConversationSource(source string) ([][]message, error) {
+	return readConversationSourceRows(source, func(err error) error {
+		return err
+	})
+}
+
+// readConversationSourceRows is like readConversationSource,
+// but malformed rows are handled by badRow as they are in
+// readConversationRows.
+func readConversationSourceRows(source string, badRow func(err error) error) ([][]message,
+	error) {
+	if info, err := os.Stat(source); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return readCornell(source)
+	}
+	return readConversationsFile(source, badRow)
+}
+
+func (l *LoadOptions) fileError(path string, err error) error {
+	err = fmt.Errorf("load %s: %s", path, err)
+	if !l.SkipBadFiles {
+		return err
+	}
+	l.warn(err)
+	return nil
+}
+
+// errNotConversationFile is reported to Warn for files
+// which are skipped because they lack a conversation
+// extension.
+var errNotConversationFile = errors.New("not a conversation file")
+
+func (l *LoadOptions) warn(err error) {
+	if l.Warn != nil {
+		l.Warn(err)
+	} else {
+		log.Println("Warning:", err)
+	}
+}
+
+// included checks if a file in a directory should be
+// read.
+// Without Include patterns, only files with conversation
+// extensions or no extension are read, so that stray
+// files like notes.md do not abort the load.
+func (l *LoadOptions) included(relPath string) bool {
+	if len(l.Include) == 0 {
+		return isConversationFile(relPath)
+	}
+	return matchesAnyGlob(l.Include, relPath)
+}
+
+// isConversationFile checks if a file name has the
+// extension of a conversation format, or no extension,
+// possibly followed by a compression extension.
+func isConversationFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(trimCompressionExt(path))) {
+	case "", ".csv", ".json", ".srt":
+		return true
+	}
+	return false
+}
+
+func (l *LoadOptions) excluded(relPath string) bool {
+	return matchesAnyGlob(l.Exclude, relPath)
+}
+
+func matchesAnyGlob(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		for _, name := range []string{filepath.Base(relPath), relPath} {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openCorpusFile opens a file for reading, decompressing
+// it if its extension indicates a compression format.
+func openCorpusFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressedFile{Reader: r, file: f, closer: r.Close}, nil
+	case ".zst":
+		r, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressedFile{
+			Reader: r,
+			file:   f,
+			closer: func() error {
+				r.Close()
+				return nil
+			},
+		}, nil
+	}
+	return f, nil
+}
+
+// trimCompressionExt removes a compression extension from
+// a file name, if present.
+func trimCompressionExt(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz", ".zst":
+		return strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	return path
+}
+
+type decompressedFile struct {
+	io.Reader
+	file   *os.File
+	closer func() error
+}
+
+func (d *decompressedFile) Close() error {
+	err := d.closer()
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(s string) error {
+	for _, pattern := range strings.Split(s, ",") {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %s", pattern, err)
+		}
+		*g = append(*g, pattern)
+	}
+	return nil
+}
+
+// taggerFlag is a boolean flag which sets the Tagger
+// field of a LoadOptions to DefaultAttributeTaggers.
+type taggerFlag struct {
+	l *LoadOptions
+}
+
+func (t taggerFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (t taggerFlag) String() string {
+	if t.l == nil || t.l.Tagger == nil {
+		return "false"
+	}
+	return "true"
+}
+
+func (t taggerFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if !on {
+		t.l.Tagger = nil
+	} else {
+		t.l.Tagger = DefaultAttributeTaggers()
+	}
+	return nil
+}
+
+// dedupFlag is a boolean flag which sets the Dedup field
+// of a LoadOptions to a default Deduplicator.
+type dedupFlag struct {
+	l *LoadOptions
+}
+
+func (d dedupFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (d dedupFlag) String() string {
+	if d.l == nil || d.l.Dedup == nil {
+		return "false"
+	}
+	return "true"
+}
+
+func (d dedupFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if !on {
+		d.l.Dedup = nil
+	} else {
+		d.l.Dedup = &Deduplicator{
+			Conversations: true,
+			Messages:      true,
+			Threshold:     0.9,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package chatbot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	linked, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(linked)
+
+	for _, name := range []string{
+		"a.csv",
+		"chats",
+		"notes.md",
+		"b.json.gz",
+		"sub/c.txt",
+		".hidden/d.csv",
+	} {
+		writeTestFile(t, filepath.Join(dir, name), "")
+	}
+	writeTestFile(t, filepath.Join(linked, "e.srt"), "")
+	if err := os.Symlink(linked, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// A link back to the root must not loop forever.
+	if err := os.Symlink(dir, filepath.Join(linked, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts     LoadOptions
+		expected []string
+	}{
+		{LoadOptions{}, []string{"a.csv", "b.json.gz", "chats"}},
+		{LoadOptions{Recursive: true},
+			[]string{"a.csv", "b.json.gz", "chats", "link/e.srt"}},
+		{LoadOptions{Recursive: true, Include: []string{"*.txt"}}, []string{"sub/c.txt"}},
+		{LoadOptions{Include: []string{"chats"}}, []string{"chats"}},
+		{LoadOptions{Recursive: true, Exclude: []string{"link"}},
+			[]string{"a.csv", "b.json.gz", "chats"}},
+	}
+	for i, test := range tests {
+		test.opts.Warn = func(err error) {}
+		var actual []string
+		err := test.opts.walkSources(dir, func(source string) error {
+			rel, _ := filepath.Rel(dir, source)
+			actual = append(actual, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("test %d: %s", i, err)
+		} else if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("test %d: expected %v but got %v", i, test.expected, actual)
+		}
+	}
+
+	var warnings int
+	opts := LoadOptions{Warn: func(err error) { warnings++ }}
+	if err := opts.walkSources(dir, func(string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if warnings != 1 {
+		t.Errorf("expected 1 skipped file but got %d", warnings)
+	}
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadChecksPersonas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "alice.csv"), "persona,alice\nhuman,hi\nbot,hello\n")
+	writeTestFile(t, filepath.Join(dir, "plain.csv"), "human,hi\nbot,hey\n")
+
+	arch := &Architecture{StateSizes: []int{10}, Personas: []string{"alice", "bob"}}
+	tests := []struct {
+		opts LoadOptions
+		ok   bool
+	}{
+		{LoadOptions{}, true},
+		{LoadOptions{Arch: arch}, true},
+		{LoadOptions{Arch: arch, Persona: "bob"}, true},
+		{LoadOptions{Arch: arch, Persona: "carol"}, false},
+		{LoadOptions{Arch: DefaultArchitecture()}, false},
+	}
+	for i, test := range tests {
+		_, err := NewSampleSetOptions(dir, 100, &test.opts)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestLoadChecksAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFile(t, filepath.Join(dir, "convo.csv"),
+		"human,hi,,,\nbot,hello there,,,formal short\n")
+
+	tests := []struct {
+		attrs []string
+		ok    bool
+	}{
+		{[]string{"formal", "short"}, true},
+		{[]string{"short"}, false},
+		{nil, false},
+	}
+	for i, test := range tests {
+		arch := &Architecture{StateSizes: []int{10}, Attributes: test.attrs}
+		_, err := NewSampleSetOptions(dir, 100, &LoadOptions{Arch: arch})
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestLoadShardsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("convo%d.csv", i)),
+			fmt.Sprintf("human,hi %d,,,\nbot,hello,,,\nhuman,bye,,,\nbot,later,,,\n", i))
+	}
+	cacheFile := filepath.Join(dir, "cache")
+	if err := WriteSampleCache(cacheFile, dir, 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := LoadSamples(cacheFile, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.(*CacheSampleSet).Close()
+
+	seen := map[uint32]bool{}
+	for shard := 0; shard < 3; shard++ {
+		samples, err := LoadSamples(cacheFile, 100, &LoadOptions{
+			NumShards: 3,
+			Shards:    []int{shard},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer samples.(*CacheSampleSet).Close()
+		if samples.Len()%4 != 0 || samples.Len() == 0 {
+			t.Errorf("shard %d: unexpected size %d", shard, samples.Len())
+		}
+		for _, idx := range samples.(*CacheSampleSet).indices {
+			seen[idx] = true
+		}
+	}
+	if len(seen) != all.Len() {
+		t.Errorf("shards cover %d of %d samples", len(seen), all.Len())
+	}
+}
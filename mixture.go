@@ -0,0 +1,366 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/unixpickle/sgd"
+)
+
+type mixtureEntry struct {
+	Set   int32
+	Index int32
+}
+
+// A MixtureSampleSet combines several sample sets,
+// drawing from each of them according to a weight.
+//
+// A MixtureSampleSet is a list of references to samples
+// in its component sets, where the number of references
+// to each set is proportional to the set's weight.
+// Since shuffling, copying, and subsetting only rearrange
+// these references, the mixture ratio is preserved as
+// sgd.SGDMini shuffles the set and splits it into
+// batches.
+// Reshuffle draws new references, keeping the number of
+// references to each set.
+//
+// The component sets are never modified.
+type MixtureSampleSet struct {
+	sets    []sgd.SampleSet
+	entries []mixtureEntry
+
+	// draws continues the random order of each set
+	// between calls to Reshuffle.
+	// It is nil for subsets, which cannot be reshuffled.
+	draws []mixtureDraw
+}
+
+// mixtureDraw draws the indices of a sample set in a
+// random order, starting a new order once every index
+// has been drawn.
+type mixtureDraw struct {
+	perm []int
+	next int
+}
+
+func (m *mixtureDraw) Next(size int) int {
+	if m.next >= len(m.perm) {
+		m.perm = rand.Perm(size)
+		m.next = 0
+	}
+	m.next++
+	return m.perm[m.next-1]
+}
+
+// NewMixtureSampleSet creates a mixture of sample sets.
+//
+// The weights need not sum to 1.
+// The size argument specifies the total number of
+// samples in the mixture.
+// If it is 0, the total size of the sets is used.
+//
+// Samples from each set are used in a random order, and a
+// sample is only repeated once every other sample in its
+// set has been used.
+// This also holds across calls to Reshuffle, so a set
+// with fewer references than samples is covered over
+// several epochs.
+func NewMixtureSampleSet(sets []sgd.SampleSet, weights []float64,
+	size int) (*MixtureSampleSet, error) {
+	if len(sets) != len(weights) {
+		return nil, errors.New("mismatching sample set and weight counts")
+	}
+	if size == 0 {
+		for _, s := range sets {
+			size += s.Len()
+		}
+	}
+
+	var totalWeight float64
+	for i, w := range weights {
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid weight: %f", w)
+		} else if w > 0 && sets[i].Len() == 0 {
+			return nil, fmt.Errorf("sample set %d is empty", i)
+		}
+		totalWeight += w
+	}
+	if totalWeight == 0 {
+		return nil, errors.New("all weights are zero")
+	}
+
+	return newMixture(sets, mixtureCounts(weights, totalWeight, size)), nil
+}
+
+// newMixture creates a shuffled mixture with the given
+// number of references to each set.
+func newMixture(sets []sgd.SampleSet, counts []int) *MixtureSampleSet {
+	res := &MixtureSampleSet{sets: sets, draws: make([]mixtureDraw, len(sets))}
+	for setIdx, count := range counts {
+		for i := 0; i < count; i++ {
+			res.entries = append(res.entries, mixtureEntry{Set: int32(setIdx)})
+		}
+	}
+	res.Reshuffle()
+	return res
+}
+
+// TemperatureWeights computes mixture weights for sample
+// sets based on their sizes.
+//
+// Each weight is proportional to the size of a set raised
+// to the power 1/temperature.
+// A temperature of 1 samples in proportion to size, and
+// larger temperatures move toward sampling every set
+// equally.
+// The temperature must be positive.
+func TemperatureWeights(sets []sgd.SampleSet, temperature float64) ([]float64, error) {
+	if !(temperature > 0) || math.IsInf(temperature, 0) {
+		return nil, fmt.Errorf("invalid temperature: %f", temperature)
+	}
+	res := make([]float64, len(sets))
+	for i, s := range sets {
+		res[i] = math.Pow(float64(s.Len()), 1/temperature)
+	}
+	return res, nil
+}
+
+// mixtureCounts splits size into integer counts which
+// are proportional to the weights, using the largest
+// remainder method.
+func mixtureCounts(weights []float64, totalWeight float64, size int) []int {
+	counts := make([]int, len(weights))
+	remainders := make([]float64, len(weights))
+	var assigned int
+	for i, w := range weights {
+		exact := float64(size) * w / totalWeight
+		counts[i] = int(exact)
+		remainders[i] = exact - float64(counts[i])
+		assigned += counts[i]
+	}
+	var order []int
+	for i, w := range weights {
+		if w > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for i := 0; assigned < size; i++ {
+		counts[order[i%len(order)]]++
+		assigned++
+	}
+	return counts
+}
+
+// Len returns the number of samples.
+func (m *MixtureSampleSet) Len() int {
+	return len(m.entries)
+}
+
+// Copy returns a shallow copy of the sample set.
+// The copy shares the component sets, but it is
+// reshuffled independently of the original.
+func (m *MixtureSampleSet) Copy() sgd.SampleSet {
+	res := &MixtureSampleSet{
+		sets:    m.sets,
+		entries: make([]mixtureEntry, len(m.entries)),
+	}
+	copy(res.entries, m.entries)
+	if m.draws != nil {
+		res.draws = make([]mixtureDraw, len(m.draws))
+		copy(res.draws, m.draws)
+	}
+	return res
+}
+
+// Reshuffle replaces the references to each component
+// set with the next samples from that set, and then
+// shuffles the references.
+// It should be called once per epoch.
+//
+// Subsets cannot be reshuffled, since they would draw
+// samples from outside of the subset, so Reshuffle only
+// shuffles them.
+// Use HashSplit to split a mixture into mixtures which
+// can be reshuffled.
+func (m *MixtureSampleSet) Reshuffle() {
+	if m.draws != nil {
+		for i := range m.entries {
+			e := &m.entries[i]
+			e.Index = int32(m.draws[e.Set].Next(m.sets[e.Set].Len()))
+		}
+	}
+	sgd.ShuffleSampleSet(m)
+}
+
+// Swap swaps two samples.
+func (m *MixtureSampleSet) Swap(i, j int) {
+	m.entries[i], m.entries[j] = m.entries[j], m.entries[i]
+}
+
+// GetSample gets a sample from the underlying set.
+func (m *MixtureSampleSet) GetSample(idx int) interface{} {
+	e := m.entries[idx]
+	return m.sets[e.Set].GetSample(int(e.Index))
+}
+
+// SampleLength returns the number of timesteps in a
+// sample from the underlying set.
+func (m *MixtureSampleSet) SampleLength(idx int) int {
+	e := m.entries[idx]
+	return sampleLength(m.sets[e.Set], int(e.Index))
+}
+
+// Subset returns a subset of this sample set.
+func (m *MixtureSampleSet) Subset(start, end int) sgd.SampleSet {
+	return &MixtureSampleSet{
+		sets:    m.sets,
+		entries: m.entries[start:end],
+	}
+}
+
+// Hash returns the hash of a sample from the underlying
+// set.
+func (m *MixtureSampleSet) Hash(idx int) []byte {
+	e := m.entries[idx]
+	return m.sets[e.Set].Hash(int(e.Index))
+}
+
+// LoadWeightedSamples loads one or more sample sets using
+// LoadSamples and mixes them if there is more than one.
+//
+// Each path may end with ":weight" to specify its mixture
+// weight, e.g. "personal_chats:3".
+// Paths without weights are weighted using
+// TemperatureWeights with the given temperature.
+// Paths with weights cannot be mixed with paths without
+// weights.
+//
+// The result should be passed to CloseSamples when it is
+// no longer needed, to close any sample caches.
+func LoadWeightedSamples(paths []string, maxBuffer int, opts *LoadOptions,
+	temperature float64) (res sgd.SampleSet, err error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no sample paths")
+	}
+	var sets []sgd.SampleSet
+	defer func() {
+		if err != nil {
+			for _, set := range sets {
+				CloseSamples(set)
+			}
+		}
+	}()
+	var weights []float64
+	for _, spec := range paths {
+		path, weight, hasWeight := parseWeightedPath(spec)
+		if hasWeight {
+			weights = append(weights, weight)
+		}
+		set, err := LoadSamples(path, maxBuffer, opts)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	if len(weights) != 0 && len(weights) != len(sets) {
+		return nil, errors.New("weights must be given for all sample paths or none")
+	}
+	if len(sets) == 1 {
+		return sets[0], nil
+	}
+	if weights == nil {
+		weights, err = TemperatureWeights(sets, temperature)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewMixtureSampleSet(sets, weights, 0)
+}
+
+// CloseSamples closes a sample set from LoadSamples or
+// LoadWeightedSamples, along with the component sets of a
+// mixture, if they need to be closed.
+//
+// Copies and subsets of the set, including those from
+// HashSplit, share its resources, so they should not be
+// closed separately, nor used after the set is closed.
+func CloseSamples(s sgd.SampleSet) error {
+	if m, ok := s.(*MixtureSampleSet); ok {
+		var firstErr error
+		for _, set := range m.sets {
+			if err := CloseSamples(set); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// HashSplit is like sgd.HashSplit, but it splits a
+// MixtureSampleSet by splitting each of its component
+// sets.
+// The resulting mixtures can be reshuffled without
+// drawing samples from each other, and they keep the
+// ratio of the original mixture.
+func HashSplit(s sgd.SampleSet, leftRatio float64) (left, right sgd.SampleSet) {
+	m, ok := s.(*MixtureSampleSet)
+	if !ok || m.draws == nil {
+		return sgd.HashSplit(s, leftRatio)
+	}
+	counts := make([]int, len(m.sets))
+	for _, e := range m.entries {
+		counts[e.Set]++
+	}
+	var leftSets, rightSets []sgd.SampleSet
+	var leftCounts, rightCounts []int
+	for i, set := range m.sets {
+		l, r := sgd.HashSplit(set, leftRatio)
+		var leftCount int
+		if set.Len() > 0 {
+			leftCount = int(math.Round(float64(counts[i]*l.Len()) / float64(set.Len())))
+		}
+		if r.Len() == 0 {
+			leftCount = counts[i]
+		} else if l.Len() == 0 {
+			leftCount = 0
+		}
+		leftSets = append(leftSets, l)
+		rightSets = append(rightSets, r)
+		leftCounts = append(leftCounts, leftCount)
+		rightCounts = append(rightCounts, counts[i]-leftCount)
+	}
+	return newMixture(leftSets, leftCounts), newMixture(rightSets, rightCounts)
+}
+
+// parseWeightedPath splits a path from its weight.
+// A spec which names an existing file is never split, so
+// that paths containing a colon can be used.
+func parseWeightedPath(spec string) (path string, weight float64, ok bool) {
+	if _, err := os.Stat(spec); err == nil {
+		return spec, 0, false
+	}
+	idx := strings.LastIndex(spec, ":")
+	if idx < 0 {
+		return spec, 0, false
+	}
+	weight, err := strconv.ParseFloat(spec[idx+1:], 64)
+	if err != nil {
+		return spec, 0, false
+	}
+	return spec[:idx], weight, true
+}
@@ -0,0 +1,216 @@
+package chatbot
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/unixpickle/sgd"
+)
+
+func TestMixtureCounts(t *testing.T) {
+	tests := []struct {
+		weights  []float64
+		size     int
+		expected []int
+	}{
+		{[]float64{1, 2, 0, 1}, 10, []int{3, 5, 0, 2}},
+		{[]float64{1, 1, 1}, 7, []int{3, 2, 2}},
+		{[]float64{0.1, 0.9}, 3, []int{0, 3}},
+		{[]float64{5}, 4, []int{4}},
+	}
+	for i, test := range tests {
+		var total float64
+		for _, w := range test.weights {
+			total += w
+		}
+		actual := mixtureCounts(test.weights, total, test.size)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("test %d: expected %v but got %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestMixtureSampleSetCoverage(t *testing.T) {
+	small := newIndexSampleSet(1000, 10)
+	large := newIndexSampleSet(0, 100)
+	mixture, err := NewMixtureSampleSet([]sgd.SampleSet{small, large},
+		[]float64{1, 1}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]int{}
+	for epoch := 0; epoch < 10; epoch++ {
+		if epoch > 0 {
+			mixture.Reshuffle()
+		}
+		var fromLarge int
+		for i := 0; i < mixture.Len(); i++ {
+			sample := mixture.GetSample(i).(int)
+			seen[sample]++
+			if sample < 1000 {
+				fromLarge++
+			}
+		}
+		if fromLarge != 10 {
+			t.Errorf("epoch %d: expected 10 large samples but got %d", epoch, fromLarge)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if seen[i] != 1 {
+			t.Errorf("large sample %d used %d times", i, seen[i])
+		}
+	}
+	for i := 1000; i < 1010; i++ {
+		if seen[i] != 10 {
+			t.Errorf("small sample %d used %d times", i, seen[i])
+		}
+	}
+}
+
+func TestMixtureHashSplit(t *testing.T) {
+	mixture, err := NewMixtureSampleSet(
+		[]sgd.SampleSet{newIndexSampleSet(1000, 20), newIndexSampleSet(0, 200)},
+		[]float64{1, 1}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, right := HashSplit(mixture, 0.8)
+	if left.Len()+right.Len() != mixture.Len() {
+		t.Errorf("split %d samples into %d and %d", mixture.Len(), left.Len(), right.Len())
+	}
+	sides := map[int]int{}
+	for epoch := 0; epoch < 5; epoch++ {
+		for side, s := range []sgd.SampleSet{left, right} {
+			ShuffleEpoch(s)
+			for i := 0; i < s.Len(); i++ {
+				sample := s.GetSample(i).(int)
+				if prev, ok := sides[sample]; ok && prev != side {
+					t.Fatalf("sample %d is on both sides", sample)
+				}
+				sides[sample] = side
+			}
+		}
+	}
+}
+
+func TestTemperatureWeights(t *testing.T) {
+	sets := []sgd.SampleSet{newIndexSampleSet(0, 4), newIndexSampleSet(0, 16)}
+	weights, err := TemperatureWeights(sets, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(weights, []float64{2, 4}) {
+		t.Errorf("unexpected weights %v", weights)
+	}
+	for _, temp := range []float64{0, -1, math.NaN()} {
+		if _, err := TemperatureWeights(sets, temp); err == nil {
+			t.Errorf("temperature %f: expected an error", temp)
+		}
+	}
+}
+
+func TestParseWeightedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	colonDir := filepath.Join(dir, "backup:2")
+	if err := os.Mkdir(colonDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec   string
+		path   string
+		weight float64
+		ok     bool
+	}{
+		{"chats", "chats", 0, false},
+		{"chats:3", "chats", 3, true},
+		{"chats:0.5", "chats", 0.5, true},
+		{"logs:2016:10", "logs:2016", 10, true},
+		{"logs:2016/chat", "logs:2016/chat", 0, false},
+		{"chats:", "chats:", 0, false},
+		{colonDir, colonDir, 0, false},
+		{colonDir + ":4", colonDir, 4, true},
+	}
+	for _, test := range tests {
+		path, weight, ok := parseWeightedPath(test.spec)
+		if path != test.path || weight != test.weight || ok != test.ok {
+			t.Errorf("%q: expected (%q, %f, %v) but got (%q, %f, %v)", test.spec,
+				test.path, test.weight, test.ok, path, weight, ok)
+		}
+	}
+}
+
+func TestCloseSamples(t *testing.T) {
+	var closed [2]bool
+	sets := []sgd.SampleSet{
+		closingSampleSet{newIndexSampleSet(0, 10), &closed[0]},
+		newIndexSampleSet(10, 10),
+		closingSampleSet{newIndexSampleSet(20, 10), &closed[1]},
+	}
+	mixture, err := NewMixtureSampleSet(sets, []float64{1, 1, 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseSamples(mixture); err != nil {
+		t.Fatal(err)
+	}
+	if !closed[0] || !closed[1] {
+		t.Errorf("expected both sets to be closed but got %v", closed)
+	}
+}
+
+// closingSampleSet records when it is closed.
+type closingSampleSet struct {
+	indexSampleSet
+	closed *bool
+}
+
+func (c closingSampleSet) Close() error {
+	*c.closed = true
+	return nil
+}
+
+// indexSampleSet is a sample set of integers.
+type indexSampleSet []int
+
+func newIndexSampleSet(start, count int) indexSampleSet {
+	res := make(indexSampleSet, count)
+	for i := range res {
+		res[i] = start + i
+	}
+	return res
+}
+
+func (s indexSampleSet) Len() int {
+	return len(s)
+}
+
+func (s indexSampleSet) Copy() sgd.SampleSet {
+	return append(indexSampleSet{}, s...)
+}
+
+func (s indexSampleSet) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s indexSampleSet) GetSample(idx int) interface{} {
+	return s[idx]
+}
+
+func (s indexSampleSet) Subset(start, end int) sgd.SampleSet {
+	return s[start:end]
+}
+
+func (s indexSampleSet) Hash(idx int) []byte {
+	hash := md5.Sum([]byte(strconv.Itoa(s[idx])))
+	return hash[:]
+}
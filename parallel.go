@@ -0,0 +1,67 @@
+package chatbot
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/sgd"
+)
+
+// A ParallelGradienter splits each batch between several
+// Gradienters, runs them on separate goroutines, and sums
+// their gradients.
+//
+// The Gradienters should compute gradients for the same
+// parameters, and each should be safe to run alongside
+// the others.
+// Gradients are summed in a fixed order, so the result
+// does not depend on which goroutine finishes first.
+// For the result to be reproducible, each Gradienter
+// should also have its own random source, for example
+// by using a block from Bot.DropoutBlock.
+type ParallelGradienter struct {
+	Gradienters []sgd.Gradienter
+}
+
+// NewParallelGradienter creates a ParallelGradienter,
+// failing if there are no Gradienters.
+func NewParallelGradienter(g []sgd.Gradienter) (*ParallelGradienter, error) {
+	if len(g) == 0 {
+		return nil, errors.New("parallel gradienter: no gradienters")
+	}
+	return &ParallelGradienter{Gradienters: g}, nil
+}
+
+// Gradient computes the total gradient for a batch.
+//
+// It panics if there are no Gradienters.
+func (p *ParallelGradienter) Gradient(s sgd.SampleSet) autofunc.Gradient {
+	if len(p.Gradienters) == 0 {
+		panic("parallel gradienter: no gradienters")
+	}
+	n := len(p.Gradienters)
+	if n > s.Len() {
+		n = s.Len()
+	}
+	if n <= 1 {
+		return p.Gradienters[0].Gradient(s)
+	}
+
+	grads := make([]autofunc.Gradient, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start, end := i*s.Len()/n, (i+1)*s.Len()/n
+			grads[i] = p.Gradienters[i].Gradient(s.Subset(start, end))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, g := range grads[1:] {
+		grads[0].Add(g)
+	}
+	return grads[0]
+}
@@ -0,0 +1,105 @@
+package chatbot
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rnn"
+	"github.com/unixpickle/weakai/rnn/seqtoseq"
+)
+
+func TestParallelGradienterDeterministic(t *testing.T) {
+	arch := &Architecture{StateSizes: []int{16}}
+	bot := NewBotArchitecture(arch)
+	bot.Dropout(true)
+	samples := testSampleSet(arch, 10, 100)
+
+	gradient := func() autofunc.Gradient {
+		p := &ParallelGradienter{}
+		for i := 0; i < 4; i++ {
+			p.Gradienters = append(p.Gradienters, &seqtoseq.Gradienter{
+				SeqFunc:  &rnn.BlockSeqFunc{B: bot.DropoutBlock(rand.New(rand.NewSource(int64(i))))},
+				Learner:  bot.Block.(sgd.Learner),
+				CostFunc: neuralnet.DotCost{},
+			})
+		}
+		return p.Gradient(samples)
+	}
+
+	expected := gradient()
+	for trial := 0; trial < 3; trial++ {
+		actual := gradient()
+		for _, param := range bot.Block.(sgd.Learner).Parameters() {
+			x, y := expected[param], actual[param]
+			if len(x) != len(y) {
+				t.Fatalf("trial %d: gradient sizes differ", trial)
+			}
+			for i := range x {
+				if x[i] != y[i] {
+					t.Fatalf("trial %d: gradients differ", trial)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelGradienterTraining(t *testing.T) {
+	arch := &Architecture{StateSizes: []int{16}}
+	data, err := NewBotArchitecture(arch).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := testSampleSet(arch, 10, 100)
+
+	train := func() []*autofunc.Variable {
+		bot, err := DecodeBot(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot.Dropout(true)
+		var gradienters []sgd.Gradienter
+		for i := 0; i < 3; i++ {
+			gradienters = append(gradienters, &seqtoseq.Gradienter{
+				SeqFunc:  &rnn.BlockSeqFunc{B: bot.DropoutBlock(rand.New(rand.NewSource(int64(i))))},
+				Learner:  bot.Block.(sgd.Learner),
+				CostFunc: neuralnet.DotCost{},
+			})
+		}
+		p, err := NewParallelGradienter(gradienters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adam := &sgd.Adam{Gradienter: p}
+		for step := 0; step < 5; step++ {
+			start := step * samples.Len() / 5
+			end := (step + 1) * samples.Len() / 5
+			adam.Gradient(samples.Subset(start, end)).AddToVars(-0.01)
+		}
+		return bot.Block.(sgd.Learner).Parameters()
+	}
+
+	expected := train()
+	for trial := 0; trial < 2; trial++ {
+		actual := train()
+		for i, param := range expected {
+			x, y := param.Vector, actual[i].Vector
+			if len(x) != len(y) {
+				t.Fatalf("trial %d: parameter sizes differ", trial)
+			}
+			for j := range x {
+				if x[j] != y[j] {
+					t.Fatalf("trial %d: parameters differ after training", trial)
+				}
+			}
+		}
+	}
+}
+
+func TestNewParallelGradienterEmpty(t *testing.T) {
+	if _, err := NewParallelGradienter(nil); err == nil {
+		t.Error("expected an error for no gradienters")
+	}
+}
@@ -0,0 +1,182 @@
+package chatbot
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A Preprocessor transforms the body of every message in
+// a corpus before samples are generated from it.
+type Preprocessor interface {
+	Preprocess(body string) string
+}
+
+// A PreprocessorChain applies a list of Preprocessors in
+// order.
+type PreprocessorChain []Preprocessor
+
+// Preprocess applies every Preprocessor in the chain.
+func (p PreprocessorChain) Preprocess(body string) string {
+	for _, x := range p {
+		body = x.Preprocess(body)
+	}
+	return body
+}
+
+// NormalizeUnicode converts messages to a Unicode
+// normalization form.
+// Invalid UTF-8 sequences are replaced with U+FFFD.
+type NormalizeUnicode struct {
+	Form norm.Form
+}
+
+// Preprocess normalizes the body.
+func (n *NormalizeUnicode) Preprocess(body string) string {
+	if !utf8.ValidString(body) {
+		body = strings.ToValidUTF8(body, "\uFFFD")
+	}
+	return n.Form.String(body)
+}
+
+// CleanWhitespace normalizes line endings, collapses runs
+// of spaces and tabs, removes blank lines, and trims the
+// whitespace around each line.
+type CleanWhitespace struct{}
+
+var horizontalSpaceExpr = regexp.MustCompile(`[\t\f\v \x{00A0}]+`)
+
+// Preprocess cleans the whitespace in the body.
+func (c *CleanWhitespace) Preprocess(body string) string {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\r", "\n", -1)
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(horizontalSpaceExpr.ReplaceAllString(line, " "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A PIIPattern matches one kind of personal information.
+type PIIPattern struct {
+	Expr        *regexp.Regexp
+	Placeholder string
+}
+
+// NamePattern creates a PIIPattern which matches any of
+// the given names as whole words, ignoring case.
+//
+// It fails if there are no names or if a name is empty,
+// since an empty name would match every word boundary.
+func NamePattern(names []string, placeholder string) (PIIPattern, error) {
+	if len(names) == 0 {
+		return PIIPattern{}, errors.New("no names to match")
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		if name == "" {
+			return PIIPattern{}, errors.New("empty name")
+		}
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	return PIIPattern{
+		Expr:        regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`),
+		Placeholder: placeholder,
+	}, nil
+}
+
+// DefaultPIIPatterns returns patterns for email addresses
+// and phone numbers.
+func DefaultPIIPatterns() []PIIPattern {
+	return []PIIPattern{
+		{
+			Expr:        regexp.MustCompile(`[\w.%+-]+@[\w-]+(\.[\w-]+)*\.[A-Za-z]{2,}`),
+			Placeholder: "<EMAIL>",
+		},
+		{
+			Expr: regexp.MustCompile(`(\+\d{1,3}[\s.-]?)?(\(\d{3}\)|\b\d{3})[\s.-]?` +
+				`\d{3}[\s.-]?\d{4}\b`),
+			Placeholder: "<PHONE>",
+		},
+	}
+}
+
+// ReplacePII replaces personal information with
+// placeholder tokens.
+type ReplacePII struct {
+	Patterns []PIIPattern
+}
+
+// Preprocess replaces every match of every pattern.
+func (r *ReplacePII) Preprocess(body string) string {
+	for _, p := range r.Patterns {
+		body = p.Expr.ReplaceAllLiteralString(body, p.Placeholder)
+	}
+	return body
+}
+
+var urlExpr = regexp.MustCompile(`\b(https?://|www\.)[^\s<>"]+`)
+
+// CollapseURLs replaces URLs with their host names, or
+// with a placeholder if one is set.
+type CollapseURLs struct {
+	Placeholder string
+}
+
+// Preprocess collapses every URL in the body.
+func (c *CollapseURLs) Preprocess(body string) string {
+	return urlExpr.ReplaceAllStringFunc(body, func(match string) string {
+		if c.Placeholder != "" {
+			return c.Placeholder
+		}
+		rawURL := match
+		if !strings.Contains(rawURL, "://") {
+			rawURL = "http://" + rawURL
+		}
+		if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return match
+	})
+}
+
+// TruncateMessages cuts off messages after a maximum
+// number of bytes, without splitting UTF-8 sequences.
+//
+// A negative MaxLength is treated like 0.
+type TruncateMessages struct {
+	MaxLength int
+}
+
+// Preprocess truncates the body.
+func (t *TruncateMessages) Preprocess(body string) string {
+	if len(body) <= t.MaxLength {
+		return body
+	}
+	end := t.MaxLength
+	if end < 0 {
+		end = 0
+	}
+	for end > 0 && !utf8.RuneStart(body[end]) {
+		end--
+	}
+	return body[:end]
+}
+
+func preprocessConversations(p Preprocessor, convos [][]message) {
+	if p == nil {
+		return
+	}
+	for _, convo := range convos {
+		for i, msg := range convo {
+			convo[i].Body = p.Preprocess(msg.Body)
+		}
+	}
+}
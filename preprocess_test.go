@@ -0,0 +1,102 @@
+package chatbot
+
+import (
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestDefaultPIIPatterns(t *testing.T) {
+	r := &ReplacePII{Patterns: DefaultPIIPatterns()}
+	tests := map[string]string{
+		"mail john.doe+x@mail.example.co.uk now": "mail <EMAIL> now",
+		"call 555-123-4567 or (555) 123 4567":    "call <PHONE> or <PHONE>",
+		"call +1 555.123.4567 please":            "call <PHONE> please",
+		"version 1.2.3 costs $12345":             "version 1.2.3 costs $12345",
+		"no @ sign here":                         "no @ sign here",
+	}
+	for in, expected := range tests {
+		if actual := r.Preprocess(in); actual != expected {
+			t.Errorf("%q: expected %q but got %q", in, expected, actual)
+		}
+	}
+}
+
+func TestNamePattern(t *testing.T) {
+	pattern, err := NamePattern([]string{"Bob", "Mary-Jane"}, "<NAME>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReplacePII{Patterns: []PIIPattern{pattern}}
+	tests := map[string]string{
+		"hi bob, it's MARY-JANE": "hi <NAME>, it's <NAME>",
+		"bobby and Bob.":         "bobby and <NAME>.",
+		"nobody":                 "nobody",
+	}
+	for in, expected := range tests {
+		if actual := r.Preprocess(in); actual != expected {
+			t.Errorf("%q: expected %q but got %q", in, expected, actual)
+		}
+	}
+
+	for _, names := range [][]string{nil, {"Bob", ""}} {
+		if _, err := NamePattern(names, "<NAME>"); err == nil {
+			t.Errorf("%q: expected an error", names)
+		}
+	}
+}
+
+func TestCollapseURLs(t *testing.T) {
+	tests := []struct {
+		placeholder string
+		in          string
+		expected    string
+	}{
+		{"", "see https://example.com/a?b=c now", "see example.com now"},
+		{"", "at www.example.org/x.", "at www.example.org"},
+		{"<URL>", "see http://example.com and www.x.io", "see <URL> and <URL>"},
+	}
+	for _, test := range tests {
+		c := &CollapseURLs{Placeholder: test.placeholder}
+		if actual := c.Preprocess(test.in); actual != test.expected {
+			t.Errorf("%q: expected %q but got %q", test.in, test.expected, actual)
+		}
+	}
+}
+
+func TestCleanWhitespace(t *testing.T) {
+	in := "  hello \t there\r\n\r\n  second line  \r"
+	expected := "hello there\nsecond line"
+	if actual := (&CleanWhitespace{}).Preprocess(in); actual != expected {
+		t.Errorf("expected %q but got %q", expected, actual)
+	}
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	n := &NormalizeUnicode{Form: norm.NFC}
+	if actual := n.Preprocess("e\u0301 \xff"); actual != "\u00e9 \uFFFD" {
+		t.Errorf("unexpected result %q", actual)
+	}
+}
+
+func TestTruncateMessages(t *testing.T) {
+	tests := []struct {
+		max      int
+		in       string
+		expected string
+	}{
+		{5, "hello world", "hello"},
+		{20, "hello world", "hello world"},
+		{2, "héllo", "h"},
+		{3, "héllo", "hé"},
+		{0, "hello", ""},
+		{-1, "hello", ""},
+	}
+	for _, test := range tests {
+		tm := &TruncateMessages{MaxLength: test.max}
+		if actual := tm.Preprocess(test.in); actual != test.expected {
+			t.Errorf("%d %q: expected %q but got %q", test.max, test.in, test.expected,
+				actual)
+		}
+	}
+}
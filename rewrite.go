@@ -0,0 +1,128 @@
+package chatbot
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RewriteCorpus loads the conversations at a path and
+// writes them to a directory as CSV conversation files,
+// applying opts.Preprocessor and opts.Dedup along the way.
+// Duplicate messages are kept, since the files cannot
+// mark them; they are masked again whenever the
+// rewritten corpus is loaded with deduplication.
+//
+// The directory structure of the original corpus is
+// preserved.
+// Sources containing more than one conversation, such as
+// subtitle files, are split into one file per
+// conversation.
+func RewriteCorpus(path, outDir string, opts *LoadOptions) error {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	root := path
+	if !info.IsDir() {
+		root = filepath.Dir(path)
+	}
+	return opts.walkSources(path, func(source string) error {
+		convos, err := opts.readSource(source)
+		if err != nil {
+			return err
+		}
+		convos = opts.dedup(convos)
+		relPath, err := filepath.Rel(root, source)
+		if err != nil {
+			return err
+		}
+		outBase := filepath.Join(outDir, trimConversationExt(relPath))
+		if info, err := os.Stat(source); err == nil && info.IsDir() {
+			outBase = filepath.Join(outDir, relPath, "conversation")
+		}
+		if err := os.MkdirAll(filepath.Dir(outBase), 0755); err != nil {
+			return err
+		}
+		for i, convo := range convos {
+			outPath := outBase + ".csv"
+			if len(convos) > 1 {
+				outPath = fmt.Sprintf("%s_%d.csv", outBase, i)
+			}
+			if err := writeConversationFile(outPath, convo); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// trimConversationExt removes compression and format
+// extensions from a file name.
+func trimConversationExt(path string) string {
+	path = trimCompressionExt(path)
+	if isConversationFile(path) {
+		return strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	return path
+}
+
+func writeConversationFile(path string, convo []message) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeConversation(f, convo); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeConversation writes a conversation as CSV.
+// Speakers are numbered in the third column if there is
+// more than one of them, and timestamps and attributes
+// are written in the fourth and fifth columns if there
+// are any.
+func writeConversation(w io.Writer, convo []message) error {
+	numColumns := 2
+	for _, msg := range convo {
+		if len(msg.Attributes) > 0 {
+			numColumns = 5
+		} else if !msg.Time.IsZero() && numColumns < 4 {
+			numColumns = 4
+		} else if !msg.FromBot && msg.Speaker != 0 && numColumns < 3 {
+			numColumns = 3
+		}
+	}
+	cw := csv.NewWriter(w)
+	if len(convo) > 0 && convo[0].Persona != "" {
+		if err := cw.Write([]string{"persona", convo[0].Persona}); err != nil {
+			return err
+		}
+	}
+	for _, msg := range convo {
+		row := []string{"human", msg.Body, "", "", strings.Join(msg.Attributes, " ")}
+		if msg.FromBot {
+			row[0] = "bot"
+		} else if numColumns >= 3 {
+			row[2] = strconv.Itoa(msg.Speaker)
+		}
+		if !msg.Time.IsZero() {
+			row[3] = msg.Time.Format(time.RFC3339Nano)
+		}
+		if err := cw.Write(row[:numColumns]); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
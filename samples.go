@@ -1,14 +1,14 @@
 package chatbot
 
 import (
+	"bytes"
 	"encoding/csv"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/sgd"
@@ -17,13 +17,61 @@ import (
 
 type message struct {
 	FromBot bool
-	Body    string
+
+	// Speaker distinguishes the external senders in a
+	// conversation, numbered from 0 in order of their
+	// first messages.
+	Speaker int
+
+	// Time is the time the message was sent, or the zero
+	// time if it is unknown.
+	Time time.Time
+
+	// Gap is 1 plus the GapBucket of the time since the
+	// previous message, or 0 if that time is unknown.
+	Gap int
+
+	// Persona is the label of the persona which the bot
+	// speaks as in the message's conversation, or "" if
+	// there is none.
+	Persona string
+
+	// Attributes are the labels of the message's
+	// attributes, such as its style.
+	Attributes []string
+
+	// Duplicate is set for messages which a Deduplicator
+	// found to duplicate earlier messages.
+	// They are used as context, but not trained on.
+	Duplicate bool
+
+	Body string
+}
+
+// startToken returns the control token which starts the
+// message.
+func (m *message) startToken(arch *Architecture) int {
+	if m.FromBot {
+		return StartBotMsg
+	}
+	return arch.SpeakerToken(m.Speaker)
 }
 
 type snippet struct {
-	EndOfChat bool
-	NextBot   bool
-	Messages  []message
+	EndOfChat   bool
+	NextBot     bool
+	NextSpeaker int
+	Messages    []message
+
+	// FirstCut is the number of bytes cut from the start
+	// of the first message when there is more than one
+	// message.
+	// A cut first message is only used as context.
+	FirstCut int
+
+	// LastCut is the number of bytes cut from the start of
+	// the last message.
+	LastCut int
 }
 
 // A SampleSet stores a set of conversational training
@@ -31,50 +79,16 @@ type snippet struct {
 // A training sample consists of a message and its
 // preceding messages if applicable.
 type SampleSet struct {
+	arch     *Architecture
 	snippets []snippet
 }
 
 // NewSampleSet loads a sample set from a directory of
 // conversation files or from a single conversation file.
-//
-// A conversation file must be formatted using CSV with
-// two columns: the sender and the message.
-// The sender is either "bot" or "human".
-//
-// The maxBuffer size specifies the maximum number of
-// characters in a generated training sequence.
+// It is equivalent to NewSampleSetOptions with nil
+// options.
 func NewSampleSet(path string, maxBuffer int) (*SampleSet, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var convos [][]message
-	if info.IsDir() {
-		listing, err := ioutil.ReadDir(path)
-		if err != nil {
-			return nil, err
-		}
-		for _, entry := range listing {
-			if strings.HasPrefix(entry.Name(), ".") {
-				continue
-			}
-			convoPath := filepath.Join(path, entry.Name())
-			convo, err := readConversationFile(convoPath)
-			if err != nil {
-				return nil, fmt.Errorf("load %s: %s", convoPath, err)
-			}
-			convos = append(convos, convo)
-		}
-	} else {
-		convo, err := readConversationFile(path)
-		if err != nil {
-			return nil, err
-		}
-		convos = [][]message{convo}
-	}
-
-	return newSampleSetConvos(convos, maxBuffer)
+	return NewSampleSetOptions(path, maxBuffer, nil)
 }
 
 // NewSampleSetReader loads a sample set by reading the
@@ -84,14 +98,18 @@ func NewSampleSetReader(in io.Reader, maxBuffer int) (*SampleSet, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newSampleSetConvos([][]message{convo}, maxBuffer)
+	return newSampleSetConvos([][]message{convo}, maxBuffer, nil)
 }
 
-func newSampleSetConvos(convos [][]message, maxBuffer int) (*SampleSet, error) {
-	res := &SampleSet{}
+func newSampleSetConvos(convos [][]message, maxBuffer int,
+	opts *LoadOptions) (*SampleSet, error) {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	res := &SampleSet{arch: opts.Arch}
 	for _, convo := range convos {
 		for i := range convo {
-			sn := generateSnippet(maxBuffer, convo, i)
+			sn, _ := opts.Snippets.generate(maxBuffer, convo, i)
 			if sn != nil {
 				res.snippets = append(res.snippets, *sn)
 			}
@@ -108,6 +126,7 @@ func (s *SampleSet) Len() int {
 // Copy returns a shallow copy of the sample set.
 func (s *SampleSet) Copy() sgd.SampleSet {
 	res := &SampleSet{
+		arch:     s.arch,
 		snippets: make([]snippet, len(s.snippets)),
 	}
 	copy(res.snippets, s.snippets)
@@ -122,38 +141,19 @@ func (s *SampleSet) Swap(i, j int) {
 // GetSample generates a seqtoseq.Sample for the snippet
 // at the given index.
 func (s *SampleSet) GetSample(idx int) interface{} {
-	sample := s.snippets[idx]
-	var inputSeq []linalg.Vector
-	for _, msg := range sample.Messages {
-		if msg.FromBot {
-			inputSeq = append(inputSeq, oneHotVector(StartBotMsg))
-		} else {
-			inputSeq = append(inputSeq, oneHotVector(StartExternalMsg))
-		}
-		for _, chr := range []byte(msg.Body) {
-			inputSeq = append(inputSeq, oneHotVector(int(chr)))
-		}
-	}
-
-	var outSeq []linalg.Vector
-	if sample.EndOfChat {
-		nextVec := make(linalg.Vector, InputCount)
-		nextVec[StartBotMsg] = 0.5
-		nextVec[StartExternalMsg] = 0.5
-		outSeq = append(inputSeq, nextVec)
-	} else if sample.NextBot {
-		outSeq = append(inputSeq, oneHotVector(StartBotMsg))
-	} else {
-		outSeq = append(inputSeq, oneHotVector(StartExternalMsg))
-	}
-	outSeq = outSeq[1:]
+	return s.snippets[idx].Sample(s.arch)
+}
 
-	return seqtoseq.Sample{Inputs: inputSeq, Outputs: outSeq}
+// SampleLength returns the number of timesteps in the
+// sample at the given index.
+func (s *SampleSet) SampleLength(idx int) int {
+	return s.snippets[idx].length()
 }
 
 // Subset returns a subset of this sample set.
 func (s *SampleSet) Subset(start, end int) sgd.SampleSet {
 	return &SampleSet{
+		arch:     s.arch,
 		snippets: s.snippets[start:end],
 	}
 }
@@ -163,65 +163,249 @@ func (s *SampleSet) Hash(i int) []byte {
 	return s.GetSample(i).(seqtoseq.Sample).Hash()
 }
 
-func generateSnippet(maxChars int, msgs []message, msgIdx int) *snippet {
-	var count int
-	for i := msgIdx; i >= 0; i-- {
-		msgLen := len(msgs[i].Body)
-		if msgLen == 0 {
-			break
-		}
-		if maxChars-msgLen <= 0 {
-			break
-		}
-		count++
-		maxChars -= msgLen
+// length returns the number of timesteps in the
+// snippet's sample.
+func (s *snippet) length() int {
+	res := len(s.Messages) - s.LastCut
+	if len(s.Messages) > 1 {
+		res -= s.FirstCut
 	}
-	if count == 0 {
-		return nil
+	for _, msg := range s.Messages {
+		res += len(msg.Body)
 	}
-	res := &snippet{
-		EndOfChat: msgIdx+1 == len(msgs),
-		Messages:  msgs[msgIdx+1-count : msgIdx+1],
+	return res
+}
+
+// Sample generates a seqtoseq.Sample for the snippet,
+// encoding inputs for the given architecture.
+//
+// Outputs which the bot should not be trained to produce,
+// such as the bytes of a cut first message or of a
+// duplicate message, are zero vectors.
+func (s *snippet) Sample(arch *Architecture) seqtoseq.Sample {
+	var inputSeq, outSeq []linalg.Vector
+	for i, msg := range s.Messages {
+		controls := InputControls{
+			Persona:    msg.Persona,
+			Attributes: msg.Attributes,
+		}
+		start := msg.startToken(arch)
+		body := msg.Body
+		firstCut := i == 0 && s.FirstCut > 0 && len(s.Messages) > 1
+		if firstCut {
+			body = body[s.FirstCut:]
+		}
+		contextOnly := firstCut || msg.Duplicate
+		lastCut := i == len(s.Messages)-1 && s.LastCut > 0
+		if lastCut {
+			body = body[s.LastCut:]
+		}
+		startControls := controls
+		startControls.Gap = msg.Gap
+		inputSeq = append(inputSeq, arch.InputVector(start, startControls))
+		outSeq = append(outSeq, arch.OutputVector(start))
+		for j, chr := range []byte(body) {
+			inputSeq = append(inputSeq, arch.InputVector(int(chr), controls))
+			if contextOnly || (lastCut && j == 0) {
+				outSeq = append(outSeq, make(linalg.Vector, arch.TokenCount()))
+			} else {
+				outSeq = append(outSeq, arch.OutputVector(int(chr)))
+			}
+		}
 	}
-	if msgIdx+1 < len(msgs) {
-		res.NextBot = msgs[msgIdx+1].FromBot
+
+	if s.EndOfChat {
+		nextVec := make(linalg.Vector, arch.TokenCount())
+		nextVec[StartBotMsg] = 0.5
+		nextVec[StartExternalMsg] = 0.5
+		outSeq = append(outSeq, nextVec)
+	} else if s.NextBot {
+		outSeq = append(outSeq, arch.OutputVector(StartBotMsg))
+	} else {
+		outSeq = append(outSeq, arch.OutputVector(arch.SpeakerToken(s.NextSpeaker)))
 	}
-	return res
+	outSeq = outSeq[1:]
+
+	return seqtoseq.Sample{Inputs: inputSeq, Outputs: outSeq}
 }
 
-func readConversationFile(file string) ([]message, error) {
-	f, err := os.Open(file)
+// readConversationsFile reads all of the conversations
+// from a file, choosing a format based on the file name.
+// Compressed files are decompressed transparently.
+//
+// Malformed rows in CSV files are handled by badRow, as
+// in readConversationRows.
+func readConversationsFile(file string, badRow func(err error) error) ([][]message, error) {
+	if filepath.Base(file) == cornellConvosFile {
+		return readCornell(filepath.Dir(file))
+	}
+	f, err := openCorpusFile(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return readConversation(f)
+	var convo []message
+	switch strings.ToLower(filepath.Ext(trimCompressionExt(file))) {
+	case ".srt":
+		return readSRT(f)
+	case ".json":
+		convo, err = readConversationJSON(f, badRow)
+	default:
+		convo, err = readConversationRows(f, badRow)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return [][]message{convo}, nil
 }
 
 func readConversation(f io.Reader) ([]message, error) {
+	return readConversationRows(f, func(err error) error {
+		return err
+	})
+}
+
+// readConversationRows reads a CSV conversation.
+//
+// Malformed rows are passed to badRow, which may either
+// return an error to abort reading or return nil to skip
+// the row.
+// Errors in the CSV syntax itself always abort reading.
+func readConversationRows(f io.Reader, badRow func(err error) error) ([]message, error) {
 	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
 
-	records, err := r.ReadAll()
-	if err != nil {
+	var result []message
+	var persona string
+	speakers := speakerIDs{}
+	for {
+		x, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		if len(x) < 2 || len(x) > 5 {
+			if err := badRow(fmt.Errorf("line %d: expected two to five columns", line)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if x[0] == "persona" {
+			persona = x[1]
+			continue
+		}
+		x = append(x, "", "", "")
+		record, err := speakers.message(x[0], x[2], x[3], x[1])
+		if err != nil {
+			if err := badRow(fmt.Errorf("line %d: %s", line, err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		record.Attributes = strings.Fields(x[4])
+		result = append(result, record)
+	}
+	setGaps(result)
+	setPersona(result, persona)
+
+	return result, nil
+}
+
+// readConversationJSON reads a JSON conversation, which
+// is an array of objects with "sender" and "body" fields,
+// and optionally "speaker" and "time" fields.
+// Times may be strings or numbers.
+//
+// The array may also be wrapped in an object, as the
+// "messages" field, with a "persona" field giving the
+// conversation's persona label.
+//
+// Malformed messages are handled by badRow, as they are
+// in readConversationRows.
+func readConversationJSON(f io.Reader, badRow func(err error) error) ([]message, error) {
+	type jsonMessage struct {
+		Sender     string          `json:"sender"`
+		Speaker    string          `json:"speaker"`
+		Time       json.RawMessage `json:"time"`
+		Attributes []string        `json:"attributes"`
+		Body       string          `json:"body"`
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
 		return nil, err
 	}
-	if len(records) == 0 {
-		return nil, nil
+	var convo struct {
+		Persona  string        `json:"persona"`
+		Messages []jsonMessage `json:"messages"`
 	}
-	if len(records[0]) != 2 {
-		return nil, errors.New("expected exactly two columns")
+	var err error
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(raw, &convo)
+	} else {
+		err = json.Unmarshal(raw, &convo.Messages)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	result := make([]message, len(records))
-	for i, x := range records {
-		record := message{Body: x[1]}
-		if x[0] == "bot" {
-			record.FromBot = true
-		} else if x[0] != "human" {
-			return nil, fmt.Errorf("record %d: unknown sender %s", i, x[0])
+	var result []message
+	speakers := speakerIDs{}
+	for i, obj := range convo.Messages {
+		var timestamp string
+		if len(obj.Time) > 0 && json.Unmarshal(obj.Time, &timestamp) != nil {
+			timestamp = string(obj.Time)
+		}
+		record, err := speakers.message(obj.Sender, obj.Speaker, timestamp, obj.Body)
+		if err != nil {
+			if err := badRow(fmt.Errorf("message %d: %s", i, err)); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		result[i] = record
+		record.Attributes = obj.Attributes
+		result = append(result, record)
 	}
-
+	setGaps(result)
+	setPersona(result, convo.Persona)
 	return result, nil
 }
+
+func setPersona(convo []message, persona string) {
+	for i := range convo {
+		convo[i].Persona = persona
+	}
+}
+
+// speakerIDs assigns numbers to the external speakers in
+// a conversation in order of appearance.
+type speakerIDs map[string]int
+
+// message creates a message from a sender ("bot" or
+// "human"), a speaker ID, an optional timestamp, and a
+// body.
+func (s speakerIDs) message(sender, speaker, timestamp, body string) (message, error) {
+	var res message
+	switch sender {
+	case "bot":
+		res = message{FromBot: true, Body: body}
+	case "human":
+		idx, ok := s[speaker]
+		if !ok {
+			idx = len(s)
+			s[speaker] = idx
+		}
+		res = message{Speaker: idx, Body: body}
+	default:
+		return message{}, fmt.Errorf("unknown sender %s", sender)
+	}
+	if timestamp != "" && timestamp != "null" {
+		t, err := parseTimestamp(timestamp)
+		if err != nil {
+			return message{}, fmt.Errorf("bad timestamp %q", timestamp)
+		}
+		res.Time = t
+	}
+	return res, nil
+}
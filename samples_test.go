@@ -0,0 +1,153 @@
+package chatbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestReadConversationControls(t *testing.T) {
+	csvData := "persona,alice\n" +
+		"human,hi,,2016-01-01T00:00:00Z,\n" +
+		"bot,hey there,,2016-01-01T00:30:00Z,formal short\n"
+	jsonData := `{"persona": "alice", "messages": [
+		{"sender": "human", "body": "hi", "time": "2016-01-01T00:00:00Z"},
+		{"sender": "bot", "body": "hey there", "time": 1451608200,
+		 "attributes": ["formal", "short"]}
+	]}`
+	fail := func(err error) error {
+		return err
+	}
+	csvConvo, err := readConversationRows(strings.NewReader(csvData), fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonConvo, err := readConversationJSON(strings.NewReader(jsonData), fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch := &Architecture{
+		StateSizes: []int{10},
+		TimeGaps:   true,
+		Personas:   []string{"bob", "alice"},
+		Attributes: []string{"short", "emoji", "formal"},
+	}
+	for name, convo := range map[string][]message{"csv": csvConvo, "json": jsonConvo} {
+		if len(convo) != 2 {
+			t.Errorf("%s: expected 2 messages but got %d", name, len(convo))
+			continue
+		}
+		for i, msg := range convo {
+			if msg.Persona != "alice" {
+				t.Errorf("%s: message %d has persona %q", name, i, msg.Persona)
+			}
+		}
+		if len(convo[0].Attributes) != 0 || convo[0].Gap != 0 {
+			t.Errorf("%s: unexpected first message %+v", name, convo[0])
+		}
+		// A 30 minute gap is in bucket 2.
+		if !reflect.DeepEqual(convo[1].Attributes, []string{"formal", "short"}) ||
+			convo[1].Gap != 3 {
+			t.Errorf("%s: unexpected second message %+v", name, convo[1])
+		}
+
+		sn, _ := (&SnippetOptions{}).generate(100, convo, 1)
+		inputs := sn.Sample(arch).Inputs
+		controls := func(idx int) linalg.Vector {
+			return inputs[idx][arch.TokenCount():]
+		}
+		tests := []struct {
+			idx      int
+			expected linalg.Vector
+		}{
+			// The start of the human message.
+			{0, linalg.Vector{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}},
+			// The start of the bot message has its gap.
+			{3, linalg.Vector{0, 0, 1, 0, 0, 0, 0, 0, 1, 1, 0, 1}},
+			// The bytes of the bot message do not.
+			{4, linalg.Vector{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 1}},
+		}
+		for _, test := range tests {
+			if actual := controls(test.idx); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("%s: input %d: expected controls %v but got %v", name, test.idx,
+					test.expected, actual)
+			}
+		}
+	}
+}
+
+func TestReadConversationSpeakers(t *testing.T) {
+	csvData := "human,hi,ann\n" +
+		"human,hello,ben\n" +
+		"bot,hey\n" +
+		"human,yo,ann\n" +
+		"human,sup,cat\n"
+	jsonData := `[
+		{"sender": "human", "body": "hi", "speaker": "ann"},
+		{"sender": "human", "body": "hello", "speaker": "ben"},
+		{"sender": "bot", "body": "hey"},
+		{"sender": "human", "body": "yo", "speaker": "ann"},
+		{"sender": "human", "body": "sup", "speaker": "cat"}
+	]`
+	fail := func(err error) error {
+		return err
+	}
+	csvConvo, err := readConversationRows(strings.NewReader(csvData), fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonConvo, err := readConversationJSON(strings.NewReader(jsonData), fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Speakers are numbered in order of appearance, and
+	// bot messages do not take up a number.
+	expected := []int{0, 1, 0, 0, 2}
+	arch := &Architecture{StateSizes: []int{10}, Speakers: 3}
+	for name, convo := range map[string][]message{"csv": csvConvo, "json": jsonConvo} {
+		if len(convo) != len(expected) {
+			t.Errorf("%s: expected %d messages but got %d", name, len(expected), len(convo))
+			continue
+		}
+		for i, msg := range convo {
+			if msg.FromBot != (i == 2) || msg.Speaker != expected[i] {
+				t.Errorf("%s: message %d: unexpected sender %+v", name, i, msg)
+			}
+		}
+
+		// The start of each message is marked with its
+		// speaker's token, and the last output predicts the
+		// start of the next message.
+		tests := []struct {
+			msgIdx     int
+			startInput int
+			nextToken  int
+		}{
+			{0, StartExternalMsg, InputCount},
+			{1, InputCount, StartBotMsg},
+			{3, StartExternalMsg, InputCount + 1},
+		}
+		for _, test := range tests {
+			sn, _ := (&SnippetOptions{}).generate(100, convo, test.msgIdx)
+			if sn == nil {
+				t.Errorf("%s: no snippet for message %d", name, test.msgIdx)
+				continue
+			}
+			sample := sn.Sample(arch)
+			startIdx := len(sample.Inputs) - len(convo[test.msgIdx].Body) - 1
+			if !reflect.DeepEqual(sample.Inputs[startIdx], arch.TokenVector(test.startInput)) {
+				t.Errorf("%s: message %d: expected start token %d", name, test.msgIdx,
+					test.startInput)
+			}
+			lastOut := sample.Outputs[len(sample.Outputs)-1]
+			if !reflect.DeepEqual(lastOut, arch.OutputVector(test.nextToken)) {
+				t.Errorf("%s: message %d: expected next token %d", name, test.msgIdx,
+					test.nextToken)
+			}
+		}
+	}
+}
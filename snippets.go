@@ -0,0 +1,189 @@
+package chatbot
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// An EmptyMessageMode determines how snippet generation
+// treats messages with empty bodies.
+type EmptyMessageMode int
+
+const (
+	// StopAtEmpty never trains on empty messages, and ends
+	// the history of a snippet at the first empty message.
+	StopAtEmpty EmptyMessageMode = iota
+
+	// SkipEmpty removes empty messages from conversations
+	// before snippets are generated.
+	SkipEmpty
+
+	// KeepEmpty encodes empty messages as a start token
+	// with no body, both in the history of a snippet and
+	// as the message to be trained on.
+	KeepEmpty
+)
+
+// String returns the flag name of the mode.
+func (e *EmptyMessageMode) String() string {
+	switch *e {
+	case SkipEmpty:
+		return "skip"
+	case KeepEmpty:
+		return "keep"
+	default:
+		return "stop"
+	}
+}
+
+// Set parses a mode from its flag name.
+func (e *EmptyMessageMode) Set(s string) error {
+	switch s {
+	case "stop":
+		*e = StopAtEmpty
+	case "skip":
+		*e = SkipEmpty
+	case "keep":
+		*e = KeepEmpty
+	default:
+		return fmt.Errorf("unknown empty message mode: %s", s)
+	}
+	return nil
+}
+
+// SnippetOptions controls how training snippets are
+// generated from conversations.
+//
+// The zero value generates a snippet for every non-empty
+// message which fits in the maximum buffer, with as many
+// whole preceding messages as fit before it.
+type SnippetOptions struct {
+	// TruncateHistory fills the space left in a snippet
+	// with the end of the first message that does not fit.
+	// The truncated message is only used as context; the
+	// bot is not trained to produce it.
+	TruncateHistory bool
+
+	// EmptyMessages determines how empty messages are
+	// handled.
+	EmptyMessages EmptyMessageMode
+
+	// MinContext is the number of bytes reserved for the
+	// history of every snippet that has history.
+	// Messages too long to leave this much room are cut
+	// from the front, and the bot is not trained to produce
+	// the first byte after the cut.
+	//
+	// If MinContext is 0, messages which do not fit in the
+	// maximum buffer are not trained on at all.
+	MinContext int
+}
+
+// filterEmpty removes empty messages from conversations
+// if the mode is SkipEmpty.
+func (s *SnippetOptions) filterEmpty(convos [][]message) [][]message {
+	if s.EmptyMessages != SkipEmpty {
+		return convos
+	}
+	for i, convo := range convos {
+		var filtered []message
+		for _, msg := range convo {
+			if msg.Body != "" {
+				filtered = append(filtered, msg)
+			}
+		}
+		convos[i] = filtered
+	}
+	return convos
+}
+
+// A snippetStop indicates why generate stopped adding
+// messages to a snippet.
+type snippetStop int
+
+const (
+	stopChatStart snippetStop = iota
+	stopEmptyMessage
+	stopMaxChars
+
+	// stopDuplicate means that there is no snippet because
+	// the message is a duplicate.
+	stopDuplicate
+)
+
+// generate creates the snippet which trains on the
+// message at msgIdx, or returns nil if there is no such
+// snippet.
+//
+// The bodies in a snippet contain fewer than maxChars
+// bytes in total.
+//
+// A nil *SnippetOptions is equivalent to the zero value.
+func (s *SnippetOptions) generate(maxChars int, msgs []message,
+	msgIdx int) (*snippet, snippetStop) {
+	var opts SnippetOptions
+	if s != nil {
+		opts = *s
+	}
+
+	if msgs[msgIdx].Duplicate {
+		return nil, stopDuplicate
+	}
+	last := msgs[msgIdx].Body
+	if last == "" && opts.EmptyMessages != KeepEmpty {
+		return nil, stopEmptyMessage
+	}
+
+	res := &snippet{EndOfChat: msgIdx+1 == len(msgs)}
+	if msgIdx+1 < len(msgs) {
+		res.NextBot = msgs[msgIdx+1].FromBot
+		res.NextSpeaker = msgs[msgIdx+1].Speaker
+	}
+
+	room := maxChars - 1
+	reserve := 0
+	if msgIdx > 0 {
+		reserve = opts.MinContext
+	}
+	if len(last) > room-reserve {
+		if opts.MinContext == 0 || room-reserve <= 0 {
+			return nil, stopMaxChars
+		}
+		res.LastCut = runeCut(last, len(last)-(room-reserve))
+	}
+	room -= len(last) - res.LastCut
+
+	count := 1
+	stop := stopChatStart
+	for i := msgIdx - 1; i >= 0; i-- {
+		body := msgs[i].Body
+		if body == "" && opts.EmptyMessages == StopAtEmpty {
+			stop = stopEmptyMessage
+			break
+		}
+		if len(body) > room {
+			stop = stopMaxChars
+			if opts.TruncateHistory && room > 0 {
+				if cut := runeCut(body, len(body)-room); cut < len(body) {
+					res.FirstCut = cut
+					count++
+				}
+			}
+			break
+		}
+		room -= len(body)
+		count++
+	}
+	res.Messages = msgs[msgIdx+1-count : msgIdx+1]
+	return res, stop
+}
+
+// runeCut returns the smallest index, no less than n, at
+// which body can be cut without splitting a UTF-8
+// sequence.
+func runeCut(body string, n int) int {
+	for n < len(body) && !utf8.RuneStart(body[n]) {
+		n++
+	}
+	return n
+}
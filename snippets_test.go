@@ -0,0 +1,72 @@
+package chatbot
+
+import "testing"
+
+func TestSnippetOptionsCounts(t *testing.T) {
+	convo := []message{
+		{Body: "hello there"},
+		{FromBot: true, Body: ""},
+		{Body: "how are you"},
+		{FromBot: true, Body: "this reply is much too long to fit"},
+		{Body: "ok"},
+	}
+	const maxBuffer = 20
+
+	tests := []struct {
+		name     string
+		opts     SnippetOptions
+		snippets int
+
+		// messages is the total number of messages in all
+		// of the snippets, including history.
+		messages int
+	}{
+		{"default", SnippetOptions{}, 3, 3},
+		{"skip empty", SnippetOptions{EmptyMessages: SkipEmpty}, 3, 3},
+		{"keep empty", SnippetOptions{EmptyMessages: KeepEmpty}, 4, 6},
+		{"truncate history", SnippetOptions{TruncateHistory: true}, 3, 4},
+		{"min context", SnippetOptions{MinContext: 5}, 4, 4},
+		{"min context and truncate", SnippetOptions{MinContext: 5, TruncateHistory: true}, 4, 6},
+	}
+	for _, test := range tests {
+		msgs := append([]message{}, convo...)
+		opts := test.opts
+		samples, err := newSampleSetConvos(opts.filterEmpty([][]message{msgs}), maxBuffer,
+			&LoadOptions{Snippets: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages int
+		for _, sn := range samples.snippets {
+			messages += len(sn.Messages)
+			if sn.length() > maxBuffer+len(sn.Messages) {
+				t.Errorf("%s: snippet is too long", test.name)
+			}
+		}
+		if samples.Len() != test.snippets {
+			t.Errorf("%s: expected %d snippets but got %d", test.name, test.snippets,
+				samples.Len())
+		}
+		if messages != test.messages {
+			t.Errorf("%s: expected %d messages but got %d", test.name, test.messages, messages)
+		}
+	}
+}
+
+func TestSnippetOptionsCuts(t *testing.T) {
+	convo := []message{
+		{Body: "how are you"},
+		{FromBot: true, Body: "this reply is much too long to fit"},
+		{Body: "ok"},
+	}
+	opts := SnippetOptions{TruncateHistory: true, MinContext: 5}
+
+	sn, _ := opts.generate(20, convo, 1)
+	if sn == nil || sn.LastCut != 20 || sn.FirstCut != 6 || len(sn.Messages) != 2 {
+		t.Errorf("unexpected long message snippet: %+v", sn)
+	}
+	sn, _ = opts.generate(20, convo, 2)
+	if sn == nil || sn.FirstCut != 17 || sn.LastCut != 0 || len(sn.Messages) != 2 {
+		t.Errorf("unexpected truncated history snippet: %+v", sn)
+	}
+}
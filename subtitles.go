@@ -0,0 +1,142 @@
+package chatbot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SubtitleGap is the amount of silence between two
+// subtitles which causes an SRT file to be split into
+// separate conversations.
+const SubtitleGap = time.Second * 6
+
+var (
+	srtTimingExpr = regexp.MustCompile(`^(\d+):(\d+):(\d+)[,.](\d+)\s*-->\s*(\d+):(\d+):(\d+)[,.](\d+)`)
+	srtTagExpr    = regexp.MustCompile(`<[^>]*>|\{[^}]*\}`)
+)
+
+type srtCue struct {
+	Start time.Duration
+	End   time.Duration
+	Lines []string
+}
+
+// readSRT reads an SRT subtitle file and turns it into
+// conversations.
+//
+// Every subtitle line is treated as a message, and the
+// sender alternates between a human and the bot.
+// A new conversation is started whenever there is more
+// than SubtitleGap between two subtitles.
+func readSRT(r io.Reader) ([][]message, error) {
+	cues, err := readSRTCues(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var res [][]message
+	var convo []message
+	var lastEnd time.Duration
+	for i, cue := range cues {
+		if i > 0 && cue.Start-lastEnd > SubtitleGap {
+			if len(convo) > 0 {
+				res = append(res, convo)
+			}
+			convo = nil
+		}
+		lastEnd = cue.End
+		for _, line := range splitSRTSpeakers(cue.Lines) {
+			convo = append(convo, message{
+				FromBot: len(convo)%2 == 1,
+				Body:    line,
+			})
+		}
+	}
+	if len(convo) > 0 {
+		res = append(res, convo)
+	}
+	return res, nil
+}
+
+func readSRTCues(r io.Reader) ([]srtCue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	var res []srtCue
+	var cur *srtCue
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if lineNum == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if cur == nil {
+			if match := srtTimingExpr.FindStringSubmatch(line); match != nil {
+				res = append(res, srtCue{
+					Start: parseSRTTime(match[1:5]),
+					End:   parseSRTTime(match[5:9]),
+				})
+				cur = &res[len(res)-1]
+			} else if strings.TrimSpace(line) != "" {
+				if _, err := strconv.Atoi(strings.TrimSpace(line)); err != nil {
+					return nil, fmt.Errorf("line %d: unexpected text: %s", lineNum, line)
+				}
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			cur = nil
+			continue
+		}
+		cur.Lines = append(cur.Lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %s", lineNum+1, err)
+	}
+	return res, nil
+}
+
+func parseSRTTime(fields []string) time.Duration {
+	var nums [4]int
+	for i, f := range fields {
+		nums[i], _ = strconv.Atoi(f)
+	}
+	return time.Duration(nums[0])*time.Hour + time.Duration(nums[1])*time.Minute +
+		time.Duration(nums[2])*time.Second + time.Duration(nums[3])*time.Millisecond
+}
+
+// splitSRTSpeakers joins the lines of a subtitle into
+// messages.
+//
+// Lines starting with a dash indicate a change of speaker
+// within a single subtitle, so they start new messages.
+func splitSRTSpeakers(lines []string) []string {
+	var res []string
+	var cur string
+	for _, line := range lines {
+		line = strings.TrimSpace(srtTagExpr.ReplaceAllString(line, ""))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "-") {
+			if cur != "" {
+				res = append(res, cur)
+			}
+			cur = strings.TrimSpace(strings.TrimLeft(line, "-"))
+		} else if cur == "" {
+			cur = line
+		} else {
+			cur += " " + line
+		}
+	}
+	if cur != "" {
+		res = append(res, cur)
+	}
+	return res
+}
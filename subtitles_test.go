@@ -0,0 +1,58 @@
+package chatbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSRT(t *testing.T) {
+	srt := "\ufeff1\r\n" +
+		"00:00:01,000 --> 00:00:02,000\r\n" +
+		"Hello there.\r\n" +
+		"\r\n" +
+		"2\r\n" +
+		"00:00:03,000 --> 00:00:04,500\r\n" +
+		"- How are you?\r\n" +
+		"- <i>Fine</i>, thanks.\r\n" +
+		"\r\n" +
+		"3\r\n" +
+		"00:00:10,500 --> 00:00:11,000\r\n" +
+		"Good to hear.\r\n" +
+		"\r\n" +
+		"4\r\n" +
+		"00:00:17,001 --> 00:00:18,000\r\n" +
+		"A new scene\r\n" +
+		"starts here.\r\n"
+	convos, err := readSRT(strings.NewReader(srt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]message{
+		{
+			{Body: "Hello there."},
+			{FromBot: true, Body: "How are you?"},
+			{Body: "Fine, thanks."},
+			{FromBot: true, Body: "Good to hear."},
+		},
+		{
+			{Body: "A new scene starts here."},
+		},
+	}
+	if !reflect.DeepEqual(convos, expected) {
+		t.Errorf("expected %v but got %v", expected, convos)
+	}
+}
+
+func TestReadSRTMalformed(t *testing.T) {
+	tests := []string{
+		"Hello there.\n",
+		"1\nHello there.\n",
+		"1\n00:00:01,000 --> 00:00:02,000\nHi\n\nnot a cue\n",
+	}
+	for i, test := range tests {
+		if _, err := readSRT(strings.NewReader(test)); err == nil {
+			t.Errorf("test %d: expected an error", i)
+		}
+	}
+}
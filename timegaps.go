@@ -0,0 +1,91 @@
+package chatbot
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GapBucketCount is the number of buckets which time gaps
+// between messages are sorted into.
+const GapBucketCount = len(gapBounds) + 1
+
+// gapBounds are the exclusive upper bounds of every gap
+// bucket but the last.
+var gapBounds = [...]time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// GapBucket returns the bucket, from 0 to
+// GapBucketCount-1, for the time between two messages.
+//
+// The buckets grow roughly logarithmically, from pauses
+// under a minute to pauses of more than a week.
+func GapBucket(gap time.Duration) int {
+	for i, bound := range gapBounds {
+		if gap < bound {
+			return i
+		}
+	}
+	return len(gapBounds)
+}
+
+// maxUnixSeconds bounds the number of seconds since
+// the Unix epoch which a timestamp may have, so that the
+// time fits in an int64 of nanoseconds.
+const maxUnixSeconds = math.MaxInt64 / float64(time.Second)
+
+// unixMillisThreshold is the magnitude above which
+// numeric timestamps are read as milliseconds, which is
+// in the year 5138 as seconds, and in 1973 as
+// milliseconds.
+const unixMillisThreshold = 1e11
+
+// parseTimestamp parses a message timestamp, which is
+// either in RFC 3339 format, in the format
+// "2006-01-02 15:04:05", or a number of seconds or
+// milliseconds since the Unix epoch.
+// Numbers with magnitudes above 1e11 are treated as
+// milliseconds, as in many chat exports.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05", s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.Abs(secs) > unixMillisThreshold {
+		secs /= 1000
+	}
+	if !(math.Abs(secs) < maxUnixSeconds) {
+		return time.Time{}, errors.New("timestamp out of range: " + s)
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), nil
+}
+
+// setGaps fills in the Gap of every message which has a
+// timestamp and follows a message with a timestamp.
+func setGaps(convo []message) {
+	for i := 1; i < len(convo); i++ {
+		if convo[i].Time.IsZero() || convo[i-1].Time.IsZero() {
+			continue
+		}
+		gap := convo[i].Time.Sub(convo[i-1].Time)
+		if gap < 0 {
+			gap = 0
+		}
+		convo[i].Gap = GapBucket(gap) + 1
+	}
+}
@@ -0,0 +1,84 @@
+package chatbot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGapBucket(t *testing.T) {
+	tests := []struct {
+		gap      time.Duration
+		expected int
+	}{
+		{0, 0},
+		{time.Minute - 1, 0},
+		{time.Minute, 1},
+		{10*time.Minute - 1, 1},
+		{10 * time.Minute, 2},
+		{time.Hour - 1, 2},
+		{time.Hour, 3},
+		{6*time.Hour - 1, 3},
+		{6 * time.Hour, 4},
+		{24*time.Hour - 1, 4},
+		{24 * time.Hour, 5},
+		{7*24*time.Hour - 1, 5},
+		{7 * 24 * time.Hour, 6},
+		{365 * 24 * time.Hour, 6},
+	}
+	for _, test := range tests {
+		if actual := GapBucket(test.gap); actual != test.expected {
+			t.Errorf("%s: expected bucket %d but got %d", test.gap, test.expected, actual)
+		}
+	}
+	if GapBucketCount != 7 {
+		t.Errorf("unexpected bucket count %d", GapBucketCount)
+	}
+}
+
+func TestSetGaps(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	convo := []message{
+		{Time: start},
+		{Time: start.Add(30 * time.Second)},
+		{},
+		{Time: start.Add(2 * time.Hour)},
+		{Time: start.Add(3 * time.Hour)},
+		{Time: start.Add(time.Hour)},
+	}
+	setGaps(convo)
+	var gaps []int
+	for _, msg := range convo {
+		gaps = append(gaps, msg.Gap)
+	}
+	// Messages after an unknown time have no gap, and
+	// messages out of order have a zero gap.
+	expected := []int{0, 1, 0, 0, 4, 1}
+	if !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("expected gaps %v but got %v", expected, gaps)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, s := range []string{
+		"2016-01-02T03:04:05Z",
+		"2016-01-02 03:04:05",
+		" 1451703845 ",
+		"1451703845.0",
+		"1451703845000",
+		"1451703845000.0",
+	} {
+		actual, err := parseTimestamp(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+		} else if !actual.Equal(expected) {
+			t.Errorf("%q: expected %s but got %s", s, expected, actual)
+		}
+	}
+	for _, s := range []string{"yesterday", "1e30", "-1e30", "NaN", "Inf"} {
+		if _, err := parseTimestamp(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
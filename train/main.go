@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/unixpickle/chatbot"
@@ -21,62 +24,139 @@ const (
 )
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, "Usage: train <samples> <output>")
-		os.Exit(1)
+	var loadOpts chatbot.LoadOptions
+	loadOpts.AddFlags(flag.CommandLine)
+	embedding := flag.Int("embedding", 0, "input embedding size for new bots (0 for one-hot)")
+	speakers := flag.Int("speakers", 1, "external speakers new bots can tell apart")
+	timeGaps := flag.Bool("time-gaps", false, "give new bots inputs for the time between messages")
+	personas := flag.String("personas", "", "comma-separated persona labels for new bots")
+	attributes := flag.String("attributes", "", "comma-separated attribute labels for new bots")
+	temperature := flag.Float64("temperature", 1, "mixing temperature for unweighted corpora")
+	batchSize := flag.Int("batch", BatchSize, "maximum samples per batch (0 for no limit)")
+	tokenBudget := flag.Int("token-budget", 0,
+		"maximum bytes per batch, including padding (0 for no limit)")
+	bucket := flag.Bool("bucket", true, "batch samples of similar lengths together")
+	workers := flag.Int("workers", 1, "goroutines to split each batch between")
+	seed := flag.Int64("seed", 0, "random seed (0 to seed from the clock)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: train [flags] <samples[:weight]>... <output>")
+		flag.PrintDefaults()
 	}
-
-	samples, err := chatbot.NewSampleSet(os.Args[1], MaxBufferChars)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to load samples:", err)
+	flag.Parse()
+	if flag.NArg() < 2 || (*batchSize == 0 && *tokenBudget == 0) {
+		flag.Usage()
 		os.Exit(1)
-	} else if samples.Len() == 0 {
-		fmt.Fprintln(os.Stderr, "No samples loaded.")
+	}
+	if !(*temperature > 0) {
+		fmt.Fprintln(os.Stderr, "Invalid temperature:", *temperature)
 		os.Exit(1)
 	}
+	samplesPaths, outputPath := flag.Args()[:flag.NArg()-1], flag.Arg(flag.NArg()-1)
 
-	bot, err := chatbot.LoadBot(os.Args[2])
+	if *seed != 0 {
+		rand.Seed(*seed)
+	} else {
+		rand.Seed(time.Now().UnixNano())
+	}
+
+	arch := chatbot.DefaultArchitecture()
+	arch.Embedding = *embedding
+	arch.Speakers = *speakers
+	arch.TimeGaps = *timeGaps
+	if *personas != "" {
+		arch.Personas = strings.Split(*personas, ",")
+	}
+	if *attributes != "" {
+		arch.Attributes = strings.Split(*attributes, ",")
+	}
+
+	bot, err := chatbot.LoadBot(outputPath)
 	if os.IsNotExist(err) {
 		log.Println("Creating bot...")
-		bot = chatbot.NewBot()
+		if err := arch.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid architecture:", err)
+			os.Exit(1)
+		}
+		bot = chatbot.NewBotArchitecture(arch)
 	} else if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to load bot:", err)
 		os.Exit(1)
+	} else if err := checkArchFlags(bot.Arch, arch); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 	bot.Dropout(true)
 
+	loadOpts.Arch = bot.Arch
+	if loadOpts.Arch == nil {
+		loadOpts.Arch = chatbot.DefaultArchitecture()
+	}
+	samples, err := chatbot.LoadWeightedSamples(samplesPaths, MaxBufferChars, &loadOpts,
+		*temperature)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load samples:", err)
+		os.Exit(1)
+	} else if samples.Len() == 0 {
+		fmt.Fprintln(os.Stderr, "No samples loaded.")
+		os.Exit(1)
+	}
+
 	log.Println("Partitioning", samples.Len(), "samples...")
-	training, validation := sgd.HashSplit(samples, 0.9)
+	training, validation := chatbot.HashSplit(samples, 0.9)
+
+	if *bucket {
+		log.Println("Bucketing samples by length...")
+	}
+	sampler := chatbot.NewBucketSampler(training, *batchSize, *tokenBudget)
+	sampler.Unbucketed = !*bucket
 
 	log.Println("Training...")
 
 	costFunc := neuralnet.DotCost{}
-	gradienter := &sgd.Adam{
-		Gradienter: &seqtoseq.Gradienter{
-			SeqFunc:  &rnn.BlockSeqFunc{B: bot.Block},
+	var gradienters []sgd.Gradienter
+	for i := 0; i < *workers || i == 0; i++ {
+		dropoutRand := rand.New(rand.NewSource(rand.Int63()))
+		gradienters = append(gradienters, &seqtoseq.Gradienter{
+			SeqFunc:  &rnn.BlockSeqFunc{B: bot.DropoutBlock(dropoutRand)},
 			Learner:  bot.Block.(sgd.Learner),
 			CostFunc: costFunc,
-		},
+		})
+	}
+	parallel, err := chatbot.NewParallelGradienter(gradienters)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gradienter := &sgd.Adam{Gradienter: parallel}
+
+	// Costs are computed in batches of the training batch
+	// size, or of BatchSize if only the token budget limits
+	// batches.
+	logBatch := *batchSize
+	if logBatch == 0 {
+		logBatch = BatchSize
 	}
 
 	var iteration int
 	var lastBatch sgd.SampleSet
-	sgd.SGDMini(gradienter, training, StepSize, BatchSize, func(s sgd.SampleSet) bool {
+	chatbot.SGDBucketed(gradienter, sampler, StepSize, func(s sgd.SampleSet) bool {
 		if iteration%4 == 0 {
 			bot.Dropout(false)
 			defer bot.Dropout(true)
 			var lastCost float64
 			if lastBatch != nil {
-				lastCost = seqtoseq.TotalCostBlock(bot.Block, BatchSize, lastBatch, costFunc)
+				lastCost = seqtoseq.TotalCostBlock(bot.Block, logBatch, lastBatch, costFunc)
 			}
 			lastBatch = s.Copy()
-			newCost := seqtoseq.TotalCostBlock(bot.Block, BatchSize, s, costFunc)
+			newCost := seqtoseq.TotalCostBlock(bot.Block, logBatch, s, costFunc)
 
 			sgd.ShuffleSampleSet(validation)
-			validationCost := seqtoseq.TotalCostBlock(bot.Block, BatchSize,
-				validation.Subset(0, BatchSize), costFunc)
+			n := logBatch
+			if n > validation.Len() {
+				n = validation.Len()
+			}
+			validationCost := seqtoseq.TotalCostBlock(bot.Block, logBatch,
+				validation.Subset(0, n), costFunc)
 
 			log.Printf("iter %d: validation=%f cost=%f last=%f", iteration, validationCost,
 				newCost, lastCost)
@@ -86,8 +166,53 @@ func main() {
 		return true
 	})
 
-	if err := bot.Save(os.Args[2]); err != nil {
+	if err := bot.Save(outputPath); err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to save output:", err)
 		os.Exit(1)
 	}
 }
+
+// checkArchFlags makes sure that the architecture flags
+// which were passed on the command line agree with the
+// architecture of an existing bot, since they only apply
+// to new bots.
+func checkArchFlags(existing, requested *chatbot.Architecture) error {
+	if existing == nil {
+		existing = chatbot.DefaultArchitecture()
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		oldValue, ok := archFlagValue(existing, f.Name)
+		if !ok || err != nil {
+			return
+		}
+		if newValue, _ := archFlagValue(requested, f.Name); newValue != oldValue {
+			err = fmt.Errorf("-%s=%s does not match the existing bot, which has %s",
+				f.Name, newValue, oldValue)
+		}
+	})
+	return err
+}
+
+// archFlagValue formats the field of an architecture
+// which is set by a flag.
+// It returns false if the flag does not set a field.
+func archFlagValue(arch *chatbot.Architecture, name string) (string, bool) {
+	switch name {
+	case "embedding":
+		return strconv.Itoa(arch.Embedding), true
+	case "speakers":
+		// Zero and one speaker are the same.
+		if arch.Speakers <= 1 {
+			return "1", true
+		}
+		return strconv.Itoa(arch.Speakers), true
+	case "time-gaps":
+		return strconv.FormatBool(arch.TimeGaps), true
+	case "personas":
+		return strings.Join(arch.Personas, ","), true
+	case "attributes":
+		return strings.Join(arch.Attributes, ","), true
+	}
+	return "", false
+}